@@ -15,15 +15,49 @@ import (
 const BuffSize = 1024
 
 var portNumber = flag.Int("port", 4242, "Port number of server")
+var wsPortNumber = flag.Int("ws-port", 0, "Port number of WebSocket gateway, disabled when 0")
+var ircPortNumber = flag.Int("irc-port", 0, "Port number of IRC front-end, disabled when 0")
+var opPassword = flag.String("op-password", "", "Password for /op command, commands are disabled when empty")
+var banFile = flag.String("ban-file", "", "File the ban list is persisted to")
+var maxMessageLen = flag.Int("max-msg-len", 0, "Maximum message length, 0 means unlimited")
+var msgRate = flag.Float64("rate", 0, "Messages per second allowed per user, 0 means unlimited")
+var msgBurst = flag.Int("burst", 5, "Messages user can send at once before rate limit applies")
 
 func main() {
 	flag.Parse()
+	bans, err := LoadBanList(*banFile)
+	if err != nil {
+		log.Fatal(err)
+	}
 	server := NewServer()
+	server.mod = Moderation{
+		OpPassword:    *opPassword,
+		MaxMessageLen: *maxMessageLen,
+		Rate:          *msgRate,
+		Burst:         *msgBurst,
+		Bans:          bans,
+	}
 	handler := pserver.WithMiddleware(
 		server.handleConnection,
 		pserver.LoggingMiddleware,
 	)
 
+	if *wsPortNumber != 0 {
+		go func() {
+			log.Fatal(ListenServeWebSocket(handler, *wsPortNumber))
+		}()
+	}
+
+	if *ircPortNumber != 0 {
+		ircHandler := pserver.WithMiddleware(
+			server.handleIRCConnection,
+			pserver.LoggingMiddleware,
+		)
+		go func() {
+			log.Fatal(pserver.ListenServe(ircHandler, *ircPortNumber))
+		}()
+	}
+
 	log.Fatal(pserver.ListenServe(handler, *portNumber))
 }
 
@@ -33,19 +67,61 @@ func isValidUsername(username string) bool {
 }
 
 type Server struct {
-	users map[string]chan string
+	users map[string]*user
+	mod   Moderation
 
 	mu sync.Mutex
 }
 
+type user struct {
+	ch    chan Event
+	conn  net.Conn
+	ip    string
+	op    bool
+	muted bool
+	// opFailures counts wrong /op passwords
+	opFailures int
+}
+
 func NewServer() *Server {
 	return &Server{
-		users: make(map[string]chan string),
+		users: make(map[string]*user),
+		mod:   Moderation{Bans: newBanList("")},
 		mu:    sync.Mutex{},
 	}
 }
 
-func (s *Server) AddUser(name string) (chan string, error) {
+type EventKind int
+
+const (
+	EventJoin EventKind = iota
+	EventLeave
+	EventMessage
+)
+
+// Event is delivered to every participant of the room, each front-end
+// renders it in its own protocol
+type Event struct {
+	Kind EventKind
+	Name string
+	Text string
+}
+
+// String renders event as budgetchat line
+func (e Event) String() string {
+	switch e.Kind {
+	case EventJoin:
+		return fmt.Sprintf("* %s has entered the room\n", e.Name)
+	case EventLeave:
+		return fmt.Sprintf("* %s has left the room\n", e.Name)
+	default:
+		return fmt.Sprintf("[%s] %s\n", e.Name, e.Text)
+	}
+}
+
+// AddUser registers user in the room, conn is used by operators to kick the user
+// and may be nil for users that cannot be disconnected
+func (s *Server) AddUser(name string, conn net.Conn) (chan Event, error) {
 	if ok := isValidUsername(name); !ok {
 		return nil, fmt.Errorf("user name %s is invalid", name)
 	}
@@ -55,11 +131,15 @@ func (s *Server) AddUser(name string) (chan string, error) {
 	if _, ok := s.users[name]; ok {
 		return nil, fmt.Errorf("user named %s already exists", name)
 	}
-	ch := make(chan string, 100)
-	s.users[name] = ch
-	for uname, userCh := range s.users {
+	ch := make(chan Event, 100)
+	u := &user{ch: ch, conn: conn}
+	if conn != nil {
+		u.ip = hostOf(conn.RemoteAddr())
+	}
+	s.users[name] = u
+	for uname, other := range s.users {
 		if uname != name {
-			userCh <- fmt.Sprintf("* %s has entered the room\n", name)
+			other.ch <- Event{Kind: EventJoin, Name: name}
 		}
 	}
 	return ch, nil
@@ -70,8 +150,8 @@ func (s *Server) RemoveUser(name string) error {
 	defer s.mu.Unlock()
 
 	delete(s.users, name)
-	for _, userChan := range s.users {
-		userChan <- fmt.Sprintf("* %s has left the room\n", name)
+	for _, u := range s.users {
+		u.ch <- Event{Kind: EventLeave, Name: name}
 	}
 
 	return nil
@@ -81,13 +161,20 @@ func (s *Server) SendMessage(name string, msg string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	for uname, userChan := range s.users {
+	for uname, u := range s.users {
 		if uname != name {
-			userChan <- fmt.Sprintf("[%s] %s\n", name, msg)
+			u.ch <- Event{Kind: EventMessage, Name: name, Text: msg}
 		}
 	}
 }
 
+func (s *Server) hasUser(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.users[name]
+	return ok
+}
+
 func (s *Server) GetParticipants(name string) []string {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -111,7 +198,13 @@ func (s *Server) handleConnection(conn net.Conn) {
 	}
 	line = strings.TrimSpace(line)
 
-	ch, err := s.AddUser(line)
+	if s.isBanned(line, conn) {
+		_, _ = conn.Write([]byte("You are banned\n"))
+		log.Printf("error: %s from %s: %v\n", line, conn.RemoteAddr(), ErrBanned)
+		return
+	}
+
+	ch, err := s.AddUser(line, conn)
 
 	if err != nil {
 		_, _ = conn.Write([]byte("Something went wrong"))
@@ -121,10 +214,10 @@ func (s *Server) handleConnection(conn net.Conn) {
 	uname := line
 
 	defer s.RemoveUser(line)
-	go func(ch chan string) {
+	go func(ch chan Event) {
 		for {
-			msg := <-ch
-			conn.Write([]byte(msg))
+			ev := <-ch
+			conn.Write([]byte(ev.String()))
 		}
 	}(ch)
 
@@ -138,6 +231,7 @@ func (s *Server) handleConnection(conn net.Conn) {
 	msg += "\n"
 	_, _ = conn.Write([]byte(msg))
 
+	bucket := s.newBucket()
 	for {
 		line, err := reader.ReadString('\n')
 		if err != nil {
@@ -146,6 +240,20 @@ func (s *Server) handleConnection(conn net.Conn) {
 		}
 		line = strings.TrimSpace(line)
 		log.Printf("%s: %s", uname, line)
+		if s.mod.OpPassword != "" && isCommand(line) {
+			reply, disconnect := s.handleCommand(uname, line, bucket)
+			_, _ = conn.Write([]byte(reply))
+			if disconnect {
+				return
+			}
+			continue
+		}
+		if reason, rejected := s.rejectMessage(uname, line, bucket); rejected {
+			if reason != "" {
+				_, _ = conn.Write([]byte("* " + reason + "\n"))
+			}
+			continue
+		}
 		s.SendMessage(uname, line)
 	}
 }
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bean/pkg/pserver"
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+const (
+	ircServerName = "budgetchat"
+	ircChannel    = "#budgetchat"
+)
+
+// ircMessage is single parsed IRC line, prefix sent by clients is ignored
+type ircMessage struct {
+	Command string
+	Params  []string
+}
+
+// parseIRCLine splits line into command and parameters, trailing parameter
+// (starting with colon) may contain spaces
+func parseIRCLine(line string) ircMessage {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, ":") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+
+	var msg ircMessage
+	for line != "" {
+		line = strings.TrimLeft(line, " ")
+		if strings.HasPrefix(line, ":") {
+			msg.Params = append(msg.Params, line[1:])
+			break
+		}
+		var part string
+		part, line, _ = strings.Cut(line, " ")
+		if part == "" {
+			continue
+		}
+		if msg.Command == "" {
+			msg.Command = strings.ToUpper(part)
+		} else {
+			msg.Params = append(msg.Params, part)
+		}
+	}
+	return msg
+}
+
+// ircSession keeps state of single IRC client, room membership starts at JOIN
+type ircSession struct {
+	s    *Server
+	conn net.Conn
+
+	nick       string
+	registered bool
+	gotUser    bool
+
+	joined bool
+	stop   chan struct{}
+	bucket *tokenBucket
+}
+
+// handleIRCConnection serves subset of IRC protocol, the only channel is
+// #budgetchat which is the same room TCP users are in
+func (s *Server) handleIRCConnection(conn net.Conn) {
+	defer pserver.HandleConnShutdown(conn)
+
+	is := &ircSession{
+		s:      s,
+		conn:   conn,
+		bucket: s.newBucket(),
+	}
+	defer is.part()
+
+	reader := bufio.NewReaderSize(conn, BuffSize)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			log.Printf("error when reading from socket: %v", err)
+			return
+		}
+		msg := parseIRCLine(line)
+		if msg.Command == "" {
+			continue
+		}
+		if !is.handle(msg) {
+			return
+		}
+	}
+}
+
+// handle executes single command, returns false when connection should be closed
+func (is *ircSession) handle(msg ircMessage) bool {
+	switch msg.Command {
+	case "CAP":
+		// capability negotiation is not supported, clients continue without it
+		return true
+	case "PING":
+		token := ircServerName
+		if len(msg.Params) > 0 {
+			token = msg.Params[0]
+		}
+		is.send(fmt.Sprintf(":%s PONG %s :%s", ircServerName, ircServerName, token))
+		return true
+	case "QUIT":
+		is.send("ERROR :Closing link")
+		return false
+	case "NICK":
+		is.handleNick(msg.Params)
+		return true
+	case "USER":
+		if is.registered {
+			is.numeric("462", ":You may not reregister")
+			return true
+		}
+		if len(msg.Params) < 4 {
+			is.numeric("461", "USER :Not enough parameters")
+			return true
+		}
+		is.gotUser = true
+		is.tryRegister()
+		return true
+	}
+
+	if !is.registered {
+		is.numeric("451", ":You have not registered")
+		return true
+	}
+
+	switch msg.Command {
+	case "JOIN":
+		is.handleJoin(msg.Params)
+	case "PART":
+		if !is.joined {
+			is.numeric("442", ircChannel+" :You're not on that channel")
+			return true
+		}
+		is.send(fmt.Sprintf(":%s PART %s", is.mask(is.nick), ircChannel))
+		is.part()
+	case "NAMES":
+		is.sendNames()
+	case "PRIVMSG":
+		is.handlePrivmsg(msg.Params)
+	default:
+		is.numeric("421", msg.Command+" :Unknown command")
+	}
+	return true
+}
+
+func (is *ircSession) handleNick(params []string) {
+	if len(params) == 0 {
+		is.numeric("431", ":No nickname given")
+		return
+	}
+	nick := params[0]
+	if is.joined {
+		is.numeric("447", ":Cannot change nickname while in "+ircChannel)
+		return
+	}
+	if !isValidUsername(nick) {
+		is.numeric("432", nick+" :Erroneous nickname")
+		return
+	}
+	if is.s.hasUser(nick) {
+		is.numeric("433", nick+" :Nickname is already in use")
+		return
+	}
+	is.nick = nick
+	is.tryRegister()
+}
+
+func (is *ircSession) tryRegister() {
+	if is.registered || is.nick == "" || !is.gotUser {
+		return
+	}
+	is.registered = true
+	is.numeric("001", fmt.Sprintf(":Welcome to budgetchat %s, join %s to chat", is.nick, ircChannel))
+	is.numeric("422", ":MOTD File is missing")
+}
+
+func (is *ircSession) handleJoin(params []string) {
+	if len(params) == 0 {
+		is.numeric("461", "JOIN :Not enough parameters")
+		return
+	}
+	for _, channel := range strings.Split(params[0], ",") {
+		if channel != ircChannel {
+			is.numeric("403", channel+" :No such channel")
+			continue
+		}
+		if is.joined {
+			continue
+		}
+		if is.s.isBanned(is.nick, is.conn) {
+			is.numeric("474", ircChannel+" :Cannot join channel (you are banned)")
+			continue
+		}
+		ch, err := is.s.AddUser(is.nick, is.conn)
+		if err != nil {
+			log.Printf("error: %s\n", err)
+			is.numeric("433", is.nick+" :Nickname is already in use")
+			continue
+		}
+		is.joined = true
+		is.stop = make(chan struct{})
+		go is.forward(ch, is.stop)
+
+		is.send(fmt.Sprintf(":%s JOIN %s", is.mask(is.nick), ircChannel))
+		is.numeric("331", ircChannel+" :No topic is set")
+		is.sendNames()
+	}
+}
+
+func (is *ircSession) handlePrivmsg(params []string) {
+	if len(params) < 2 {
+		is.numeric("412", ":No text to send")
+		return
+	}
+	if params[0] != ircChannel {
+		is.numeric("401", params[0]+" :No such nick/channel")
+		return
+	}
+	if !is.joined {
+		is.numeric("404", ircChannel+" :Cannot send to channel")
+		return
+	}
+	text := strings.TrimSpace(params[1])
+	if reason, rejected := is.s.rejectMessage(is.nick, text, is.bucket); rejected {
+		if reason != "" {
+			is.send(fmt.Sprintf(":%s NOTICE %s :%s", ircServerName, is.nick, reason))
+		}
+		return
+	}
+	is.s.SendMessage(is.nick, text)
+}
+
+func (is *ircSession) sendNames() {
+	names := []string{}
+	if is.joined {
+		names = append(names, is.nick)
+	}
+	names = append(names, is.s.GetParticipants(is.nick)...)
+	is.numeric("353", fmt.Sprintf("= %s :%s", ircChannel, strings.Join(names, " ")))
+	is.numeric("366", ircChannel+" :End of /NAMES list")
+}
+
+// forward translates room events to IRC messages until stop is closed
+func (is *ircSession) forward(ch chan Event, stop chan struct{}) {
+	for {
+		select {
+		case ev := <-ch:
+			switch ev.Kind {
+			case EventJoin:
+				is.send(fmt.Sprintf(":%s JOIN %s", is.mask(ev.Name), ircChannel))
+			case EventLeave:
+				is.send(fmt.Sprintf(":%s PART %s", is.mask(ev.Name), ircChannel))
+			case EventMessage:
+				is.send(fmt.Sprintf(":%s PRIVMSG %s :%s", is.mask(ev.Name), ircChannel, ev.Text))
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// part removes user from the room, it's noop when user is not in the room
+func (is *ircSession) part() {
+	if !is.joined {
+		return
+	}
+	is.joined = false
+	close(is.stop)
+	_ = is.s.RemoveUser(is.nick)
+}
+
+func (is *ircSession) mask(nick string) string {
+	return fmt.Sprintf("%s!%s@%s", nick, nick, ircServerName)
+}
+
+func (is *ircSession) numeric(code, rest string) {
+	target := is.nick
+	if target == "" {
+		target = "*"
+	}
+	is.send(fmt.Sprintf(":%s %s %s %s", ircServerName, code, target, rest))
+}
+
+func (is *ircSession) send(line string) {
+	if _, err := is.conn.Write([]byte(line + "\r\n")); err != nil {
+		log.Printf("error writing to irc client %s: %v\n", is.nick, err)
+	}
+}
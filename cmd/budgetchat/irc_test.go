@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseIRCLine(t *testing.T) {
+	var tests = []struct {
+		line    string
+		command string
+		params  []string
+	}{
+		{"NICK alice\r\n", "NICK", []string{"alice"}},
+		{"USER alice 0 * :Alice Smith\r\n", "USER", []string{"alice", "0", "*", "Alice Smith"}},
+		{":alice PRIVMSG #budgetchat :hello: world\r\n", "PRIVMSG", []string{"#budgetchat", "hello: world"}},
+		{"ping  token\n", "PING", []string{"token"}},
+		{"\r\n", "", nil},
+	}
+
+	for _, tt := range tests {
+		got := parseIRCLine(tt.line)
+		if got.Command != tt.command {
+			t.Errorf("%q: got command %q, want %q\n", tt.line, got.Command, tt.command)
+		}
+		if !slices.Equal(got.Params, tt.params) {
+			t.Errorf("%q: got params %q, want %q\n", tt.line, got.Params, tt.params)
+		}
+	}
+}
+
+func TestIRCBridge(t *testing.T) {
+	s := NewServer()
+
+	bob := join(t, s, "bob")
+	bob.expect(t, "* The room contains:\n")
+
+	irc := ircConnect(t, s)
+	irc.send(t, "PING :abc\r\n")
+	irc.expect(t, ":budgetchat PONG budgetchat :abc\r\n")
+	irc.send(t, "PRIVMSG #budgetchat :too early\r\n")
+	irc.expect(t, ":budgetchat 451 * :You have not registered\r\n")
+
+	irc.send(t, "NICK bob\r\n")
+	irc.expect(t, ":budgetchat 433 * bob :Nickname is already in use\r\n")
+	irc.send(t, "NICK alice\r\n")
+	irc.send(t, "USER alice 0 * :Alice\r\n")
+	irc.expect(t, ":budgetchat 001 alice :Welcome to budgetchat alice, join #budgetchat to chat\r\n")
+	irc.expect(t, ":budgetchat 422 alice :MOTD File is missing\r\n")
+
+	irc.send(t, "JOIN #budgetchat\r\n")
+	irc.expect(t, ":alice!alice@budgetchat JOIN #budgetchat\r\n")
+	irc.expect(t, ":budgetchat 331 alice #budgetchat :No topic is set\r\n")
+	irc.expect(t, ":budgetchat 353 alice = #budgetchat :alice bob\r\n")
+	irc.expect(t, ":budgetchat 366 alice #budgetchat :End of /NAMES list\r\n")
+	bob.expect(t, "* alice has entered the room\n")
+
+	irc.send(t, "PRIVMSG #budgetchat :hi bob\r\n")
+	bob.expect(t, "[alice] hi bob\n")
+
+	bob.send(t, "hi alice\n")
+	irc.expect(t, ":bob!bob@budgetchat PRIVMSG #budgetchat :hi alice\r\n")
+
+	irc.send(t, "PART #budgetchat\r\n")
+	irc.expect(t, ":alice!alice@budgetchat PART #budgetchat\r\n")
+	bob.expect(t, "* alice has left the room\n")
+
+	carol := join(t, s, "carol")
+	carol.expect(t, "* The room contains: bob\n")
+	bob.expect(t, "* carol has entered the room\n")
+
+	irc.send(t, "QUIT :bye\r\n")
+	irc.expect(t, "ERROR :Closing link\r\n")
+}
+
+func ircConnect(t *testing.T, s *Server) *testClient {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	t.Cleanup(func() { clientConn.Close() })
+	_ = clientConn.SetDeadline(time.Now().Add(2 * time.Second))
+	go s.handleIRCConnection(serverConn)
+
+	return &testClient{conn: clientConn, br: bufio.NewReader(clientConn)}
+}
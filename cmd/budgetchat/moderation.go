@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrBanned = errors.New("banned")
+
+// maxOpFailures is number of wrong /op passwords after which user is disconnected
+const maxOpFailures = 3
+
+// Moderation holds operator settings, zero value disables every limit
+type Moderation struct {
+	// OpPassword enables /op command, when empty commands are not interpreted
+	// and lines starting with slash are ordinary messages
+	OpPassword string
+	// MaxMessageLen is maximum length of single chat message, 0 means unlimited
+	MaxMessageLen int
+	// Rate is number of messages per second user can send on average, 0 means unlimited
+	Rate float64
+	// Burst is number of messages user can send at once before Rate applies
+	Burst int
+
+	Bans *BanList
+}
+
+// BanList stores banned user names and IP addresses, when path is set
+// every change is written to disk, one entry per line
+type BanList struct {
+	path    string
+	entries map[string]struct{}
+
+	mu sync.Mutex
+}
+
+// newBanList creates empty list persisted to path, if there is any
+func newBanList(path string) *BanList {
+	return &BanList{
+		path:    path,
+		entries: make(map[string]struct{}),
+	}
+}
+
+// LoadBanList reads ban list from path, missing file is treated as empty list.
+// Empty path creates list kept only in memory
+func LoadBanList(path string) (*BanList, error) {
+	bl := newBanList(path)
+	if path == "" {
+		return bl, nil
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return bl, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open ban list: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		bl.entries[entry] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read ban list: %w", err)
+	}
+	return bl, nil
+}
+
+// Add bans entry (name or IP) and persists the list
+func (bl *BanList) Add(entry string) error {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	if _, ok := bl.entries[entry]; ok {
+		return nil
+	}
+	bl.entries[entry] = struct{}{}
+	return bl.save()
+}
+
+// IsBanned reports if either name or ip is on the list
+func (bl *BanList) IsBanned(name, ip string) bool {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	if _, ok := bl.entries[name]; ok {
+		return true
+	}
+	_, ok := bl.entries[ip]
+	return ok
+}
+
+// save writes list to temporary file and renames it, so crash never leaves half written list
+func (bl *BanList) save() error {
+	if bl.path == "" {
+		return nil
+	}
+	var sb strings.Builder
+	for entry := range bl.entries {
+		sb.WriteString(entry)
+		sb.WriteByte('\n')
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(bl.path), ".bans-*")
+	if err != nil {
+		return fmt.Errorf("create ban list: %w", err)
+	}
+	if _, err := tmp.WriteString(sb.String()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("write ban list: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("sync ban list: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("close ban list: %w", err)
+	}
+	return os.Rename(tmp.Name(), bl.path)
+}
+
+// tokenBucket implements flood limit, it's owned by single connection so it's not synchronized
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+	}
+}
+
+// allow takes one token if available, nil bucket allows everything
+func (tb *tokenBucket) allow(now time.Time) bool {
+	if tb == nil {
+		return true
+	}
+	if !tb.last.IsZero() {
+		tb.tokens = min(tb.burst, tb.tokens+now.Sub(tb.last).Seconds()*tb.rate)
+	}
+	tb.last = now
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
+
+// hostOf returns IP part of remote address, or whole address if it has no port
+func hostOf(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+func checkPassword(got, want string) bool {
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+// commands users can issue once operator password is set, other lines
+// starting with slash are ordinary messages
+var commands = map[string]bool{
+	"/op":   true,
+	"/kick": true,
+	"/ban":  true,
+	"/mute": true,
+}
+
+// isCommand tells if line is command rather than chat message
+func isCommand(line string) bool {
+	cmd, _, _ := strings.Cut(line, " ")
+	return commands[cmd]
+}
+
+// handleCommand executes operator command issued by user, reply is sent only
+// to the issuer. Commands are charged against flood limit like messages, so
+// password cannot be guessed at line rate, and user who keeps guessing
+// wrong is disconnected (second result is true then)
+func (s *Server) handleCommand(name string, line string, bucket *tokenBucket) (string, bool) {
+	cmd, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+
+	if !bucket.allow(time.Now()) {
+		return "* you are sending messages too fast\n", false
+	}
+	if cmd == "/op" {
+		if !checkPassword(arg, s.mod.OpPassword) {
+			failures := s.opFailed(name)
+			log.Printf("failed /op attempt %d by %s\n", failures, name)
+			if failures >= maxOpFailures {
+				return "* too many wrong passwords\n", true
+			}
+			return "* wrong password\n", false
+		}
+		s.setOp(name)
+		return "* you are now an operator\n", false
+	}
+	return s.operatorCommand(name, cmd, arg), false
+}
+
+// operatorCommand executes command which needs operator rights
+func (s *Server) operatorCommand(name, cmd, arg string) string {
+	if !s.isOp(name) {
+		return "* permission denied\n"
+	}
+	if arg == "" {
+		return fmt.Sprintf("* usage: %s <target>\n", cmd)
+	}
+
+	switch cmd {
+	case "/kick":
+		if !s.Kick(arg) {
+			return fmt.Sprintf("* no user named %s\n", arg)
+		}
+		return fmt.Sprintf("* %s was kicked\n", arg)
+	case "/ban":
+		if err := s.Ban(arg); err != nil {
+			log.Printf("could not ban %s: %v\n", arg, err)
+			return fmt.Sprintf("* could not ban %s\n", arg)
+		}
+		return fmt.Sprintf("* %s was banned\n", arg)
+	case "/mute":
+		if !s.Mute(arg) {
+			return fmt.Sprintf("* no user named %s\n", arg)
+		}
+		return fmt.Sprintf("* %s was muted\n", arg)
+	default:
+		return fmt.Sprintf("* unknown command %s\n", cmd)
+	}
+}
+
+// isBanned checks name and address of connection against the ban list
+func (s *Server) isBanned(name string, conn net.Conn) bool {
+	return s.mod.Bans != nil && s.mod.Bans.IsBanned(name, hostOf(conn.RemoteAddr()))
+}
+
+// rejectMessage applies message limits, reason is empty when message should be
+// dropped silently (muted users are not told about it)
+func (s *Server) rejectMessage(name, line string, bucket *tokenBucket) (string, bool) {
+	if s.mod.MaxMessageLen > 0 && len(line) > s.mod.MaxMessageLen {
+		return "message too long", true
+	}
+	if !bucket.allow(time.Now()) {
+		return "you are sending messages too fast", true
+	}
+	if s.isMuted(name) {
+		return "", true
+	}
+	return "", false
+}
+
+// newBucket creates flood limiter for single connection, nil when rate limit is disabled
+func (s *Server) newBucket() *tokenBucket {
+	if s.mod.Rate <= 0 {
+		return nil
+	}
+	return newTokenBucket(s.mod.Rate, s.mod.Burst)
+}
+
+func (s *Server) setOp(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u, ok := s.users[name]; ok {
+		u.op = true
+	}
+}
+
+// opFailed counts wrong /op password of user and returns number of them so far
+func (s *Server) opFailed(name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[name]
+	if !ok {
+		return 0
+	}
+	u.opFailures++
+	return u.opFailures
+}
+
+func (s *Server) isOp(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[name]
+	return ok && u.op
+}
+
+func (s *Server) isMuted(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[name]
+	return ok && u.muted
+}
+
+// Kick disconnects user, the connection handler removes it from the room
+func (s *Server) Kick(name string) bool {
+	s.mu.Lock()
+	u, ok := s.users[name]
+	s.mu.Unlock()
+	if !ok {
+		return false
+	}
+	// closing may block on network, so it's done without holding the lock
+	if u.conn != nil {
+		_ = u.conn.Close()
+	}
+	return true
+}
+
+// Mute stops messages of user from being broadcast
+func (s *Server) Mute(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[name]
+	if !ok {
+		return false
+	}
+	u.muted = true
+	return true
+}
+
+// Ban adds name or IP to the ban list and kicks every matching user
+func (s *Server) Ban(target string) error {
+	if s.mod.Bans == nil {
+		return errors.New("ban list not configured")
+	}
+	if err := s.mod.Bans.Add(target); err != nil {
+		return err
+	}
+
+	var conns []net.Conn
+	s.mu.Lock()
+	for name, u := range s.users {
+		if (name == target || u.ip == target) && u.conn != nil {
+			conns = append(conns, u.conn)
+		}
+	}
+	s.mu.Unlock()
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+	return nil
+}
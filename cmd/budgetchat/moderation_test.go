@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	tb := newTokenBucket(1, 2)
+	now := time.Now()
+
+	if !tb.allow(now) || !tb.allow(now) {
+		t.Errorf("burst of 2 should be allowed\n")
+	}
+	if tb.allow(now) {
+		t.Errorf("third message should be rejected\n")
+	}
+	if !tb.allow(now.Add(time.Second)) {
+		t.Errorf("message after refill should be allowed\n")
+	}
+}
+
+func TestBanListPersisted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans")
+
+	bl, err := LoadBanList(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if err := bl.Add("mallory"); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if err := bl.Add("10.0.0.1"); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+
+	loaded, err := LoadBanList(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if !loaded.IsBanned("mallory", "127.0.0.1") {
+		t.Errorf("mallory should be banned by name\n")
+	}
+	if !loaded.IsBanned("alice", "10.0.0.1") {
+		t.Errorf("10.0.0.1 should be banned by ip\n")
+	}
+	if loaded.IsBanned("alice", "127.0.0.1") {
+		t.Errorf("alice should not be banned\n")
+	}
+}
+
+func TestBannedUserCannotJoin(t *testing.T) {
+	s := NewServer()
+	_ = s.mod.Bans.Add("mallory")
+
+	c := join(t, s, "mallory")
+	c.expect(t, "You are banned\n")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.users) != 0 {
+		t.Errorf("banned user should not be added, got %d users\n", len(s.users))
+	}
+}
+
+func TestOperatorKick(t *testing.T) {
+	s := NewServer()
+	s.mod.OpPassword = "secret"
+
+	admin := join(t, s, "admin")
+	admin.expect(t, "* The room contains:\n")
+	bob := join(t, s, "bob")
+	bob.expect(t, "* The room contains: admin\n")
+	admin.expect(t, "* bob has entered the room\n")
+
+	admin.send(t, "/kick bob\n")
+	admin.expect(t, "* permission denied\n")
+
+	admin.send(t, "/op wrong\n")
+	admin.expect(t, "* wrong password\n")
+
+	admin.send(t, "/op secret\n")
+	admin.expect(t, "* you are now an operator\n")
+
+	admin.send(t, "/kick bob\n")
+	// reply and leave notification are written by different goroutines
+	got := map[string]bool{}
+	for range 2 {
+		line, err := admin.br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("could not read line: %v\n", err)
+		}
+		got[line] = true
+	}
+	for _, want := range []string{"* bob was kicked\n", "* bob has left the room\n"} {
+		if !got[want] {
+			t.Errorf("missing %q, got %v\n", want, got)
+		}
+	}
+}
+
+func TestFloodLimit(t *testing.T) {
+	s := NewServer()
+	s.mod.Rate = 0.001
+	s.mod.Burst = 1
+	s.mod.MaxMessageLen = 10
+
+	alice := join(t, s, "alice")
+	alice.expect(t, "* The room contains:\n")
+
+	alice.send(t, "this line is way too long\n")
+	alice.expect(t, "* message too long\n")
+	alice.send(t, "first\n")
+	alice.send(t, "second\n")
+	alice.expect(t, "* you are sending messages too fast\n")
+}
+
+type testClient struct {
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+// join connects new user through net.Pipe and consumes welcome message
+func join(t *testing.T, s *Server, name string) *testClient {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	t.Cleanup(func() { clientConn.Close() })
+	_ = clientConn.SetDeadline(time.Now().Add(2 * time.Second))
+	go s.handleConnection(serverConn)
+
+	c := &testClient{conn: clientConn, br: bufio.NewReader(clientConn)}
+	c.expect(t, "Welcome to budgetchat! What shall I call you?\n")
+	c.send(t, name+"\n")
+	return c
+}
+
+func (c *testClient) send(t *testing.T, line string) {
+	t.Helper()
+	if _, err := c.conn.Write([]byte(line)); err != nil {
+		t.Fatalf("could not send %q: %v\n", line, err)
+	}
+}
+
+func (c *testClient) expect(t *testing.T, want string) {
+	t.Helper()
+	expectLine(t, c.br, want)
+}
+
+func TestOpGuessingDisconnects(t *testing.T) {
+	s := NewServer()
+	s.mod.OpPassword = "secret"
+
+	mallory := join(t, s, "mallory")
+	mallory.expect(t, "* The room contains:\n")
+	for range maxOpFailures - 1 {
+		mallory.send(t, "/op guess\n")
+		mallory.expect(t, "* wrong password\n")
+	}
+	mallory.send(t, "/op guess\n")
+	mallory.expect(t, "* too many wrong passwords\n")
+	if _, err := mallory.br.ReadString('\n'); err == nil {
+		t.Errorf("connection should be closed\n")
+	}
+}
+
+func TestOpRateLimited(t *testing.T) {
+	s := NewServer()
+	s.mod.OpPassword = "secret"
+	s.mod.Rate = 0.001
+	s.mod.Burst = 1
+
+	mallory := join(t, s, "mallory")
+	mallory.expect(t, "* The room contains:\n")
+	mallory.send(t, "/op guess\n")
+	mallory.expect(t, "* wrong password\n")
+	mallory.send(t, "/op secret\n")
+	mallory.expect(t, "* you are sending messages too fast\n")
+	if s.isOp("mallory") {
+		t.Errorf("rate limited attempt should not be checked\n")
+	}
+}
+
+func TestSlashMessageIsChat(t *testing.T) {
+	s := NewServer()
+	s.mod.OpPassword = "secret"
+
+	alice := join(t, s, "alice")
+	alice.expect(t, "* The room contains:\n")
+	bob := join(t, s, "bob")
+	bob.expect(t, "* The room contains: alice\n")
+	alice.expect(t, "* bob has entered the room\n")
+
+	bob.send(t, "/shrug\n")
+	alice.expect(t, "[bob] /shrug\n")
+	bob.send(t, "/path/to/file\n")
+	alice.expect(t, "[bob] /path/to/file\n")
+}
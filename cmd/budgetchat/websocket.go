@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bean/pkg/pserver"
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// wsGUID is the magic value from RFC 6455 used to compute Sec-WebSocket-Accept
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// maxFrameSize limits single WebSocket message, chat lines are short anyway
+const maxFrameSize = 64 * 1024
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+var (
+	ErrUnmaskedFrame = errors.New("client frame is not masked")
+	ErrFrameTooLarge = errors.New("frame exceeds size limit")
+)
+
+// ListenServeWebSocket starts HTTP server with WebSocket endpoint at /chat,
+// every upgraded connection is passed to the handler just like TCP one
+func ListenServeWebSocket(handler pserver.HandlerFunc, port int) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/chat", webSocketHandler(handler))
+	addr := fmt.Sprintf(":%d", port)
+	log.Printf("WebSocket gateway started, running at port: %d\n", port)
+	return http.ListenAndServe(addr, mux)
+}
+
+// webSocketHandler performs the opening handshake and hijacks the connection,
+// from then on handler sees every text message as a single line
+func webSocketHandler(handler pserver.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !headerContains(r.Header, "Connection", "upgrade") ||
+			!headerContains(r.Header, "Upgrade", "websocket") {
+			http.Error(w, "websocket upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		if r.Header.Get("Sec-WebSocket-Version") != "13" {
+			w.Header().Set("Sec-WebSocket-Version", "13")
+			http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+			return
+		}
+		key := r.Header.Get("Sec-WebSocket-Key")
+		if key == "" {
+			http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+			return
+		}
+
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+			return
+		}
+		conn, brw, err := hj.Hijack()
+		if err != nil {
+			log.Printf("could not hijack connection: %v\n", err)
+			return
+		}
+
+		response := "HTTP/1.1 101 Switching Protocols\r\n" +
+			"Upgrade: websocket\r\n" +
+			"Connection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+		if _, err := conn.Write([]byte(response)); err != nil {
+			log.Printf("could not finish handshake: %v\n", err)
+			_ = conn.Close()
+			return
+		}
+
+		handler(newWSConn(conn, brw.Reader))
+	}
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, part := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// wsConn adapts WebSocket connection to line oriented net.Conn, so that
+// handleConnection can serve it without knowing about framing.
+// Each received message is one line, each Write is sent as one text message
+type wsConn struct {
+	net.Conn
+	br *bufio.Reader
+
+	// pending holds part of last message not yet consumed by Read
+	pending []byte
+
+	wmu       sync.Mutex
+	closeOnce sync.Once
+}
+
+func newWSConn(conn net.Conn, br *bufio.Reader) *wsConn {
+	return &wsConn{
+		Conn: conn,
+		br:   br,
+	}
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		msg, err := c.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		if len(msg) == 0 || msg[len(msg)-1] != '\n' {
+			msg = append(msg, '\n')
+		}
+		c.pending = msg
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	payload := strings.TrimSuffix(string(p), "\n")
+	if err := c.writeFrame(opText, []byte(payload)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		_ = c.writeFrame(opClose, nil)
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+// readMessage returns payload of next data message, answering control frames on the way
+func (c *wsConn) readMessage() ([]byte, error) {
+	var msg []byte
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil {
+				return nil, err
+			}
+		case opPong:
+			// unsolicited pong, nothing to do
+		case opClose:
+			return nil, io.EOF
+		case opText, opBinary, opContinuation:
+			if len(msg)+len(payload) > maxFrameSize {
+				return nil, ErrFrameTooLarge
+			}
+			msg = append(msg, payload...)
+			if fin {
+				return msg, nil
+			}
+		default:
+			return nil, fmt.Errorf("unknown opcode %x", op)
+		}
+	}
+}
+
+func (c *wsConn) readFrame() (bool, byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.br, header); err != nil {
+		return false, 0, nil, err
+	}
+	fin := header[0]&0x80 != 0
+	op := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(c.br, ext); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(c.br, ext); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext)
+	}
+
+	if !masked {
+		return false, 0, nil, ErrUnmaskedFrame
+	}
+	if length > maxFrameSize {
+		return false, 0, nil, ErrFrameTooLarge
+	}
+
+	mask := make([]byte, 4)
+	if _, err := io.ReadFull(c.br, mask); err != nil {
+		return false, 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, op, payload, nil
+}
+
+// writeFrame sends single unmasked frame, server frames are never masked
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	frame := make([]byte, 0, len(payload)+10)
+	frame = append(frame, 0x80|op)
+	switch l := len(payload); {
+	case l < 126:
+		frame = append(frame, byte(l))
+	case l <= 0xFFFF:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(l))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(l))
+	}
+	frame = append(frame, payload...)
+	_, err := c.Conn.Write(frame)
+	return err
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcceptKey(t *testing.T) {
+	// example taken from RFC 6455, section 1.3
+	got := acceptKey("dGhlIHNhbXBsZSBub25jZQ==")
+	want := "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="
+	if got != want {
+		t.Errorf("got %q, want %q\n", got, want)
+	}
+}
+
+func TestWebSocketAndTCPShareRoom(t *testing.T) {
+	s := NewServer()
+	hs := httptest.NewServer(webSocketHandler(s.handleConnection))
+	defer hs.Close()
+
+	ws, wbr := wsDial(t, hs.Listener.Addr().String())
+	defer ws.Close()
+
+	expectFrame(t, wbr, "Welcome to budgetchat! What shall I call you?")
+	wsWriteText(t, ws, "alice")
+	expectFrame(t, wbr, "* The room contains:")
+
+	serverConn, tcp := net.Pipe()
+	defer tcp.Close()
+	_ = tcp.SetReadDeadline(time.Now().Add(2 * time.Second))
+	go s.handleConnection(serverConn)
+
+	tbr := bufio.NewReader(tcp)
+	expectLine(t, tbr, "Welcome to budgetchat! What shall I call you?\n")
+	_, _ = tcp.Write([]byte("bob\n"))
+	expectLine(t, tbr, "* The room contains: alice\n")
+	expectFrame(t, wbr, "* bob has entered the room")
+
+	_, _ = tcp.Write([]byte("hi from tcp\n"))
+	expectFrame(t, wbr, "[bob] hi from tcp")
+
+	wsWriteText(t, ws, "hi from browser")
+	expectLine(t, tbr, "[alice] hi from browser\n")
+}
+
+func TestWebSocketRejectsPlainRequest(t *testing.T) {
+	s := NewServer()
+	hs := httptest.NewServer(webSocketHandler(s.handleConnection))
+	defer hs.Close()
+
+	resp, err := http.Get(hs.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUpgradeRequired {
+		t.Errorf("got status %d, want %d\n", resp.StatusCode, http.StatusUpgradeRequired)
+	}
+}
+
+func wsDial(t *testing.T, addr string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("could not connect: %v\n", err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	req := "GET /chat HTTP/1.1\r\n" +
+		"Host: " + addr + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		t.Fatalf("could not send handshake: %v\n", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("could not read handshake response: %v\n", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %d, want %d\n", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("wrong accept key %q\n", got)
+	}
+	return conn, br
+}
+
+func wsWriteText(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	frame := []byte{0x80 | opText, 0x80 | byte(len(msg))}
+	frame = append(frame, mask...)
+	for i := range len(msg) {
+		frame = append(frame, msg[i]^mask[i%4])
+	}
+	if _, err := conn.Write(frame); err != nil {
+		t.Fatalf("could not write frame: %v\n", err)
+	}
+}
+
+func expectFrame(t *testing.T, br *bufio.Reader, want string) {
+	t.Helper()
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(br, header); err != nil {
+		t.Fatalf("could not read frame header: %v\n", err)
+	}
+	if header[0] != 0x80|opText {
+		t.Fatalf("unexpected frame type %x\n", header[0])
+	}
+	length := int(header[1])
+	if length == 126 {
+		ext := make([]byte, 2)
+		_, _ = io.ReadFull(br, ext)
+		length = int(binary.BigEndian.Uint16(ext))
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		t.Fatalf("could not read frame payload: %v\n", err)
+	}
+	if got := strings.TrimSpace(string(payload)); got != want {
+		t.Errorf("got %q, want %q\n", got, want)
+	}
+}
+
+func expectLine(t *testing.T, br *bufio.Reader, want string) {
+	t.Helper()
+	got, err := br.ReadString('\n')
+	if err != nil {
+		t.Fatalf("could not read line: %v\n", err)
+	}
+	if got != want {
+		t.Errorf("got %q, want %q\n", got, want)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bean/pkg/pserver"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Admin API, enabled with -admin-addr flag:
+//
+//	GET    /keys         -> all live pairs as JSON array sorted by key
+//	GET    /keys/{key}   -> single pair, 404 when missing
+//	PUT    /keys/{key}   -> stores request body as value
+//	DELETE /keys/{key}   -> deletes key
+//	GET    /stats        -> key count, bytes and request rate
+//	POST   /snapshot     -> compacts write-ahead log, 501 for in-memory store
+//
+// Writes go through the same Database as UDP requests, so they get versions,
+// respect store limits and are replicated to peers.
+func ListenServeAdmin(db *Database, addr string) error {
+	log.Printf("admin API listening at %s\n", addr)
+	return http.ListenAndServe(addr, db.adminHandler())
+}
+
+type adminEntry struct {
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	Version string `json:"version"`
+	Expires int64  `json:"expires,omitempty"`
+}
+
+type adminStats struct {
+	Node           string  `json:"node"`
+	Keys           int     `json:"keys"`
+	Bytes          int64   `json:"bytes"`
+	Requests       uint64  `json:"requests"`
+	RequestsPerSec float64 `json:"requests_per_sec"`
+}
+
+// snapshotter is implemented by stores that can compact their log
+type snapshotter interface {
+	Snapshot() error
+}
+
+func (d *Database) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /keys", d.adminDump)
+	mux.HandleFunc("GET /keys/{key...}", d.adminGet)
+	mux.HandleFunc("PUT /keys/{key...}", d.adminPut)
+	mux.HandleFunc("DELETE /keys/{key...}", d.adminDelete)
+	mux.HandleFunc("GET /stats", d.adminStats)
+	mux.HandleFunc("POST /snapshot", d.adminSnapshot)
+	return mux
+}
+
+func adminStorageError(w http.ResponseWriter, key string, err error) {
+	if errors.Is(err, ErrStoreFull) {
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	}
+	log.Printf("could not write %q: %v\n", key, err)
+	http.Error(w, "storage failure", http.StatusInternalServerError)
+}
+
+func (d *Database) adminDump(w http.ResponseWriter, r *http.Request) {
+	now := d.now()
+	entries := make([]adminEntry, 0)
+	for key, e := range d.store.Entries() {
+		if e.Live(now) {
+			entries = append(entries, adminEntry{key, e.Value, e.Version.String(), e.Expires})
+		}
+	}
+	slices.SortFunc(entries, func(a, b adminEntry) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	pserver.WriteJSON(w, http.StatusOK, entries)
+}
+
+func (d *Database) adminGet(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if key == versionKey {
+		pserver.WriteJSON(w, http.StatusOK, adminEntry{Key: key, Value: versionValue, Version: Version{}.String()})
+		return
+	}
+	e, ok := d.getEntry(key)
+	if !ok {
+		http.Error(w, "key not found", http.StatusNotFound)
+		return
+	}
+	pserver.WriteJSON(w, http.StatusOK, adminEntry{key, e.Value, e.Version.String(), e.Expires})
+}
+
+func (d *Database) adminPut(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if key == versionKey {
+		http.Error(w, "version is read-only", http.StatusForbidden)
+		return
+	}
+	// UDP requests split on first '=', such key could never be retrieved
+	if strings.Contains(key, "=") {
+		http.Error(w, "key must not contain '='", http.StatusBadRequest)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, pserver.MaxUDPDatagram))
+	if err != nil {
+		http.Error(w, "value too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	// pair stored here must still be retrievable by UDP clients
+	if len(key)+1+len(body) >= pserver.MaxUDPDatagram {
+		http.Error(w, "pair does not fit into datagram", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	e := d.newEntry(string(body))
+	if err := d.put(key, e); err != nil {
+		adminStorageError(w, key, err)
+		return
+	}
+	pserver.WriteJSON(w, http.StatusOK, adminEntry{key, e.Value, e.Version.String(), e.Expires})
+}
+
+func (d *Database) adminDelete(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if key == versionKey {
+		http.Error(w, "version is read-only", http.StatusForbidden)
+		return
+	}
+	if _, err := d.deleteKey(key); err != nil {
+		adminStorageError(w, key, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (d *Database) adminStats(w http.ResponseWriter, r *http.Request) {
+	keys, bytes := d.store.Stats()
+	now := d.now()
+	pserver.WriteJSON(w, http.StatusOK, adminStats{
+		Node:           d.node,
+		Keys:           keys,
+		Bytes:          bytes,
+		Requests:       d.requests.count(),
+		RequestsPerSec: d.requests.rate(now),
+	})
+}
+
+func (d *Database) adminSnapshot(w http.ResponseWriter, r *http.Request) {
+	s, ok := d.store.(snapshotter)
+	if !ok {
+		http.Error(w, "store is not durable", http.StatusNotImplemented)
+		return
+	}
+	if err := s.Snapshot(); err != nil {
+		log.Printf("snapshot requested by admin failed: %v\n", err)
+		http.Error(w, "snapshot failed", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// rateWindow is number of seconds request rate is averaged over
+const rateWindow = 60
+
+// rateCounter counts events in one second slots of a ring covering last rateWindow seconds
+type rateCounter struct {
+	total uint64
+	slots [rateWindow]uint64
+	secs  [rateWindow]int64
+
+	mu sync.Mutex
+}
+
+func newRateCounter() *rateCounter {
+	return &rateCounter{}
+}
+
+func (c *rateCounter) add(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sec := now.Unix()
+	i := sec % rateWindow
+	if c.secs[i] != sec {
+		c.secs[i] = sec
+		c.slots[i] = 0
+	}
+	c.slots[i]++
+	c.total++
+}
+
+func (c *rateCounter) count() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.total
+}
+
+// rate returns events per second averaged over last rateWindow seconds
+func (c *rateCounter) rate(now time.Time) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var sum uint64
+	sec := now.Unix()
+	for i, s := range c.secs {
+		if sec-s >= 0 && sec-s < rateWindow {
+			sum += c.slots[i]
+		}
+	}
+	return float64(sum) / rateWindow
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func adminRequest(db *Database, method, path, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	db.adminHandler().ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return rec
+}
+
+func TestAdminKeys(t *testing.T) {
+	db, _ := newExtendedDatabase()
+
+	if rec := adminRequest(db, http.MethodPut, "/keys/foo", "bar"); rec.Code != http.StatusOK {
+		t.Fatalf("put: got status %d, want %d\n", rec.Code, http.StatusOK)
+	}
+	// admin writes are visible to UDP clients and the other way around
+	if got := request(db, "foo"); got != "foo=bar" {
+		t.Errorf("got %q, want %q\n", got, "foo=bar")
+	}
+	request(db, "a/b=slash")
+
+	rec := adminRequest(db, http.MethodGet, "/keys/a/b", "")
+	var e adminEntry
+	if err := json.NewDecoder(rec.Body).Decode(&e); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if e.Key != "a/b" || e.Value != "slash" || e.Version != "2.n" {
+		t.Errorf("got %+v\n", e)
+	}
+
+	if rec := adminRequest(db, http.MethodDelete, "/keys/foo", ""); rec.Code != http.StatusNoContent {
+		t.Errorf("delete: got status %d, want %d\n", rec.Code, http.StatusNoContent)
+	}
+	if rec := adminRequest(db, http.MethodGet, "/keys/foo", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("deleted key: got status %d, want %d\n", rec.Code, http.StatusNotFound)
+	}
+
+	rec = adminRequest(db, http.MethodGet, "/keys", "")
+	var entries []adminEntry
+	if err := json.NewDecoder(rec.Body).Decode(&entries); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if len(entries) != 1 || entries[0].Key != "a/b" {
+		t.Errorf("got %+v, want only a/b\n", entries)
+	}
+}
+
+func TestAdminRejectsWrites(t *testing.T) {
+	db, _ := newExtendedDatabase()
+	db.store = NewLimitedMemoryStore(Limits{MaxKeys: 1})
+
+	var tests = []struct {
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{http.MethodPut, "/keys/version", "hacked", http.StatusForbidden},
+		{http.MethodDelete, "/keys/version", "", http.StatusForbidden},
+		{http.MethodPut, "/keys/big", strings.Repeat("x", 1000), http.StatusRequestEntityTooLarge},
+		{http.MethodPut, "/keys/a=b", "c", http.StatusBadRequest},
+		{http.MethodPut, "/keys/a", "1", http.StatusOK},
+		{http.MethodPut, "/keys/b", "2", http.StatusInsufficientStorage},
+		{http.MethodPost, "/snapshot", "", http.StatusNotImplemented},
+	}
+	for _, tt := range tests {
+		if rec := adminRequest(db, tt.method, tt.path, tt.body); rec.Code != tt.want {
+			t.Errorf("%s %s: got status %d, want %d\n", tt.method, tt.path, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestAdminStatsAndSnapshot(t *testing.T) {
+	ds := openTestStore(t, t.TempDir())
+	defer ds.Close()
+	db := newDatabase(ds)
+
+	request(db, "foo=bar")
+	request(db, "foo")
+	if rec := adminRequest(db, http.MethodPost, "/snapshot", ""); rec.Code != http.StatusNoContent {
+		t.Errorf("snapshot: got status %d, want %d\n", rec.Code, http.StatusNoContent)
+	}
+
+	rec := adminRequest(db, http.MethodGet, "/stats", "")
+	var stats adminStats
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if stats.Keys != 1 || stats.Bytes != 6 || stats.Requests != 2 || stats.RequestsPerSec <= 0 {
+		t.Errorf("got %+v\n", stats)
+	}
+}
@@ -5,53 +5,207 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
+	"os"
 	"strings"
-	"sync"
+	"time"
 )
 
 var portNumber = flag.Int("port", 4242, "Port number of server")
+var dataDir = flag.String("data-dir", "", "Directory for write-ahead log and snapshots, data is kept only in memory when empty")
+var fsyncPolicy = flag.String("fsync", "interval", "When to fsync write-ahead log: always, interval or never")
+var fsyncInterval = flag.Duration("fsync-interval", time.Second, "Time between fsyncs for interval policy")
+var snapshotInterval = flag.Duration("snapshot-interval", 5*time.Minute, "Time between compacting snapshots, 0 disables them")
+var nodeName = flag.String("node", "", "Name of this node, used to break ties between concurrent writes (defaults to hostname:port)")
+var replAddr = flag.String("repl-addr", "", "TCP address replication listens on, replication is disabled when empty")
+var peers = flag.String("peers", "", "Comma separated replication addresses of other nodes")
+var extended = flag.Bool("extended", false, "Enable extended commands starting with '!' (TTL, CAS, delete and prefix scan)")
+var maxKeys = flag.Int("max-keys", 0, "Maximum number of keys, 0 means unlimited")
+var maxBytes = flag.Int64("max-bytes", 0, "Maximum size of keys and values in bytes, 0 means unlimited")
+var limitPolicy = flag.String("limit-policy", "reject", "What to do when store is full: reject new writes or evict oldest keys")
+var requestRate = flag.Float64("rate", 0, "Requests per second accepted from single IP, 0 means unlimited")
+var requestBurst = flag.Int("rate-burst", 20, "Requests single IP can send at once before rate limit applies")
+var byteRate = flag.Float64("byte-rate", 0, "Response bytes per second sent to single IP, 0 means unlimited")
+var byteBurst = flag.Int("byte-burst", 16*1024, "Response bytes sent to single IP at once before byte limit applies")
+var antiEntropyInterval = flag.Duration("anti-entropy-interval", 30*time.Second, "Time between full syncs with every peer")
+var adminAddr = flag.String("admin-addr", "", "TCP address of HTTP admin API, disabled when empty (it has no authentication, bind it to localhost)")
 
 func main() {
 	flag.Parse()
-	db := newDatabase()
-	log.Fatal(pserver.ListenServeUDP(db.handler, *portNumber))
+	store, err := openStore()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+
+	db := newDatabase(store)
+	db.node = *nodeName
+	if db.node == "" {
+		host, _ := os.Hostname()
+		db.node = fmt.Sprintf("%s:%d", host, *portNumber)
+	}
+	if *replAddr != "" {
+		if err := startReplication(db); err != nil {
+			log.Fatal(err)
+		}
+	}
+	db.extended = *extended
+	if *adminAddr != "" {
+		go func() {
+			log.Fatal(ListenServeAdmin(db, *adminAddr))
+		}()
+	}
+	opts := pserver.DefaultUDPOptions()
+	opts.RequestRate = *requestRate
+	opts.RequestBurst = *requestBurst
+	opts.ByteRate = *byteRate
+	opts.ByteBurst = *byteBurst
+	log.Fatal(pserver.ListenServeUDPOptions(db.handleMulti, *portNumber, opts))
 }
 
-type Database struct {
-	db map[string]string
+func openStore() (Store, error) {
+	lp, err := ParseLimitPolicy(*limitPolicy)
+	if err != nil {
+		return nil, err
+	}
+	limits := Limits{
+		MaxKeys:  *maxKeys,
+		MaxBytes: *maxBytes,
+		Policy:   lp,
+	}
+	if *dataDir == "" {
+		return NewLimitedMemoryStore(limits), nil
+	}
+	policy, err := ParseSyncPolicy(*fsyncPolicy)
+	if err != nil {
+		return nil, err
+	}
+	return OpenDurableStore(*dataDir, DurableOptions{
+		Sync:             policy,
+		SyncInterval:     *fsyncInterval,
+		SnapshotInterval: *snapshotInterval,
+		Limits:           limits,
+	})
+}
+
+func startReplication(db *Database) error {
+	ln, err := net.Listen("tcp", *replAddr)
+	if err != nil {
+		return fmt.Errorf("listen replication: %w", err)
+	}
+	db.repl = NewReplicator(db.store, db.clock, *antiEntropyInterval)
+	for _, peer := range strings.Split(*peers, ",") {
+		if peer = strings.TrimSpace(peer); peer != "" {
+			db.repl.AddPeer(peer)
+		}
+	}
+	go func() {
+		log.Fatal(db.repl.Serve(ln))
+	}()
+	log.Printf("replication listening at %s, peers: %s\n", ln.Addr(), *peers)
+	return nil
+}
 
-	mu sync.Mutex
+type Database struct {
+	store Store
+	clock *LamportClock
+	// node identifies writes of this database, ties between equal clocks are broken by it
+	node string
+	// repl is nil when replication is disabled
+	repl *Replicator
+	// extended enables commands from extended.go, keys starting with '!'
+	// cannot be used by plain requests then
+	extended bool
+	// requests counts UDP requests for admin stats
+	requests *rateCounter
+	now      func() time.Time
 }
 
-func newDatabase() *Database {
+const (
+	versionKey   = "version"
+	versionValue = "Jakub's Key-Store v0.0.1"
+)
+
+func newDatabase(store Store) *Database {
+	clock := &LamportClock{}
+	for _, e := range store.Entries() {
+		clock.Observe(e.Version.Clock)
+	}
 	return &Database{
-		db: make(map[string]string),
-		mu: sync.Mutex{},
+		store:    store,
+		clock:    clock,
+		requests: newRateCounter(),
+		now:      time.Now,
 	}
 }
 
-func (d *Database) setValue(key string, value string) error {
-	d.mu.Lock()
-	defer d.mu.Unlock()
+// newEntry creates entry with version newer than anything this node has seen
+func (d *Database) newEntry(value string) Entry {
+	return Entry{
+		Value:   value,
+		Version: Version{Clock: d.clock.Tick(), Node: d.node},
+	}
+}
 
-	d.db[key] = value
+// put stores local write and passes it to replication
+func (d *Database) put(key string, e Entry) error {
+	if _, err := d.store.Put(key, e, d.now()); err != nil {
+		return err
+	}
+	d.publish(key, e)
 	return nil
 }
 
+func (d *Database) publish(key string, e Entry) {
+	if d.repl != nil {
+		d.repl.Publish(key, e)
+	}
+}
+
+func (d *Database) setValue(key string, value string) error {
+	return d.put(key, d.newEntry(value))
+}
+
+// deleteKey stores tombstone, so deletion wins over older writes on other nodes
+func (d *Database) deleteKey(key string) (Entry, error) {
+	e := d.newEntry("")
+	e.Deleted = true
+	return e, d.put(key, e)
+}
+
+// getEntry returns entry only if it's not deleted nor expired
+func (d *Database) getEntry(key string) (Entry, bool) {
+	e, ok := d.store.Get(key)
+	if !ok || !e.Live(d.now()) {
+		return Entry{}, false
+	}
+	return e, true
+}
+
 func (d *Database) getValue(key string) (string, bool) {
-	d.mu.Lock()
-	defer d.mu.Unlock()
+	e, ok := d.getEntry(key)
+	return e.Value, ok
+}
 
-	val, ok := d.db[key]
-	return val, ok
+// handleMulti dispatches extended commands, everything else is handled as before
+func (d *Database) handleMulti(msg string) []string {
+	d.requests.add(d.now())
+	if d.extended && strings.HasPrefix(msg, "!") {
+		return d.handleExtended(msg)
+	}
+	response := d.handler(msg)
+	if response == "" {
+		return nil
+	}
+	return []string{response}
 }
 
 func (d *Database) handler(msg string) string {
 	parts := strings.Split(msg, "=")
 	if len(parts) == 1 {
 		log.Printf("got Retrieve to key: %s\n", parts[0])
-		if parts[0] == "version" {
-			return "version=Jakub's Key-Store v0.0.1"
+		if parts[0] == versionKey {
+			return versionKey + "=" + versionValue
 		}
 		val, ok := d.getValue(parts[0])
 		if !ok {
@@ -61,7 +215,13 @@ func (d *Database) handler(msg string) string {
 	} else {
 		log.Printf("Insert, key: %q, value:%q\n", parts[0],
 			strings.Join(parts[1:], "="))
-		_ = d.setValue(parts[0], strings.Join(parts[1:], "="))
+		if parts[0] == versionKey {
+			// version is read-only, modifications are ignored
+			return ""
+		}
+		if err := d.setValue(parts[0], strings.Join(parts[1:], "=")); err != nil {
+			log.Printf("could not insert %q: %v\n", parts[0], err)
+		}
 		return ""
 	}
 }
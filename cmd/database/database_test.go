@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestHandler(t *testing.T) {
+	db := newDatabase(NewMemoryStore())
+
+	var tests = []struct {
+		msg  string
+		want string
+	}{
+		{"foo=bar", ""},
+		{"foo", "foo=bar"},
+		{"foo=bar=baz", ""},
+		{"foo", "foo=bar=baz"},
+		{"empty=", ""},
+		{"empty", "empty="},
+		{"missing", "missing="},
+		{"version=hacked", ""},
+		{"version", "version=Jakub's Key-Store v0.0.1"},
+	}
+
+	for _, tt := range tests {
+		got := db.handler(tt.msg)
+		if got != tt.want {
+			t.Errorf("%q: got %q, want %q\n", tt.msg, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bean/pkg/pserver"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxScanDatagrams limits datagrams single !scan answers with, so small
+// request with spoofed source cannot flood anybody with the whole store
+const maxScanDatagrams = 16
+
+// Extended commands, enabled with -extended flag:
+//
+//	!get <key>                   -> !val <version> <key>=<value> | !nil <key>
+//	!setex <ttl> <key>=<value>   -> !ok <version>       (ttl in seconds)
+//	!cas <version> <key>=<value> -> !ok <version> | !conflict <current version>
+//	!del <key>                   -> !ok <version>
+//	!scan <prefix>               -> !scan <seq> datagrams, then !end <pairs> <datagrams>
+//
+// Scan answers with at most 16 datagrams, when more pairs match, !end line ends
+// with " truncated" and the rest has to be listed with longer prefix.
+// Version "0" stands for missing key, so "!cas 0 key=value" creates key only if it does not exist.
+// Errors are reported as "!err <reason>".
+func (d *Database) handleExtended(msg string) []string {
+	cmd, arg, _ := strings.Cut(msg, " ")
+	log.Printf("extended %s: %q\n", cmd, arg)
+
+	switch cmd {
+	case "!get":
+		return []string{d.extGet(arg)}
+	case "!setex":
+		return []string{d.extSetex(arg)}
+	case "!cas":
+		return []string{d.extCas(arg)}
+	case "!del":
+		return []string{d.extDel(arg)}
+	case "!scan":
+		return d.extScan(arg)
+	default:
+		return []string{extError("unknown command " + cmd)}
+	}
+}
+
+func extError(reason string) string {
+	return "!err " + reason
+}
+
+// storageError hides details of storage failures from clients, except full store
+func storageError(key string, err error) string {
+	if errors.Is(err, ErrStoreFull) {
+		return extError(err.Error())
+	}
+	log.Printf("could not write %q: %v\n", key, err)
+	return extError("storage failure")
+}
+
+func (d *Database) extGet(key string) string {
+	if key == versionKey {
+		return fmt.Sprintf("!val 0 %s", d.handler(versionKey))
+	}
+	e, ok := d.getEntry(key)
+	if !ok {
+		return "!nil " + key
+	}
+	response := fmt.Sprintf("!val %s %s=%s", e.Version, key, e.Value)
+	if len(response) >= pserver.MaxUDPDatagram {
+		return extError("value too large, use plain retrieve")
+	}
+	return response
+}
+
+func (d *Database) extSetex(arg string) string {
+	ttlStr, pair, ok := strings.Cut(arg, " ")
+	if !ok {
+		return extError("usage: !setex <ttl> <key>=<value>")
+	}
+	ttl, err := strconv.Atoi(ttlStr)
+	if err != nil || ttl <= 0 {
+		return extError("invalid ttl " + ttlStr)
+	}
+	key, value, ok := strings.Cut(pair, "=")
+	if !ok {
+		return extError("usage: !setex <ttl> <key>=<value>")
+	}
+	if key == versionKey {
+		return extError("version is read-only")
+	}
+
+	e := d.newEntry(value)
+	e.Expires = d.now().Add(time.Duration(ttl) * time.Second).UnixMilli()
+	if err := d.put(key, e); err != nil {
+		return storageError(key, err)
+	}
+	return "!ok " + e.Version.String()
+}
+
+func (d *Database) extCas(arg string) string {
+	verStr, pair, ok := strings.Cut(arg, " ")
+	if !ok {
+		return extError("usage: !cas <version> <key>=<value>")
+	}
+	expect, err := ParseVersion(verStr)
+	if err != nil {
+		return extError(err.Error())
+	}
+	key, value, ok := strings.Cut(pair, "=")
+	if !ok {
+		return extError("usage: !cas <version> <key>=<value>")
+	}
+	if key == versionKey {
+		return extError("version is read-only")
+	}
+
+	// compare is atomic only on this node, concurrent write on other node
+	// is resolved by last-writer-wins after replication
+	now := d.now()
+	cur, stored, err := d.store.CompareAndPut(key, expect, d.newEntry(value), now)
+	if err != nil {
+		return storageError(key, err)
+	}
+	if !stored {
+		if !cur.Live(now) {
+			return "!conflict 0"
+		}
+		return "!conflict " + cur.Version.String()
+	}
+	d.publish(key, cur)
+	return "!ok " + cur.Version.String()
+}
+
+func (d *Database) extDel(key string) string {
+	if key == "" {
+		return extError("usage: !del <key>")
+	}
+	if key == versionKey {
+		return extError("version is read-only")
+	}
+	e, err := d.deleteKey(key)
+	if err != nil {
+		return storageError(key, err)
+	}
+	return "!ok " + e.Version.String()
+}
+
+// extScan packs matching pairs, sorted by key, into as few datagrams as possible.
+// Every datagram starts with "!scan <seq>" line followed by one escaped pair per line,
+// so client can detect lost or reordered datagrams. Pair that cannot fit into
+// single datagram is listed by key only and has to be retrieved separately
+func (d *Database) extScan(prefix string) []string {
+	now := d.now()
+	keys := make([]string, 0)
+	entries := d.store.Entries()
+	for key, e := range entries {
+		if key != versionKey && strings.HasPrefix(key, prefix) && e.Live(now) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+
+	var (
+		datagrams []string
+		sb        strings.Builder
+		listed    int
+	)
+	header := func() string {
+		return fmt.Sprintf("!scan %d", len(datagrams))
+	}
+	flush := func() {
+		datagrams = append(datagrams, sb.String())
+		sb.Reset()
+	}
+
+	sb.WriteString(header())
+	for _, key := range keys {
+		line := escapeScan(key) + "=" + escapeScan(entries[key].Value)
+		if len(header())+1+len(line) >= pserver.MaxUDPDatagram {
+			line = escapeScan(key)
+		}
+		if len(header())+1+len(line) >= pserver.MaxUDPDatagram {
+			log.Printf("key %q too long for scan, skipping\n", key)
+			continue
+		}
+		if sb.Len()+1+len(line) >= pserver.MaxUDPDatagram {
+			flush()
+			if len(datagrams) == maxScanDatagrams {
+				return append(datagrams, fmt.Sprintf("!end %d %d truncated", listed, len(datagrams)))
+			}
+			sb.WriteString(header())
+		}
+		sb.WriteByte('\n')
+		sb.WriteString(line)
+		listed++
+	}
+	flush()
+
+	return append(datagrams, fmt.Sprintf("!end %d %d", listed, len(datagrams)))
+}
+
+// escapeScan makes pair fit on single line, backslash and newline are escaped
+func escapeScan(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bean/pkg/pserver"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newExtendedDatabase() (*Database, *time.Time) {
+	db := newDatabase(NewMemoryStore())
+	db.node = "n"
+	db.extended = true
+	now := time.Unix(1_000_000, 0)
+	db.now = func() time.Time { return now }
+	return db, &now
+}
+
+func request(db *Database, msg string) string {
+	return strings.Join(db.handleMulti(msg), "|")
+}
+
+func TestExtendedDisabled(t *testing.T) {
+	db := newDatabase(NewMemoryStore())
+
+	if got := request(db, "!del foo"); got != "!del foo=" {
+		t.Errorf("got %q, want plain retrieve\n", got)
+	}
+	request(db, "!del foo=bar")
+	if got := request(db, "!del foo"); got != "!del foo=bar" {
+		t.Errorf("got %q, want plain retrieve\n", got)
+	}
+}
+
+func TestExtendedSetexExpires(t *testing.T) {
+	db, now := newExtendedDatabase()
+
+	if got := request(db, "!setex 10 foo=bar"); got != "!ok 1.n" {
+		t.Errorf("got %q, want %q\n", got, "!ok 1.n")
+	}
+	if got := request(db, "foo"); got != "foo=bar" {
+		t.Errorf("got %q, want %q\n", got, "foo=bar")
+	}
+
+	*now = now.Add(11 * time.Second)
+	if got := request(db, "foo"); got != "foo=" {
+		t.Errorf("expired key: got %q, want %q\n", got, "foo=")
+	}
+	if got := request(db, "!get foo"); got != "!nil foo" {
+		t.Errorf("expired key: got %q, want %q\n", got, "!nil foo")
+	}
+}
+
+func TestExtendedCas(t *testing.T) {
+	db, _ := newExtendedDatabase()
+
+	if got := request(db, "!cas 0 foo=first"); got != "!ok 1.n" {
+		t.Errorf("got %q, want %q\n", got, "!ok 1.n")
+	}
+	if got := request(db, "!cas 0 foo=again"); got != "!conflict 1.n" {
+		t.Errorf("got %q, want %q\n", got, "!conflict 1.n")
+	}
+	if got := request(db, "!cas 1.n foo=second"); got != "!ok 3.n" {
+		t.Errorf("got %q, want %q\n", got, "!ok 3.n")
+	}
+	if got := request(db, "!get foo"); got != "!val 3.n foo=second" {
+		t.Errorf("got %q, want %q\n", got, "!val 3.n foo=second")
+	}
+	if got := request(db, "!cas bogus foo=x"); !strings.HasPrefix(got, "!err") {
+		t.Errorf("got %q, want error\n", got)
+	}
+}
+
+func TestExtendedDelete(t *testing.T) {
+	db, _ := newExtendedDatabase()
+
+	request(db, "foo=bar")
+	if got := request(db, "!del foo"); got != "!ok 2.n" {
+		t.Errorf("got %q, want %q\n", got, "!ok 2.n")
+	}
+	if got := request(db, "foo"); got != "foo=" {
+		t.Errorf("got %q, want %q\n", got, "foo=")
+	}
+	// deleted key can be created again with cas on missing key
+	if got := request(db, "!cas 0 foo=new"); got != "!ok 3.n" {
+		t.Errorf("got %q, want %q\n", got, "!ok 3.n")
+	}
+}
+
+func TestExtendedVersionReadOnly(t *testing.T) {
+	db, _ := newExtendedDatabase()
+
+	for _, msg := range []string{"!del version", "!setex 5 version=x", "!cas 0 version=x"} {
+		if got := request(db, msg); !strings.HasPrefix(got, "!err") {
+			t.Errorf("%q: got %q, want error\n", msg, got)
+		}
+	}
+	request(db, "version=hacked")
+	want := "version=Jakub's Key-Store v0.0.1"
+	if got := request(db, "version"); got != want {
+		t.Errorf("got %q, want %q\n", got, want)
+	}
+	if got := request(db, "!scan ver"); got != "!scan 0|!end 0 1" {
+		t.Errorf("got %q, want empty scan\n", got)
+	}
+}
+
+func TestExtendedScan(t *testing.T) {
+	db, _ := newExtendedDatabase()
+
+	request(db, "user:2=bob")
+	request(db, "user:1=alice\nsmith")
+	request(db, "other=x")
+	request(db, "user:3=deleted")
+	request(db, "!del user:3")
+
+	got := request(db, "!scan user:")
+	want := "!scan 0\nuser:1=alice\\nsmith\nuser:2=bob|!end 2 1"
+	if got != want {
+		t.Errorf("got %q, want %q\n", got, want)
+	}
+}
+
+func TestExtendedScanSplitsDatagrams(t *testing.T) {
+	db, _ := newExtendedDatabase()
+
+	value := strings.Repeat("v", 300)
+	for i := range 10 {
+		request(db, fmt.Sprintf("k%d=%s", i, value))
+	}
+	request(db, "huge="+strings.Repeat("h", 995))
+
+	datagrams := db.handleMulti("!scan ")
+	if len(datagrams) < 2 {
+		t.Fatalf("expected many datagrams, got %d\n", len(datagrams))
+	}
+
+	var keys []string
+	for i, d := range datagrams[:len(datagrams)-1] {
+		if len(d) >= pserver.MaxUDPDatagram {
+			t.Errorf("datagram %d has %d bytes\n", i, len(d))
+		}
+		lines := strings.Split(d, "\n")
+		if lines[0] != fmt.Sprintf("!scan %d", i) {
+			t.Errorf("wrong header %q\n", lines[0])
+		}
+		for _, l := range lines[1:] {
+			key, _, _ := strings.Cut(l, "=")
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) != 11 || !slices.IsSorted(keys) || !slices.Contains(keys, "huge") {
+		t.Errorf("wrong keys in scan: %v\n", keys)
+	}
+
+	end := datagrams[len(datagrams)-1]
+	if want := fmt.Sprintf("!end 11 %d", len(datagrams)-1); end != want {
+		t.Errorf("got %q, want %q\n", end, want)
+	}
+}
+
+func TestExtendedScanIsCapped(t *testing.T) {
+	db, _ := newExtendedDatabase()
+
+	value := strings.Repeat("v", 400)
+	for i := range 100 {
+		request(db, fmt.Sprintf("k%03d=%s", i, value))
+	}
+
+	datagrams := db.handleMulti("!scan k")
+	if len(datagrams) != maxScanDatagrams+1 {
+		t.Fatalf("got %d datagrams, want %d\n", len(datagrams), maxScanDatagrams+1)
+	}
+	end := datagrams[len(datagrams)-1]
+	if want := fmt.Sprintf("!end %d %d truncated", 2*maxScanDatagrams, maxScanDatagrams); end != want {
+		t.Errorf("got %q, want %q\n", end, want)
+	}
+}
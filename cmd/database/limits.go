@@ -0,0 +1,221 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrStoreFull = errors.New("store is full")
+
+type LimitPolicy int
+
+const (
+	// LimitReject refuses writes that would exceed limits
+	LimitReject LimitPolicy = iota
+	// LimitEvict removes least recently written keys to make room
+	LimitEvict
+)
+
+func ParseLimitPolicy(s string) (LimitPolicy, error) {
+	switch s {
+	case "reject":
+		return LimitReject, nil
+	case "evict":
+		return LimitEvict, nil
+	default:
+		return 0, fmt.Errorf("unknown limit policy %q", s)
+	}
+}
+
+// Limits bound memory used by the store, zero value means unlimited.
+// Only live entries count, tombstones and expired entries never block
+// new keys nor get evicted in place of live ones
+type Limits struct {
+	MaxKeys  int
+	MaxBytes int64
+	Policy   LimitPolicy
+}
+
+// entrySize is approximate memory used by the entry, only data sent by clients is counted
+func entrySize(key string, e Entry) int64 {
+	return int64(len(key) + len(e.Value) + len(e.Version.Node))
+}
+
+func (l Limits) fits(keys int, bytes int64) bool {
+	return (l.MaxKeys <= 0 || keys <= l.MaxKeys) && (l.MaxBytes <= 0 || bytes <= l.MaxBytes)
+}
+
+// evictionItem orders keys by version of their last write, oldest first.
+// Key breaks ties so replaying the log evicts exactly the same keys
+type evictionItem struct {
+	key     string
+	version Version
+	size    int64
+	index   int
+	// expires is copied from entry, only entries with expiry are in expiry
+	// queue at expiryIndex
+	expires     int64
+	expiryIndex int
+}
+
+type evictionQueue []*evictionItem
+
+func (q evictionQueue) Len() int { return len(q) }
+
+func (q evictionQueue) Less(i, j int) bool {
+	if q[i].version != q[j].version {
+		return q[i].version.Less(q[j].version)
+	}
+	return q[i].key < q[j].key
+}
+
+func (q evictionQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *evictionQueue) Push(x any) {
+	item := x.(*evictionItem)
+	item.index = len(*q)
+	*q = append(*q, item)
+}
+
+func (q *evictionQueue) Pop() any {
+	old := *q
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return item
+}
+
+// expiryQueue orders entries with expiry by it, soonest first
+type expiryQueue []*evictionItem
+
+func (q expiryQueue) Len() int { return len(q) }
+
+func (q expiryQueue) Less(i, j int) bool {
+	if q[i].expires != q[j].expires {
+		return q[i].expires < q[j].expires
+	}
+	return q[i].key < q[j].key
+}
+
+func (q expiryQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].expiryIndex = i
+	q[j].expiryIndex = j
+}
+
+func (q *expiryQueue) Push(x any) {
+	item := x.(*evictionItem)
+	item.expiryIndex = len(*q)
+	*q = append(*q, item)
+}
+
+func (q *expiryQueue) Pop() any {
+	old := *q
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return item
+}
+
+// accounting tracks size of live entries in MemoryStore and decides what
+// to evict, it's guarded by mutex of the store. Time of every write is
+// passed in, so replaying the log with recorded times repeats the same
+// decisions
+type accounting struct {
+	limits   Limits
+	bytes    int64
+	queue    evictionQueue
+	expiring expiryQueue
+	items    map[string]*evictionItem
+}
+
+func newAccounting(limits Limits) *accounting {
+	return &accounting{
+		limits: limits,
+		items:  make(map[string]*evictionItem),
+	}
+}
+
+// reap stops counting entries expired at now
+func (a *accounting) reap(now time.Time) {
+	for len(a.expiring) > 0 && now.UnixMilli() >= a.expiring[0].expires {
+		a.remove(a.expiring[0].key)
+	}
+}
+
+// check reports if entry can be stored in place of entry under key, it must
+// be called after reap
+func (a *accounting) check(key string, e Entry, now time.Time) error {
+	if !e.Live(now) {
+		// tombstone or expired entry only frees space
+		return nil
+	}
+	keys := len(a.items)
+	bytes := a.bytes + entrySize(key, e)
+	if old, ok := a.items[key]; ok {
+		keys--
+		bytes -= old.size
+	}
+	if a.limits.Policy == LimitEvict {
+		// everything else can be evicted, entry alone must fit
+		if !a.limits.fits(1, entrySize(key, e)) {
+			return ErrStoreFull
+		}
+		return nil
+	}
+	if !a.limits.fits(keys+1, bytes) {
+		return ErrStoreFull
+	}
+	return nil
+}
+
+// makeRoom evicts entries until entry fits and returns evicted keys, it must be
+// called after check succeeded and after entry replaced by this one was removed.
+// Queue holds only live entries, dead ones stopped counting already, so live
+// key is evicted only when live entries alone fill the store
+func (a *accounting) makeRoom(key string, e Entry) []string {
+	var evicted []string
+	size := entrySize(key, e)
+	for len(a.queue) > 0 && !a.limits.fits(len(a.items)+1, a.bytes+size) {
+		item := a.queue[0]
+		evicted = append(evicted, item.key)
+		a.remove(item.key)
+	}
+	return evicted
+}
+
+// add starts counting entry if it's live, dead entries are never evicted
+// because evicting them frees nothing
+func (a *accounting) add(key string, e Entry, now time.Time) {
+	if !e.Live(now) {
+		return
+	}
+	item := &evictionItem{key: key, version: e.Version, size: entrySize(key, e), expires: e.Expires}
+	a.items[key] = item
+	heap.Push(&a.queue, item)
+	if item.expires != 0 {
+		heap.Push(&a.expiring, item)
+	}
+	a.bytes += item.size
+}
+
+func (a *accounting) remove(key string) {
+	item, ok := a.items[key]
+	if !ok {
+		return
+	}
+	heap.Remove(&a.queue, item.index)
+	if item.expires != 0 {
+		heap.Remove(&a.expiring, item.expiryIndex)
+	}
+	delete(a.items, key)
+	a.bytes -= item.size
+}
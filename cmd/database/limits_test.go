@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func keysOf(s Store) []string {
+	var keys []string
+	for k := range s.Entries() {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func TestLimitRejectKeys(t *testing.T) {
+	db := newDatabase(NewLimitedMemoryStore(Limits{MaxKeys: 2}))
+
+	_ = db.setValue("a", "1")
+	_ = db.setValue("b", "2")
+	if err := db.setValue("c", "3"); !errors.Is(err, ErrStoreFull) {
+		t.Errorf("got %v, want %v\n", err, ErrStoreFull)
+	}
+	if err := db.setValue("a", "updated"); err != nil {
+		t.Errorf("update of existing key should succeed, got %v\n", err)
+	}
+	if got := keysOf(db.store); !slices.Equal(got, []string{"a", "b"}) {
+		t.Errorf("got keys %v\n", got)
+	}
+}
+
+func TestLimitRejectBytes(t *testing.T) {
+	db := newDatabase(NewLimitedMemoryStore(Limits{MaxBytes: 10}))
+
+	if err := db.setValue("a", "12345"); err != nil {
+		t.Errorf("unexpected error: %v\n", err)
+	}
+	if err := db.setValue("b", "12345"); !errors.Is(err, ErrStoreFull) {
+		t.Errorf("got %v, want %v\n", err, ErrStoreFull)
+	}
+	// replacing value with smaller one frees space
+	_ = db.setValue("a", "1")
+	if err := db.setValue("b", "1234"); err != nil {
+		t.Errorf("unexpected error: %v\n", err)
+	}
+	if keys, bytes := db.store.Stats(); keys != 2 || bytes != 7 {
+		t.Errorf("got %d keys and %d bytes, want 2 and 7\n", keys, bytes)
+	}
+}
+
+func TestLimitEvictOldest(t *testing.T) {
+	db := newDatabase(NewLimitedMemoryStore(Limits{MaxKeys: 2, Policy: LimitEvict}))
+
+	_ = db.setValue("a", "1")
+	_ = db.setValue("b", "2")
+	_ = db.setValue("c", "3")
+	if got := keysOf(db.store); !slices.Equal(got, []string{"b", "c"}) {
+		t.Errorf("got keys %v, want [b c]\n", got)
+	}
+
+	// b is now most recently written, c is evicted next
+	_ = db.setValue("b", "22")
+	_ = db.setValue("d", "4")
+	if got := keysOf(db.store); !slices.Equal(got, []string{"b", "d"}) {
+		t.Errorf("got keys %v, want [b d]\n", got)
+	}
+}
+
+func TestLimitEvictTooLargeEntry(t *testing.T) {
+	db := newDatabase(NewLimitedMemoryStore(Limits{MaxBytes: 8, Policy: LimitEvict}))
+
+	_ = db.setValue("a", "1")
+	if err := db.setValue("big", strings.Repeat("x", 10)); !errors.Is(err, ErrStoreFull) {
+		t.Errorf("got %v, want %v\n", err, ErrStoreFull)
+	}
+	if got := keysOf(db.store); !slices.Equal(got, []string{"a"}) {
+		t.Errorf("entry that cannot fit must not evict anything, got %v\n", got)
+	}
+}
+
+func TestLimitEvictionReplayed(t *testing.T) {
+	dir := t.TempDir()
+	opts := DurableOptions{Sync: SyncAlways, Limits: Limits{MaxKeys: 3, Policy: LimitEvict}}
+
+	ds, err := OpenDurableStore(dir, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	db := newDatabase(ds)
+	for _, k := range []string{"a", "b", "c", "d", "b", "e"} {
+		_ = db.setValue(k, k)
+	}
+	want := keysOf(ds)
+	_ = ds.Close()
+
+	ds, err = OpenDurableStore(dir, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	defer ds.Close()
+	if got := keysOf(ds); !slices.Equal(got, want) {
+		t.Errorf("got keys %v after restart, want %v\n", got, want)
+	}
+}
+
+func TestLimitExtendedReportsFull(t *testing.T) {
+	db, _ := newExtendedDatabase()
+	db.store = NewLimitedMemoryStore(Limits{MaxKeys: 1})
+
+	request(db, "!setex 10 a=1")
+	if got := request(db, "!setex 10 b=2"); got != "!err store is full" {
+		t.Errorf("got %q, want %q\n", got, "!err store is full")
+	}
+}
+
+func TestLimitDeadEntriesFreeRoom(t *testing.T) {
+	db, now := newExtendedDatabase()
+	db.store = NewLimitedMemoryStore(Limits{MaxKeys: 2, MaxBytes: 100})
+
+	// fill the store, then delete and expire everything
+	request(db, "!setex 10 a=1")
+	request(db, "b=2")
+	if got := request(db, "!setex 10 c=3"); got != "!err store is full" {
+		t.Fatalf("got %q, want %q\n", got, "!err store is full")
+	}
+	request(db, "!del b")
+	*now = now.Add(11 * time.Second)
+
+	for _, pair := range []string{"c=3", "d=4"} {
+		if got := request(db, "!cas 0 "+pair); !strings.HasPrefix(got, "!ok") {
+			t.Errorf("%s: got %q, want it stored\n", pair, got)
+		}
+	}
+	if keys, bytes := db.store.Stats(); keys != 2 || bytes != 6 {
+		t.Errorf("got %d keys and %d bytes, want 2 and 6\n", keys, bytes)
+	}
+	// tombstone is kept, so delete still wins over older replicated write
+	if e, ok := db.store.Get("b"); !ok || !e.Deleted {
+		t.Errorf("got %+v, want tombstone\n", e)
+	}
+}
+
+func TestLimitExpiryReplayed(t *testing.T) {
+	dir := t.TempDir()
+	opts := DurableOptions{Sync: SyncAlways, Limits: Limits{MaxKeys: 2, Policy: LimitEvict}}
+
+	ds, err := OpenDurableStore(dir, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	db, now := newExtendedDatabase()
+	db.store = ds
+	// expired a makes room for c, b is evicted for d. Replay must see a
+	// expired only from the time c was written, not from the start
+	request(db, "!setex 10 a=1")
+	request(db, "b=2")
+	*now = now.Add(11 * time.Second)
+	request(db, "c=3")
+	request(db, "d=4")
+	want := keysOf(ds)
+	_ = ds.Close()
+
+	ds, err = OpenDurableStore(dir, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	defer ds.Close()
+	if got := keysOf(ds); !slices.Equal(got, want) {
+		t.Errorf("got keys %v after restart, want %v\n", got, want)
+	}
+	if !slices.Equal(want, []string{"a", "c", "d"}) {
+		t.Errorf("got keys %v, want b evicted, expired a is kept for replication\n", want)
+	}
+}
+
+func TestLimitEvictSparesLiveKeys(t *testing.T) {
+	db, now := newExtendedDatabase()
+	db.store = NewLimitedMemoryStore(Limits{MaxKeys: 3, Policy: LimitEvict})
+
+	request(db, "a=1")
+	request(db, "!setex 10 b=2")
+	request(db, "c=3")
+	request(db, "!del c")
+	*now = now.Add(11 * time.Second)
+
+	// deleted c and expired b leave room, a is the oldest but must stay
+	request(db, "d=4")
+	request(db, "e=5")
+	for _, key := range []string{"a", "d", "e"} {
+		if _, ok := db.getEntry(key); !ok {
+			t.Errorf("live key %q was evicted\n", key)
+		}
+	}
+	// store is full of live keys now, the oldest one goes
+	request(db, "f=6")
+	if _, ok := db.getEntry("a"); ok {
+		t.Errorf("oldest key a was not evicted\n")
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// peerQueueSize bounds updates waiting for slow peer, overflow is
+	// repaired by the next anti-entropy round
+	peerQueueSize = 1024
+
+	redialDelay = time.Second
+)
+
+// replMessage is exchanged between nodes as JSON lines over TCP.
+// "put" carries single entry, "sync" asks peer for all its entries which are
+// sent back as "put" messages terminated by "sync_end"
+type replMessage struct {
+	Type  string `json:"type"`
+	Key   string `json:"key,omitempty"`
+	Value string `json:"value,omitempty"`
+	Clock uint64 `json:"clock,omitempty"`
+	Node  string `json:"node,omitempty"`
+
+	Expires int64 `json:"expires,omitempty"`
+	Deleted bool  `json:"deleted,omitempty"`
+}
+
+func putMessage(key string, e Entry) replMessage {
+	return replMessage{
+		Type:  "put",
+		Key:   key,
+		Value: e.Value,
+		Clock: e.Version.Clock,
+		Node:  e.Version.Node,
+
+		Expires: e.Expires,
+		Deleted: e.Deleted,
+	}
+}
+
+func (m replMessage) entry() Entry {
+	return Entry{
+		Value:   m.Value,
+		Version: Version{Clock: m.Clock, Node: m.Node},
+		Expires: m.Expires,
+		Deleted: m.Deleted,
+	}
+}
+
+// Replicator pushes local writes to peers and accepts their writes.
+// Every node pulls full state from each peer whenever it (re)connects and
+// then periodically, so node that was down catches up on what it missed
+type Replicator struct {
+	store    Store
+	clock    *LamportClock
+	interval time.Duration
+
+	peers map[string]chan replMessage
+	ln    net.Listener
+	conns map[net.Conn]struct{}
+
+	mu   sync.Mutex
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewReplicator creates replicator applying remote entries to store,
+// interval is time between anti-entropy rounds with every peer
+func NewReplicator(store Store, clock *LamportClock, interval time.Duration) *Replicator {
+	return &Replicator{
+		store:    store,
+		clock:    clock,
+		interval: interval,
+		peers:    make(map[string]chan replMessage),
+		conns:    make(map[net.Conn]struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Serve accepts connections from peers until listener is closed
+func (r *Replicator) Serve(ln net.Listener) error {
+	r.mu.Lock()
+	r.ln = ln
+	r.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-r.done:
+				return nil
+			default:
+				return fmt.Errorf("accept peer: %w", err)
+			}
+		}
+		if !r.track(conn) {
+			_ = conn.Close()
+			return nil
+		}
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			defer r.untrack(conn)
+			r.handlePeer(conn)
+		}()
+	}
+}
+
+// AddPeer starts pushing local writes to node at addr
+func (r *Replicator) AddPeer(addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.peers[addr]; ok {
+		return
+	}
+	queue := make(chan replMessage, peerQueueSize)
+	r.peers[addr] = queue
+	r.wg.Add(1)
+	go r.peerLoop(addr, queue)
+}
+
+// Publish queues local write for every peer
+func (r *Replicator) Publish(key string, e Entry) {
+	msg := putMessage(key, e)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for addr, queue := range r.peers {
+		select {
+		case queue <- msg:
+		default:
+			log.Printf("replication queue for %s is full, dropping %q\n", addr, key)
+		}
+	}
+}
+
+// Close stops all peer connections and waits for their goroutines
+func (r *Replicator) Close() error {
+	r.mu.Lock()
+	select {
+	case <-r.done:
+		r.mu.Unlock()
+		return nil
+	default:
+	}
+	close(r.done)
+	var err error
+	if r.ln != nil {
+		err = r.ln.Close()
+	}
+	for conn := range r.conns {
+		_ = conn.Close()
+	}
+	r.mu.Unlock()
+
+	r.wg.Wait()
+	return err
+}
+
+func (r *Replicator) track(conn net.Conn) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	select {
+	case <-r.done:
+		return false
+	default:
+	}
+	r.conns[conn] = struct{}{}
+	return true
+}
+
+func (r *Replicator) untrack(conn net.Conn) {
+	r.mu.Lock()
+	delete(r.conns, conn)
+	r.mu.Unlock()
+	_ = conn.Close()
+}
+
+func (r *Replicator) apply(msg replMessage) {
+	e := msg.entry()
+	r.clock.Observe(e.Version.Clock)
+	if _, err := r.store.Put(msg.Key, e, time.Now()); err != nil {
+		log.Printf("could not apply replicated %q: %v\n", msg.Key, err)
+	}
+}
+
+// handlePeer serves inbound connection: applies pushed entries and answers sync requests
+func (r *Replicator) handlePeer(conn net.Conn) {
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	enc := json.NewEncoder(conn)
+	for {
+		var msg replMessage
+		if err := dec.Decode(&msg); err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("error reading from peer %s: %v\n", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		switch msg.Type {
+		case "put":
+			r.apply(msg)
+		case "sync":
+			for key, e := range r.store.Entries() {
+				if err := enc.Encode(putMessage(key, e)); err != nil {
+					log.Printf("error sending sync to %s: %v\n", conn.RemoteAddr(), err)
+					return
+				}
+			}
+			if err := enc.Encode(replMessage{Type: "sync_end"}); err != nil {
+				return
+			}
+		default:
+			log.Printf("unknown replication message %q from %s\n", msg.Type, conn.RemoteAddr())
+		}
+	}
+}
+
+// peerLoop keeps outbound connection to peer, reconnecting after failures
+func (r *Replicator) peerLoop(addr string, queue chan replMessage) {
+	defer r.wg.Done()
+	for {
+		conn, err := net.DialTimeout("tcp", addr, redialDelay)
+		if err == nil && r.track(conn) {
+			err = r.runPeer(conn, queue)
+			r.untrack(conn)
+		}
+		if err != nil {
+			log.Printf("replication to %s failed: %v\n", addr, err)
+		}
+		select {
+		case <-r.done:
+			return
+		case <-time.After(redialDelay):
+		}
+	}
+}
+
+func (r *Replicator) runPeer(conn net.Conn, queue chan replMessage) error {
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	enc := json.NewEncoder(conn)
+
+	if err := r.pull(enc, dec); err != nil {
+		return err
+	}
+
+	var tick <-chan time.Time
+	if r.interval > 0 {
+		t := time.NewTicker(r.interval)
+		defer t.Stop()
+		tick = t.C
+	}
+	for {
+		select {
+		case msg := <-queue:
+			if err := enc.Encode(msg); err != nil {
+				// this one is lost for now, anti-entropy after reconnect will repair it
+				return fmt.Errorf("push %q: %w", msg.Key, err)
+			}
+		case <-tick:
+			if err := r.pull(enc, dec); err != nil {
+				return err
+			}
+		case <-r.done:
+			return nil
+		}
+	}
+}
+
+// pull asks peer for its whole state and applies everything newer than ours
+func (r *Replicator) pull(enc *json.Encoder, dec *json.Decoder) error {
+	if err := enc.Encode(replMessage{Type: "sync"}); err != nil {
+		return fmt.Errorf("request sync: %w", err)
+	}
+	for {
+		var msg replMessage
+		if err := dec.Decode(&msg); err != nil {
+			return fmt.Errorf("read sync: %w", err)
+		}
+		if msg.Type == "sync_end" {
+			return nil
+		}
+		if msg.Type == "put" {
+			r.apply(msg)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+type testNode struct {
+	db   *Database
+	addr string
+}
+
+// startNode runs node with replication listening on addr, use "127.0.0.1:0" for random port
+func startNode(t *testing.T, name, addr string, store Store) *testNode {
+	t.Helper()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("could not listen: %v\n", err)
+	}
+	db := newDatabase(store)
+	db.node = name
+	db.repl = NewReplicator(db.store, db.clock, 100*time.Millisecond)
+	go db.repl.Serve(ln)
+	t.Cleanup(func() { db.repl.Close() })
+
+	return &testNode{db: db, addr: ln.Addr().String()}
+}
+
+func connect(nodes ...*testNode) {
+	for _, a := range nodes {
+		for _, b := range nodes {
+			if a != b {
+				a.db.repl.AddPeer(b.addr)
+			}
+		}
+	}
+}
+
+func waitForValue(t *testing.T, n *testNode, key, want string) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if got := n.db.handler(key); got == key+"="+want {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("node %s: got %q, want %q\n", n.db.node, n.db.handler(key), key+"="+want)
+}
+
+func TestReplicationPropagatesInserts(t *testing.T) {
+	a := startNode(t, "a", "127.0.0.1:0", NewMemoryStore())
+	b := startNode(t, "b", "127.0.0.1:0", NewMemoryStore())
+	c := startNode(t, "c", "127.0.0.1:0", NewMemoryStore())
+	connect(a, b, c)
+
+	a.db.handler("foo=bar")
+	waitForValue(t, b, "foo", "bar")
+	waitForValue(t, c, "foo", "bar")
+
+	c.db.handler("foo=baz")
+	waitForValue(t, a, "foo", "baz")
+	waitForValue(t, b, "foo", "baz")
+}
+
+func TestReplicationRejoin(t *testing.T) {
+	a := startNode(t, "a", "127.0.0.1:0", NewMemoryStore())
+	bStore := NewMemoryStore()
+	b := startNode(t, "b", "127.0.0.1:0", bStore)
+	connect(a, b)
+
+	a.db.handler("before=1")
+	waitForValue(t, b, "before", "1")
+
+	_ = b.db.repl.Close()
+	a.db.handler("during=2")
+	a.db.handler("before=3")
+
+	// restart b on the same address with its old data, it has to catch up
+	b = startNode(t, "b", b.addr, bStore)
+	connect(a, b)
+	waitForValue(t, b, "during", "2")
+	waitForValue(t, b, "before", "3")
+
+	b.db.handler("after=4")
+	waitForValue(t, a, "after", "4")
+}
+
+func TestReplicationLastWriterWins(t *testing.T) {
+	a := startNode(t, "a", "127.0.0.1:0", NewMemoryStore())
+	b := startNode(t, "b", "127.0.0.1:0", NewMemoryStore())
+
+	// both writes have the same clock, node name breaks the tie
+	a.db.handler("key=from-a")
+	b.db.handler("key=from-b")
+	connect(a, b)
+
+	waitForValue(t, a, "key", "from-b")
+	waitForValue(t, b, "key", "from-b")
+
+	// a has seen clock of b's write, so its next write is newer
+	a.db.handler("key=again-a")
+	waitForValue(t, b, "key", "again-a")
+}
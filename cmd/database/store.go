@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Version orders writes for last-writer-wins, Clock is Lamport timestamp
+// and Node breaks ties between concurrent writes from different nodes
+type Version struct {
+	Clock uint64
+	Node  string
+}
+
+// Less reports if v was written before o
+func (v Version) Less(o Version) bool {
+	if v.Clock != o.Clock {
+		return v.Clock < o.Clock
+	}
+	return v.Node < o.Node
+}
+
+// String formats version as clock.node, zero version is "0"
+func (v Version) String() string {
+	if v == (Version{}) {
+		return "0"
+	}
+	return fmt.Sprintf("%d.%s", v.Clock, v.Node)
+}
+
+func ParseVersion(s string) (Version, error) {
+	if s == "0" {
+		return Version{}, nil
+	}
+	clock, node, ok := strings.Cut(s, ".")
+	if !ok {
+		return Version{}, fmt.Errorf("invalid version %q", s)
+	}
+	c, err := strconv.ParseUint(clock, 10, 64)
+	if err != nil {
+		return Version{}, fmt.Errorf("invalid version clock %q", clock)
+	}
+	return Version{Clock: c, Node: node}, nil
+}
+
+// Entry is versioned value, deleted keys are kept as tombstones so the
+// delete wins over older writes arriving from other nodes
+type Entry struct {
+	Value   string
+	Version Version
+	// Expires is unix time in milliseconds after which entry is gone, 0 means never
+	Expires int64
+	Deleted bool
+}
+
+// Live reports if entry should be visible to clients at given time
+func (e Entry) Live(now time.Time) bool {
+	return !e.Deleted && (e.Expires == 0 || now.UnixMilli() < e.Expires)
+}
+
+// Store is storage backend of the database, implementations must be safe
+// for concurrent use
+type Store interface {
+	Get(key string) (Entry, bool)
+	// Put stores entry only if it's newer than the one already stored,
+	// reports whether the entry was stored. Entries expired at now stop
+	// counting toward limits
+	Put(key string, e Entry, now time.Time) (bool, error)
+	// CompareAndPut stores entry only if version of live entry under key equals expect,
+	// zero expect means key must not exist. On mismatch current entry is returned
+	CompareAndPut(key string, expect Version, e Entry, now time.Time) (Entry, bool, error)
+	// Entries returns copy of every entry in the store, including tombstones
+	Entries() map[string]Entry
+	// Stats returns number of live keys and their size in bytes, as counted
+	// toward limits at last write
+	Stats() (int, int64)
+	Close() error
+}
+
+// MemoryStore keeps data only in memory, everything is lost on restart
+type MemoryStore struct {
+	db  map[string]Entry
+	acc *accounting
+
+	mu sync.Mutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	return NewLimitedMemoryStore(Limits{})
+}
+
+// NewLimitedMemoryStore creates store which rejects or evicts entries
+// when limits are reached, depending on the policy
+func NewLimitedMemoryStore(limits Limits) *MemoryStore {
+	return &MemoryStore{
+		db:  make(map[string]Entry),
+		acc: newAccounting(limits),
+		mu:  sync.Mutex{},
+	}
+}
+
+func (m *MemoryStore) Get(key string) (Entry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.db[key]
+	return e, ok
+}
+
+func (m *MemoryStore) Put(key string, e Entry, now time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if old, ok := m.db[key]; ok && !old.Version.Less(e.Version) {
+		return false, nil
+	}
+	if err := m.store(key, e, now); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (m *MemoryStore) CompareAndPut(key string, expect Version, e Entry, now time.Time) (Entry, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cur, ok := m.db[key]
+	if !casMatches(cur, ok, expect, now) || !cur.Version.Less(e.Version) {
+		return cur, false, nil
+	}
+	if err := m.store(key, e, now); err != nil {
+		return cur, false, err
+	}
+	return e, true, nil
+}
+
+// casMatches compares expected version with what client can see under the key
+func casMatches(cur Entry, ok bool, expect Version, now time.Time) bool {
+	if !ok || !cur.Live(now) {
+		return expect == Version{}
+	}
+	return cur.Version == expect
+}
+
+// check reports if entry would be accepted by limits, nothing visible changes
+func (m *MemoryStore) check(key string, e Entry, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.acc.reap(now)
+	return m.acc.check(key, e, now)
+}
+
+// store must be called with m.mu held, it enforces limits evicting other keys if needed
+func (m *MemoryStore) store(key string, e Entry, now time.Time) error {
+	m.acc.reap(now)
+	if err := m.acc.check(key, e, now); err != nil {
+		return err
+	}
+	m.acc.remove(key)
+	if e.Live(now) {
+		for _, evicted := range m.acc.makeRoom(key, e) {
+			log.Printf("evicting %q to make room for %q\n", evicted, key)
+			delete(m.db, evicted)
+		}
+	}
+	m.acc.add(key, e, now)
+	m.db[key] = e
+	return nil
+}
+
+// Stats returns number of live keys and their size in bytes, as counted
+// toward limits at last write
+func (m *MemoryStore) Stats() (int, int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.acc.items), m.acc.bytes
+}
+
+func (m *MemoryStore) Entries() map[string]Entry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := make(map[string]Entry, len(m.db))
+	for k, e := range m.db {
+		result[k] = e
+	}
+	return result
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+// LamportClock generates versions for local writes, it's advanced by every
+// version seen from other nodes so local writes always win over what we know
+type LamportClock struct {
+	time uint64
+
+	mu sync.Mutex
+}
+
+// Tick returns time for new local write
+func (c *LamportClock) Tick() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.time++
+	return c.time
+}
+
+// Observe advances clock past time seen in remote or recovered entry
+func (c *LamportClock) Observe(t uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.time = max(c.time, t)
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	walFile      = "wal.log"
+	snapshotFile = "snapshot.db"
+
+	// maxRecordSize protects recovery from allocating huge buffers for garbage length
+	maxRecordSize = 1 << 20
+)
+
+const (
+	flagDeleted byte = 1 << iota
+)
+
+var ErrTornRecord = errors.New("torn or corrupted record")
+
+type SyncPolicy int
+
+const (
+	// SyncAlways calls fsync after every insert
+	SyncAlways SyncPolicy = iota
+	// SyncInterval calls fsync periodically, inserts since last sync may be lost
+	SyncInterval
+	// SyncNever leaves flushing to the operating system
+	SyncNever
+)
+
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch s {
+	case "always":
+		return SyncAlways, nil
+	case "interval":
+		return SyncInterval, nil
+	case "never":
+		return SyncNever, nil
+	default:
+		return 0, fmt.Errorf("unknown fsync policy %q", s)
+	}
+}
+
+type DurableOptions struct {
+	Sync         SyncPolicy
+	SyncInterval time.Duration
+	// SnapshotInterval is time between compacting snapshots, 0 disables them
+	SnapshotInterval time.Duration
+	Limits           Limits
+}
+
+// DurableStore keeps data in memory and appends every change to write-ahead log.
+// Snapshot writes whole state to separate file and truncates the log,
+// on startup snapshot is loaded and the log is replayed on top of it
+type DurableStore struct {
+	mem  *MemoryStore
+	dir  string
+	opts DurableOptions
+
+	wal   logFile
+	dirty bool
+	// walSize is where next record starts, failed write is cut back to it
+	walSize int64
+	// failed is set when log may hold record whose write was reported as
+	// failed, every later write is refused so nothing is acknowledged after it
+	failed error
+
+	mu   sync.Mutex
+	done chan struct{}
+	wg   sync.WaitGroup
+	once sync.Once
+}
+
+// logFile is the write-ahead log, *os.File opened for appending
+type logFile interface {
+	io.WriteCloser
+	Sync() error
+	Truncate(size int64) error
+}
+
+type record struct {
+	key   string
+	entry Entry
+	// at is time of the write, replay uses it to decide which entries expired
+	// just like the write did, so limits evict the same keys
+	at time.Time
+}
+
+// OpenDurableStore recovers state from dir (creating it when needed) and starts
+// background sync and snapshot loops configured in opts
+func OpenDurableStore(dir string, opts DurableOptions) (*DurableStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create data dir: %w", err)
+	}
+	ds := &DurableStore{
+		mem:  NewLimitedMemoryStore(opts.Limits),
+		dir:  dir,
+		opts: opts,
+		done: make(chan struct{}),
+	}
+
+	if err := ds.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	if err := ds.replayWAL(); err != nil {
+		return nil, err
+	}
+
+	wal, err := os.OpenFile(ds.path(walFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open wal: %w", err)
+	}
+	info, err := wal.Stat()
+	if err != nil {
+		wal.Close()
+		return nil, fmt.Errorf("stat wal: %w", err)
+	}
+	ds.wal = wal
+	ds.walSize = info.Size()
+
+	ds.wg.Add(1)
+	go ds.background()
+	return ds, nil
+}
+
+func (ds *DurableStore) path(name string) string {
+	return filepath.Join(ds.dir, name)
+}
+
+func (ds *DurableStore) Put(key string, e Entry, now time.Time) (bool, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	// ds.mu serializes all writes, so entry checked here cannot change before Put below
+	if old, ok := ds.mem.Get(key); ok && !old.Version.Less(e.Version) {
+		return false, nil
+	}
+	if err := ds.mem.check(key, e, now); err != nil {
+		return false, err
+	}
+	if err := ds.appendRecord(record{key: key, entry: e, at: now}); err != nil {
+		return false, err
+	}
+	return ds.mem.Put(key, e, now)
+}
+
+func (ds *DurableStore) CompareAndPut(key string, expect Version, e Entry, now time.Time) (Entry, bool, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	cur, ok := ds.mem.Get(key)
+	if !casMatches(cur, ok, expect, now) || !cur.Version.Less(e.Version) {
+		return cur, false, nil
+	}
+	if err := ds.mem.check(key, e, now); err != nil {
+		return cur, false, err
+	}
+	if err := ds.appendRecord(record{key: key, entry: e, at: now}); err != nil {
+		return cur, false, err
+	}
+	_, err := ds.mem.Put(key, e, now)
+	return e, err == nil, err
+}
+
+func (ds *DurableStore) Get(key string) (Entry, bool) {
+	return ds.mem.Get(key)
+}
+
+func (ds *DurableStore) Entries() map[string]Entry {
+	return ds.mem.Entries()
+}
+
+func (ds *DurableStore) Stats() (int, int64) {
+	return ds.mem.Stats()
+}
+
+// appendRecord must be called with ds.mu held, record is written before the change
+// is applied to memory so it's never visible without being logged.
+// Partially written record is cut off, otherwise replay would stop at it and
+// drop every record appended later
+func (ds *DurableStore) appendRecord(r record) error {
+	if ds.failed != nil {
+		return ds.failed
+	}
+	buf := encodeRecord(r)
+	if n, err := ds.wal.Write(buf); err != nil {
+		if n > 0 {
+			if terr := ds.wal.Truncate(ds.walSize); terr != nil {
+				ds.failed = fmt.Errorf("wal has torn record: %w", terr)
+			}
+		}
+		return fmt.Errorf("append wal: %w", err)
+	}
+	ds.walSize += int64(len(buf))
+	if ds.opts.Sync == SyncAlways {
+		if err := ds.wal.Sync(); err != nil {
+			// record may or may not survive crash, so it cannot be acknowledged,
+			// nor can anything written after it
+			ds.failed = fmt.Errorf("sync wal: %w", err)
+			return ds.failed
+		}
+		return nil
+	}
+	ds.dirty = true
+	return nil
+}
+
+// Snapshot writes current state to snapshot file and truncates the log.
+// Replaying log on top of snapshot is idempotent, so crash between
+// those two steps does not lose or duplicate anything
+func (ds *DurableStore) Snapshot() error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	tmp, err := os.CreateTemp(ds.dir, ".snapshot-*")
+	if err != nil {
+		return fmt.Errorf("create snapshot: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	bw := bufio.NewWriter(tmp)
+	now := time.Now()
+	for k, e := range ds.mem.Entries() {
+		if _, err := bw.Write(encodeRecord(record{key: k, entry: e, at: now})); err != nil {
+			tmp.Close()
+			return fmt.Errorf("write snapshot: %w", err)
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write snapshot: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("sync snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close snapshot: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), ds.path(snapshotFile)); err != nil {
+		return fmt.Errorf("rename snapshot: %w", err)
+	}
+	if err := syncDir(ds.dir); err != nil {
+		return err
+	}
+
+	if err := ds.wal.Truncate(0); err != nil {
+		return fmt.Errorf("truncate wal: %w", err)
+	}
+	ds.walSize = 0
+	if err := ds.wal.Sync(); err != nil {
+		return fmt.Errorf("sync wal: %w", err)
+	}
+	ds.dirty = false
+	// records in doubt are gone, snapshot holds only what was acknowledged
+	ds.failed = nil
+	return nil
+}
+
+func (ds *DurableStore) sync() error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if !ds.dirty {
+		return nil
+	}
+	ds.dirty = false
+	return ds.wal.Sync()
+}
+
+func (ds *DurableStore) background() {
+	defer ds.wg.Done()
+
+	var syncC, snapC <-chan time.Time
+	if ds.opts.Sync == SyncInterval && ds.opts.SyncInterval > 0 {
+		t := time.NewTicker(ds.opts.SyncInterval)
+		defer t.Stop()
+		syncC = t.C
+	}
+	if ds.opts.SnapshotInterval > 0 {
+		t := time.NewTicker(ds.opts.SnapshotInterval)
+		defer t.Stop()
+		snapC = t.C
+	}
+
+	for {
+		select {
+		case <-syncC:
+			if err := ds.sync(); err != nil {
+				log.Printf("could not sync wal: %v\n", err)
+			}
+		case <-snapC:
+			if err := ds.Snapshot(); err != nil {
+				log.Printf("could not write snapshot: %v\n", err)
+			}
+		case <-ds.done:
+			return
+		}
+	}
+}
+
+// Close stops background loops and flushes the log
+func (ds *DurableStore) Close() error {
+	err := os.ErrClosed
+	ds.once.Do(func() {
+		close(ds.done)
+		ds.wg.Wait()
+
+		ds.mu.Lock()
+		defer ds.mu.Unlock()
+		if serr := ds.wal.Sync(); serr != nil {
+			ds.wal.Close()
+			err = fmt.Errorf("sync wal: %w", serr)
+			return
+		}
+		err = ds.wal.Close()
+	})
+	return err
+}
+
+// apply replays record, evictions are deterministic so replaying the log
+// with the same limits evicts the same keys as before restart
+func (ds *DurableStore) apply(r record) {
+	if _, err := ds.mem.Put(r.key, r.entry, r.at); err != nil {
+		log.Printf("could not replay record for %q: %v\n", r.key, err)
+	}
+}
+
+// loadSnapshot fails on any corruption, snapshot is renamed into place
+// only when complete so damaged file means something is seriously wrong
+func (ds *DurableStore) loadSnapshot() error {
+	f, err := os.Open(ds.path(snapshotFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("open snapshot: %w", err)
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	for {
+		r, _, err := readRecord(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read snapshot: %w", err)
+		}
+		ds.apply(r)
+	}
+}
+
+// replayWAL applies every complete record, torn tail left by crash
+// during append is truncated so new records are not written after garbage
+func (ds *DurableStore) replayWAL() error {
+	f, err := os.OpenFile(ds.path(walFile), os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("open wal: %w", err)
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	var offset int64
+	count := 0
+	for {
+		r, n, err := readRecord(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("wal: %v at offset %d, truncating\n", err, offset)
+			if err := f.Truncate(offset); err != nil {
+				return fmt.Errorf("truncate wal: %w", err)
+			}
+			break
+		}
+		ds.apply(r)
+		offset += int64(n)
+		count++
+	}
+	log.Printf("wal: replayed %d records\n", count)
+	return nil
+}
+
+// encodeRecord frames record as: length (4 bytes), crc32 of payload (4 bytes), payload.
+// Payload is key and value, each prefixed with uvarint length, uvarint clock,
+// node prefixed with its length, flags byte, varint expiry and varint time
+// of write in milliseconds
+func encodeRecord(r record) []byte {
+	e := r.entry
+	payload := make([]byte, 0, 1+5*binary.MaxVarintLen64+len(r.key)+len(e.Value)+len(e.Version.Node))
+	payload = appendField(payload, r.key)
+	payload = appendField(payload, e.Value)
+	payload = binary.AppendUvarint(payload, e.Version.Clock)
+	payload = appendField(payload, e.Version.Node)
+	var flags byte
+	if e.Deleted {
+		flags |= flagDeleted
+	}
+	payload = append(payload, flags)
+	payload = binary.AppendVarint(payload, e.Expires)
+	payload = binary.AppendVarint(payload, r.at.UnixMilli())
+
+	buf := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(buf[0:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(payload))
+	return append(buf, payload...)
+}
+
+// readRecord returns io.EOF only at clean record boundary, any partial
+// or damaged record is reported as ErrTornRecord
+func readRecord(br *bufio.Reader) (record, int, error) {
+	var r record
+	header := make([]byte, 8)
+	n, err := io.ReadFull(br, header)
+	if err == io.EOF {
+		return r, 0, io.EOF
+	}
+	if err != nil {
+		return r, 0, ErrTornRecord
+	}
+	length := binary.BigEndian.Uint32(header[0:])
+	sum := binary.BigEndian.Uint32(header[4:])
+	if length == 0 || length > maxRecordSize {
+		return r, 0, ErrTornRecord
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return r, 0, ErrTornRecord
+	}
+	if crc32.ChecksumIEEE(payload) != sum {
+		return r, 0, ErrTornRecord
+	}
+
+	key, rest, ok := readField(payload)
+	if !ok {
+		return r, 0, ErrTornRecord
+	}
+	value, rest, ok := readField(rest)
+	if !ok {
+		return r, 0, ErrTornRecord
+	}
+	clock, cn := binary.Uvarint(rest)
+	if cn <= 0 {
+		return r, 0, ErrTornRecord
+	}
+	node, rest, ok := readField(rest[cn:])
+	if !ok || len(rest) == 0 {
+		return r, 0, ErrTornRecord
+	}
+	flags := rest[0]
+	expires, en := binary.Varint(rest[1:])
+	if en <= 0 {
+		return r, 0, ErrTornRecord
+	}
+	at, an := binary.Varint(rest[1+en:])
+	if an <= 0 || 1+en+an != len(rest) {
+		return r, 0, ErrTornRecord
+	}
+	r.key = key
+	r.entry = Entry{
+		Value:   value,
+		Version: Version{Clock: clock, Node: node},
+		Deleted: flags&flagDeleted != 0,
+		Expires: expires,
+	}
+	r.at = time.UnixMilli(at)
+	return r, n + int(length), nil
+}
+
+func appendField(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func readField(b []byte) (string, []byte, bool) {
+	l, n := binary.Uvarint(b)
+	if n <= 0 || uint64(len(b)-n) < l {
+		return "", nil, false
+	}
+	return string(b[n : n+int(l)]), b[n+int(l):], true
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("open dir: %w", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("sync dir: %w", err)
+	}
+	return nil
+}
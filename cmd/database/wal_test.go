@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestStore(t *testing.T, dir string) *DurableStore {
+	t.Helper()
+	ds, err := OpenDurableStore(dir, DurableOptions{Sync: SyncAlways})
+	if err != nil {
+		t.Fatalf("could not open store: %v\n", err)
+	}
+	return ds
+}
+
+// set inserts through database, which recovers its clock from the store
+func set(t *testing.T, s Store, key, value string) {
+	t.Helper()
+	if err := newDatabase(s).setValue(key, value); err != nil {
+		t.Fatalf("could not set %q: %v\n", key, err)
+	}
+}
+
+func expectValue(t *testing.T, s Store, key, want string) {
+	t.Helper()
+	got, ok := s.Get(key)
+	if !ok {
+		t.Errorf("key %q is missing\n", key)
+		return
+	}
+	if got.Value != want {
+		t.Errorf("key %q: got %q, want %q\n", key, got.Value, want)
+	}
+}
+
+func TestRecoverFromWAL(t *testing.T) {
+	dir := t.TempDir()
+
+	ds := openTestStore(t, dir)
+	set(t, ds, "foo", "bar")
+	set(t, ds, "foo", "baz")
+	set(t, ds, "a=b", "c\nd")
+	if err := ds.Close(); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+
+	ds = openTestStore(t, dir)
+	defer ds.Close()
+	expectValue(t, ds, "foo", "baz")
+	expectValue(t, ds, "a=b", "c\nd")
+}
+
+func TestRecoverTornRecord(t *testing.T) {
+	dir := t.TempDir()
+
+	ds := openTestStore(t, dir)
+	set(t, ds, "foo", "bar")
+	set(t, ds, "second", "value")
+	_ = ds.Close()
+
+	// simulate crash in the middle of append, by cutting last record in half
+	path := filepath.Join(dir, walFile)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if err := os.Truncate(path, info.Size()-5); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+
+	ds = openTestStore(t, dir)
+	expectValue(t, ds, "foo", "bar")
+	if _, ok := ds.Get("second"); ok {
+		t.Errorf("torn record should not be applied\n")
+	}
+
+	// new records must be readable after the torn tail got truncated
+	set(t, ds, "third", "3")
+	_ = ds.Close()
+
+	ds = openTestStore(t, dir)
+	defer ds.Close()
+	expectValue(t, ds, "foo", "bar")
+	expectValue(t, ds, "third", "3")
+}
+
+func TestRecoverCorruptedRecord(t *testing.T) {
+	dir := t.TempDir()
+
+	ds := openTestStore(t, dir)
+	set(t, ds, "foo", "bar")
+	set(t, ds, "second", "value")
+	_ = ds.Close()
+
+	path := filepath.Join(dir, walFile)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	data[len(data)-1] ^= 0xFF
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+
+	ds = openTestStore(t, dir)
+	defer ds.Close()
+	expectValue(t, ds, "foo", "bar")
+	if _, ok := ds.Get("second"); ok {
+		t.Errorf("record with bad checksum should not be applied\n")
+	}
+}
+
+func TestSnapshotCompactsWAL(t *testing.T) {
+	dir := t.TempDir()
+
+	ds := openTestStore(t, dir)
+	for range 100 {
+		set(t, ds, "counter", "value")
+	}
+	if err := ds.Snapshot(); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, walFile))
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if info.Size() != 0 {
+		t.Errorf("wal should be empty after snapshot, has %d bytes\n", info.Size())
+	}
+
+	set(t, ds, "after", "snapshot")
+	_ = ds.Close()
+
+	ds = openTestStore(t, dir)
+	defer ds.Close()
+	expectValue(t, ds, "counter", "value")
+	expectValue(t, ds, "after", "snapshot")
+}
+
+func TestRecoverTombstoneAndExpiry(t *testing.T) {
+	dir := t.TempDir()
+
+	ds := openTestStore(t, dir)
+	_, _ = ds.Put("gone", Entry{Version: Version{Clock: 2, Node: "n"}, Deleted: true}, time.Now())
+	_, _ = ds.Put("ttl", Entry{Value: "v", Version: Version{Clock: 3, Node: "n"}, Expires: 12345}, time.Now())
+	_ = ds.Close()
+
+	ds = openTestStore(t, dir)
+	defer ds.Close()
+	if e, _ := ds.Get("gone"); !e.Deleted || e.Version.Clock != 2 {
+		t.Errorf("tombstone not recovered: %+v\n", e)
+	}
+	if e, _ := ds.Get("ttl"); e.Expires != 12345 || e.Value != "v" {
+		t.Errorf("expiry not recovered: %+v\n", e)
+	}
+	// older write must not resurrect deleted key
+	if ok, _ := ds.Put("gone", Entry{Value: "old", Version: Version{Clock: 1, Node: "n"}}, time.Now()); ok {
+		t.Errorf("older write replaced tombstone\n")
+	}
+}
+
+// shortWriter writes only part of the next record and fails, like full disk
+type shortWriter struct {
+	logFile
+	fail bool
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if !w.fail {
+		return w.logFile.Write(p)
+	}
+	w.fail = false
+	n, _ := w.logFile.Write(p[:len(p)/2])
+	return n, errors.New("no space left on device")
+}
+
+func TestRecordRoundTrip(t *testing.T) {
+	want := record{
+		key:   "k",
+		entry: Entry{Value: "v", Version: Version{Clock: 7, Node: "n"}, Expires: 1_000_500, Deleted: true},
+		at:    time.UnixMilli(1_000_000),
+	}
+	got, n, err := readRecord(bufio.NewReader(bytes.NewReader(encodeRecord(want))))
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if got.key != want.key || got.entry != want.entry || !got.at.Equal(want.at) || n != len(encodeRecord(want)) {
+		t.Errorf("got %+v (%d bytes), want %+v\n", got, n, want)
+	}
+}
+
+func TestFailedAppendIsCutOff(t *testing.T) {
+	dir := t.TempDir()
+
+	ds := openTestStore(t, dir)
+	w := &shortWriter{logFile: ds.wal}
+	ds.wal = w
+	set(t, ds, "before", "1")
+	w.fail = true
+	if err := newDatabase(ds).setValue("failed", "2"); err == nil {
+		t.Fatalf("write to full disk succeeded\n")
+	}
+	// acknowledged after failed one, must survive restart
+	set(t, ds, "after", "3")
+	_ = ds.Close()
+
+	ds = openTestStore(t, dir)
+	defer ds.Close()
+	expectValue(t, ds, "before", "1")
+	expectValue(t, ds, "after", "3")
+	if _, ok := ds.Get("failed"); ok {
+		t.Errorf("failed write was recovered\n")
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	ds := openTestStore(t, t.TempDir())
+	if err := ds.Close(); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if err := ds.Close(); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("got %v, want %v\n", err, os.ErrClosed)
+	}
+}
@@ -1,52 +1,154 @@
 package main
 
-import "testing"
+import (
+	"bean/pkg/lrcp"
+	"bean/pkg/lrcp/lossy"
+	"bean/pkg/pserver"
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
 
-func TestParseMessage(t *testing.T) {
-	validDataMessage := "/data/1234/0/Hello world!/"
+func TestReverse(t *testing.T) {
+	var tests = []struct {
+		s    string
+		want string
+	}{
+		{"hello", "olleh"},
+		{"a", "a"},
+		{"now is the time", "emit eht si won"},
+	}
+	for _, tt := range tests {
+		if got := reverse(tt.s); got != tt.want {
+			t.Errorf("got %q, want %q\n", got, tt.want)
+		}
+	}
+}
 
-	tp, s, rest, err := ParseMessage(validDataMessage)
+func startServer(t *testing.T) string {
+	t.Helper()
+	return startServerWith(t, &lrcp.ListenConfig{})
+}
 
+func startServerWith(t *testing.T, lc *lrcp.ListenConfig) string {
+	t.Helper()
+	ln, err := lc.Listen("127.0.0.1:0")
 	if err != nil {
-		t.Errorf("Unexpected error: %v\n", err)
+		t.Fatalf("unexpected error: %v\n", err)
 	}
+	t.Cleanup(func() { ln.Close() })
+	go pserver.Serve(ln, handleConnection)
+	return ln.Addr().String()
+}
 
-	wantRest := `0/Hello world!`
-	if rest != wantRest {
-		t.Errorf("got %q, want %q\n", rest, wantRest)
+func TestReversalOverLRCP(t *testing.T) {
+	conn, err := lrcp.Dial(startServer(t))
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
 	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
 
-	if tp != Type("data") {
-		t.Errorf("Wrong type: %q\n", err)
+	_, _ = conn.Write([]byte("hello\n\nwor"))
+	_, _ = conn.Write([]byte("ld/\\\n"))
+	r := bufio.NewReader(conn)
+	for _, want := range []string{"olleh\n", "\\/dlrow\n"} {
+		got, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("unexpected error: %v\n", err)
+		}
+		if got != want {
+			t.Errorf("got %q, want %q\n", got, want)
+		}
 	}
+}
 
-	if s != Session(1234) {
-		t.Errorf("Wrong session: %d\n", s)
+// TestWireFormat talks to server with raw datagrams, like example session in the spec
+func TestWireFormat(t *testing.T) {
+	raddr, _ := net.ResolveUDPAddr("udp", startServer(t))
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
 	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
 
-	invalidMessage := "/data/0x12/1/o7/"
-	_, _, _, err = ParseMessage(invalidMessage)
-
-	if err == nil {
-		t.Errorf("expected error")
+	var exchange = []struct {
+		send string
+		want []string
+	}{
+		{"/connect/12345/", []string{"/ack/12345/0/"}},
+		{"/data/12345/0/hello\n/", []string{"/ack/12345/6/", "/data/12345/0/olleh\n/"}},
+		{"/ack/12345/6/", nil},
+		{"/data/12345/6/Hello, world!\n/", []string{"/ack/12345/20/", "/data/12345/6/!dlrow ,olleH\n/"}},
+		{"/ack/12345/20/", nil},
+		{"/data/54321/0/unknown\n/", []string{"/close/54321/"}},
+		{"/close/12345/", []string{"/close/12345/"}},
+	}
+	buf := make([]byte, 1000)
+	for _, e := range exchange {
+		if _, err := conn.Write([]byte(e.send)); err != nil {
+			t.Fatalf("unexpected error: %v\n", err)
+		}
+		for _, want := range e.want {
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatalf("%q: unexpected error: %v\n", e.send, err)
+			}
+			if got := string(buf[:n]); got != want {
+				t.Errorf("%q: got %q, want %q\n", e.send, got, want)
+			}
+		}
 	}
 }
 
-func TestUnescape(t *testing.T) {
-	msg := "\\/"
-
-	if len(msg) != 2 {
-		t.Errorf("I don't understand strings, len: %d\n", len(msg))
+// TestReversalOverLossyNetwork sends lines through proxy losing a quarter of
+// datagrams each way and reordering, duplicating and cutting others
+func TestReversalOverLossyNetwork(t *testing.T) {
+	lc := lrcp.ListenConfig{Retransmit: 50 * time.Millisecond, MinRetransmit: 20 * time.Millisecond}
+	proxy, err := lossy.Listen(startServerWith(t, &lc), lossy.Faults{
+		Drop:      0.25,
+		Reorder:   0.25,
+		Duplicate: 0.05,
+		Corrupt:   0.05,
+		Delay:     5 * time.Millisecond,
+		Seed:      1,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
 	}
+	defer proxy.Close()
 
-	unescaped, err := unescapeMsg(msg)
-
+	d := lrcp.Dialer{Retransmit: 50 * time.Millisecond, MinRetransmit: 20 * time.Millisecond, ConnectRetry: 50 * time.Millisecond}
+	conn, err := d.Dial(proxy.Addr().String())
 	if err != nil {
-		t.Errorf("unexpected error: %v\n", err)
+		t.Fatalf("unexpected error: %v\n", err)
 	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(20 * time.Second))
 
-	want := "/"
-	if unescaped != want {
-		t.Errorf("unescaped: %v\n", unescaped)
+	var lines []string
+	for i := range 30 {
+		lines = append(lines, fmt.Sprintf("line %d of slashes/and\\backslashes", i))
+	}
+	go func() {
+		for _, line := range lines {
+			_, _ = conn.Write([]byte(line + "\n"))
+		}
+	}()
+	r := bufio.NewReader(conn)
+	for _, line := range lines {
+		got, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("unexpected error: %v\n", err)
+		}
+		if want := reverse(line) + "\n"; got != want {
+			t.Errorf("got %q, want %q\n", got, want)
+		}
+	}
+	if stats := proxy.Stats(); stats.Dropped == 0 || stats.Reordered == 0 {
+		t.Errorf("network was not lossy: %+v\n", stats)
 	}
 }
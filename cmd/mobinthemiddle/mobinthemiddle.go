@@ -3,57 +3,208 @@ package main
 import (
 	"bean/pkg/pserver"
 	"bufio"
+	"errors"
 	"flag"
-	"github.com/dlclark/regexp2"
+	"fmt"
+	"io"
 	"log"
 	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
 var portNumber = flag.Int("port", 4242, "Port number of server")
+var upstream = flag.String("upstream", "chat.protohackers.com:16963", "Address of upstream server")
+var rulesFile = flag.String("rules", "", "JSON file with rewrite rules, Boguscoin rewriting is used when empty")
+var recordDir = flag.String("record-dir", "", "Directory for transcripts of proxied sessions, recording is disabled when empty")
+var replayFile = flag.String("replay", "", "Replay transcript against -upstream and report differences instead of proxying")
+var replayTimeout = flag.Duration("replay-timeout", 2*time.Second, "How long replay waits for every expected line")
+var partialLine = flag.String("partial-line", "forward", "What to do with unterminated last line: drop, forward or terminate")
 
 func main() {
 	flag.Parse()
+	rules := BogusCoinRules()
+	if *rulesFile != "" {
+		var err error
+		if rules, err = LoadRules(*rulesFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *replayFile != "" {
+		os.Exit(replay(rules))
+	}
+	partial, err := ParsePartialLinePolicy(*partialLine)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("proxying to %s with %d rewrite rules\n", *upstream, len(rules))
+
+	p := &Proxy{Upstream: *upstream, Rules: rules, Partial: partial, RecordDir: *recordDir}
 	handler := pserver.WithMiddleware(
-		handleConnection,
+		p.handleConnection,
 		pserver.LoggingMiddleware,
 	)
 
 	log.Fatal(pserver.ListenServe(handler, *portNumber))
 }
 
-func handleConnection(conn net.Conn) {
-	fConn, err := net.Dial("tcp", "chat.protohackers.com:16963")
-	//fConn, err := net.Dial("tcp", "localhost:4243")
+// replay runs -replay mode and returns exit code, 1 when anything differs
+func replay(rules Rules) int {
+	records, err := ReadTranscript(*replayFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	mismatches, err := Replay(records, *upstream, rules, *replayTimeout)
+	for _, m := range mismatches {
+		fmt.Println(m)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(mismatches) > 0 {
+		fmt.Printf("%d differences in %d records\n", len(mismatches), len(records))
+		return 1
+	}
+	fmt.Printf("no differences in %d records\n", len(records))
+	return 0
+}
+
+// PartialLinePolicy decides what happens with data after last newline when one side closes
+type PartialLinePolicy int
+
+const (
+	// PartialForward rewrites incomplete line and forwards it without newline,
+	// it's the default so proxy passes on everything it got
+	PartialForward PartialLinePolicy = iota
+	// PartialDrop discards incomplete line, protocols like budgetchat ignore it anyway
+	PartialDrop
+	// PartialTerminate rewrites incomplete line and forwards it with newline added
+	PartialTerminate
+)
+
+func ParsePartialLinePolicy(s string) (PartialLinePolicy, error) {
+	switch s {
+	case "drop":
+		return PartialDrop, nil
+	case "forward":
+		return PartialForward, nil
+	case "terminate":
+		return PartialTerminate, nil
+	default:
+		return 0, fmt.Errorf("unknown partial line policy %q", s)
+	}
+}
+
+// Proxy forwards lines between client and upstream, rewriting them on the way
+type Proxy struct {
+	Upstream string
+	Rules    Rules
+	Partial  PartialLinePolicy
+	// RecordDir is where session transcripts are written, empty disables recording
+	RecordDir string
+}
+
+// closeWriter is implemented by connections supporting half-close, like *net.TCPConn
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// handleConnection proxies until both directions are finished. End of input
+// in one direction is passed on as half-close, so the other direction keeps
+// working, any error tears down both connections
+func (p *Proxy) handleConnection(conn net.Conn) {
+	fConn, err := net.Dial("tcp", p.Upstream)
 	if err != nil {
 		log.Printf("could not connect to upstream: %v", err)
-		_ = conn.Close()
+		pserver.HandleConnShutdown(conn)
 		return
 	}
-	go BogCoinProxy(fConn, conn)
-	go BogCoinProxy(conn, fConn)
+
+	var rec *Recorder
+	if p.RecordDir != "" {
+		if rec, err = NewRecorder(p.RecordDir); err != nil {
+			log.Printf("session will not be recorded: %v\n", err)
+		} else {
+			log.Printf("recording session to %s\n", rec.Name())
+		}
+	}
+	rec.Connect(conn.RemoteAddr().String(), fConn.RemoteAddr().String())
+
+	var once sync.Once
+	teardown := func() {
+		once.Do(func() {
+			pserver.HandleConnShutdown(conn)
+			pserver.HandleConnShutdown(fConn)
+		})
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	run := func(input, output net.Conn, dir Direction) {
+		defer wg.Done()
+		defer rec.Closed(dir)
+		if err := p.pipe(input, output, dir, rec); err != nil {
+			log.Printf("%s: %v\n", dir, err)
+			teardown()
+		}
+	}
+	go run(fConn, conn, ToClient)
+	go run(conn, fConn, ToUpstream)
+	wg.Wait()
+
+	teardown()
+	if err := rec.Close(); err != nil {
+		log.Printf("could not close transcript: %v\n", err)
+	}
 }
 
-func BogCoinProxy(input, output net.Conn) {
-	defer pserver.HandleConnShutdown(input)
-	defer pserver.HandleConnShutdown(output)
-	//re := regexp.MustCompile(`\b7[a-zA-Z0-9]{25,34}\b`)
-	//re := regexp.MustCompile(`(?:^|\s)(7[a-zA-Z0-9]{25,34})(?=\s|\n)`)
-	re := regexp2.MustCompile(`(?<=^|\s)7[a-zA-Z0-9]{25,34}(?=\s|\n)`, 0)
+// pipe rewrites lines read from input and writes them to output. It returns
+// nil after input ended and output was half-closed
+func (p *Proxy) pipe(input, output net.Conn, dir Direction, rec *Recorder) error {
 	reader := bufio.NewReader(input)
 	for {
 		message, err := reader.ReadString('\n')
-		if err != nil || message == "" {
-
-			return
+		if errors.Is(err, io.EOF) {
+			if message != "" && p.Partial != PartialDrop {
+				if err := p.forward(output, dir, rec, message); err != nil {
+					return err
+				}
+			} else if message != "" {
+				log.Printf("dropping partial line (%s): %q\n", dir, message)
+			}
+			cw, ok := output.(closeWriter)
+			if !ok {
+				return errors.New("connection does not support half-close")
+			}
+			if err := cw.CloseWrite(); err != nil {
+				return fmt.Errorf("half-close: %w", err)
+			}
+			return nil
 		}
-		log.Printf("reading message: %q\n", message)
-		result, _ := re.Replace(message, "7YWHMfk9JZe0LM0g1ZauHuiSxhI", -1, -1)
-
-		log.Printf("replaced all adresses")
-		if result[len(result)-1] != '\n' {
-			result += "\n"
+		if err != nil {
+			return fmt.Errorf("read: %w", err)
+		}
+		if err := p.forward(output, dir, rec, message); err != nil {
+			return err
 		}
-		output.Write([]byte(result))
-		log.Printf("send: %q\n", result)
 	}
 }
+
+// forward rewrites and writes single line, complete lines stay complete even if
+// rewrite removed the newline
+func (p *Proxy) forward(output net.Conn, dir Direction, rec *Recorder, message string) error {
+	log.Printf("reading message (%s): %q\n", dir, message)
+	complete := strings.HasSuffix(message, "\n") || p.Partial == PartialTerminate
+	result, err := p.Rules.applyLine(message, dir, complete)
+	if err != nil {
+		log.Printf("could not rewrite message: %v\n", err)
+	}
+	rec.Line(dir, message, result)
+	if _, err := output.Write([]byte(result)); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	log.Printf("send: %q\n", result)
+	return nil
+}
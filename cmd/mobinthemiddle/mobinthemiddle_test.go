@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// chatUpstream is minimal budgetchat: it asks for name and relays
+// "[name] message" lines to everybody else in the room
+type chatUpstream struct {
+	conns map[string]net.Conn
+	mu    sync.Mutex
+}
+
+func startChatUpstream(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	chat := &chatUpstream{conns: make(map[string]net.Conn)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go chat.handle(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func (c *chatUpstream) handle(conn net.Conn) {
+	defer conn.Close()
+	_, _ = conn.Write([]byte("Welcome to budgetchat! What shall I call you?\n"))
+	br := bufio.NewReader(conn)
+	name, err := br.ReadString('\n')
+	if err != nil {
+		return
+	}
+	name = strings.TrimSpace(name)
+
+	c.mu.Lock()
+	var names []string
+	for n := range c.conns {
+		names = append(names, n)
+	}
+	c.conns[name] = conn
+	c.mu.Unlock()
+	_, _ = conn.Write([]byte("* The room contains: " + strings.Join(names, ", ") + "\n"))
+
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return
+		}
+		c.mu.Lock()
+		for n, other := range c.conns {
+			if n != name {
+				_, _ = other.Write([]byte("[" + name + "] " + line))
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+func startProxy(t *testing.T, p *Proxy) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go p.handleConnection(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+type chatClient struct {
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+func chatJoin(t *testing.T, addr, name string) *chatClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	c := &chatClient{conn: conn, br: bufio.NewReader(conn)}
+	c.expectPrefix(t, "Welcome")
+	c.send(t, name+"\n")
+	c.expectPrefix(t, "* The room contains:")
+	return c
+}
+
+func (c *chatClient) send(t *testing.T, msg string) {
+	t.Helper()
+	if _, err := c.conn.Write([]byte(msg)); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+}
+
+func (c *chatClient) read(t *testing.T) string {
+	t.Helper()
+	_ = c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := c.br.ReadString('\n')
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	return line
+}
+
+func (c *chatClient) expect(t *testing.T, want string) {
+	t.Helper()
+	if got := c.read(t); got != want {
+		t.Errorf("got %q, want %q\n", got, want)
+	}
+}
+
+func (c *chatClient) expectPrefix(t *testing.T, prefix string) {
+	t.Helper()
+	if got := c.read(t); !strings.HasPrefix(got, prefix) {
+		t.Errorf("got %q, want prefix %q\n", got, prefix)
+	}
+}
+
+func TestRulesApply(t *testing.T) {
+	rules := BogusCoinRules()
+
+	var tests = []struct {
+		line string
+		want string
+	}{
+		{"7F1u3wSD5RbOHQmupo9nx4TnhQ\n", "7YWHMfk9JZe0LM0g1ZauHuiSxhI\n"},
+		{"pay 7iKDZEwPZSqIvDnHvVN2r0hUWXD5rHX now\n", "pay 7YWHMfk9JZe0LM0g1ZauHuiSxhI now\n"},
+		{"pay 7adNeSwJkMakpEcln9HEtthSRtxdmEHOT8T-1234\n", "pay 7adNeSwJkMakpEcln9HEtthSRtxdmEHOT8T-1234\n"},
+		{"too short 7abc\n", "too short 7abc\n"},
+	}
+	for _, tt := range tests {
+		got, err := rules.Apply(tt.line, ToUpstream)
+		if err != nil {
+			t.Fatalf("unexpected error: %v\n", err)
+		}
+		if got != tt.want {
+			t.Errorf("got %q, want %q\n", got, tt.want)
+		}
+	}
+}
+
+func TestLoadRulesErrors(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"invalid-json":      `[{"pattern": `,
+		"invalid-pattern":   `[{"pattern": "(", "direction": "both"}]`,
+		"invalid-direction": `[{"pattern": "a", "direction": "sideways"}]`,
+	} {
+		path := filepath.Join(dir, name)
+		_ = os.WriteFile(path, []byte(content), 0o644)
+		if _, err := LoadRules(path); err == nil {
+			t.Errorf("%s: expected error\n", name)
+		}
+	}
+}
+
+func TestProxyRewritesChat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	config := `[
+		{"pattern": "\\bsecret\\b", "replacement": "******", "direction": "client-to-upstream"},
+		{"pattern": "(?<=^\\[)bob(?=\\])", "replacement": "b0b", "direction": "upstream-to-client"},
+		{"pattern": "(\\d+) coins", "replacement": "$1 bogus coins", "direction": "both"}
+	]`
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	rules, err := LoadRules(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+
+	upstreamAddr := startChatUpstream(t)
+	proxyAddr := startProxy(t, &Proxy{Upstream: upstreamAddr, Rules: rules})
+
+	bob := chatJoin(t, upstreamAddr, "bob")
+	alice := chatJoin(t, proxyAddr, "alice")
+
+	alice.send(t, "my secret is 5 coins\n")
+	bob.expect(t, "[alice] my ****** is 5 bogus coins\n")
+
+	bob.send(t, "secret? 7 coins for bob\n")
+	alice.expect(t, "[b0b] secret? 7 bogus coins for bob\n")
+}
+
+// startCollectUpstream reads everything until client half-closes, reports what
+// it got and only then answers and closes
+func startCollectUpstream(t *testing.T) (string, chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := io.ReadAll(conn)
+		received <- string(data)
+		_, _ = conn.Write([]byte("bye 12 coins\n"))
+	}()
+	return ln.Addr().String(), received
+}
+
+// countingConn counts how many times proxy closed client connection
+type countingConn struct {
+	*net.TCPConn
+	closes      atomic.Int32
+	closeWrites atomic.Int32
+}
+
+func (c *countingConn) Close() error {
+	c.closes.Add(1)
+	return c.TCPConn.Close()
+}
+
+func (c *countingConn) CloseWrite() error {
+	c.closeWrites.Add(1)
+	return c.TCPConn.CloseWrite()
+}
+
+// proxyPair connects client to proxy without listener, so test can
+// wait for handleConnection to return
+func proxyPair(t *testing.T, p *Proxy) (*net.TCPConn, *countingConn, chan struct{}) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+
+	counted := &countingConn{TCPConn: server.(*net.TCPConn)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.handleConnection(counted)
+	}()
+	return client.(*net.TCPConn), counted, done
+}
+
+func waitDone(t *testing.T, done chan struct{}) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("proxy session did not finish\n")
+	}
+}
+
+func TestProxyPartialLineAddress(t *testing.T) {
+	var tests = []struct {
+		policy PartialLinePolicy
+		want   string
+	}{
+		{PartialForward, "pay 7YWHMfk9JZe0LM0g1ZauHuiSxhI"},
+		{PartialTerminate, "pay 7YWHMfk9JZe0LM0g1ZauHuiSxhI\n"},
+	}
+
+	for _, tt := range tests {
+		upstreamAddr, received := startCollectUpstream(t)
+		p := &Proxy{Upstream: upstreamAddr, Rules: BogusCoinRules(), Partial: tt.policy}
+		client, _, done := proxyPair(t, p)
+
+		_, _ = client.Write([]byte("pay 7iKDZEwPZSqIvDnHvVN2r0hUWXD5rHX"))
+		if err := client.CloseWrite(); err != nil {
+			t.Fatalf("unexpected error: %v\n", err)
+		}
+		select {
+		case got := <-received:
+			if got != tt.want {
+				t.Errorf("policy %d: upstream got %q, want %q\n", tt.policy, got, tt.want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("policy %d: half-close not propagated to upstream\n", tt.policy)
+		}
+		_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, _ = io.ReadAll(client)
+		waitDone(t, done)
+	}
+}
+
+func TestProxyHalfClose(t *testing.T) {
+	var tests = []struct {
+		policy PartialLinePolicy
+		want   string
+	}{
+		{PartialDrop, "5 bogus coins\n"},
+		{PartialForward, "5 bogus coins\nand 7 bogus coins"},
+		{PartialTerminate, "5 bogus coins\nand 7 bogus coins\n"},
+		// zero value forwards partial line like proxy always did
+		{PartialLinePolicy(0), "5 bogus coins\nand 7 bogus coins"},
+	}
+
+	for _, tt := range tests {
+		upstreamAddr, received := startCollectUpstream(t)
+		p := &Proxy{Upstream: upstreamAddr, Rules: coinRules("$1 bogus coins"), Partial: tt.policy}
+		client, counted, done := proxyPair(t, p)
+
+		_, _ = client.Write([]byte("5 coins\nand 7 coins"))
+		if err := client.CloseWrite(); err != nil {
+			t.Fatalf("unexpected error: %v\n", err)
+		}
+
+		// upstream sees end of input while client can still read the answer
+		select {
+		case got := <-received:
+			if got != tt.want {
+				t.Errorf("policy %d: upstream got %q, want %q\n", tt.policy, got, tt.want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("policy %d: half-close not propagated to upstream\n", tt.policy)
+		}
+		_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		answer, err := io.ReadAll(client)
+		if err != nil || string(answer) != "bye 12 bogus coins\n" {
+			t.Errorf("policy %d: got %q, %v\n", tt.policy, answer, err)
+		}
+
+		waitDone(t, done)
+		if counted.closes.Load() != 1 || counted.closeWrites.Load() != 1 {
+			t.Errorf("policy %d: client closed %d times, half-closed %d times\n",
+				tt.policy, counted.closes.Load(), counted.closeWrites.Load())
+		}
+	}
+}
+
+func TestProxyTeardownOnError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		// reset instead of orderly close
+		_ = conn.(*net.TCPConn).SetLinger(0)
+		_ = conn.Close()
+	}()
+
+	client, counted, done := proxyPair(t, &Proxy{Upstream: ln.Addr().String()})
+	waitDone(t, done)
+
+	_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Errorf("client connection should be closed\n")
+	}
+	if counted.closes.Load() != 1 {
+		t.Errorf("client closed %d times, want once\n", counted.closes.Load())
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Kinds of transcript records
+const (
+	EventConnect = "connect"
+	EventLine    = "line"
+	EventClose   = "close"
+)
+
+// Record is single line of transcript file. For connect and close events
+// Original holds address of the peer, for close Direction tells which pipe ended
+type Record struct {
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	Direction string    `json:"direction,omitempty"`
+	Original  string    `json:"original,omitempty"`
+	Rewritten string    `json:"rewritten,omitempty"`
+}
+
+var sessionSeq atomic.Uint64
+
+// Recorder writes transcript of single proxied session as JSON lines,
+// nil recorder records nothing
+type Recorder struct {
+	f   *os.File
+	enc *json.Encoder
+	now func() time.Time
+
+	mu sync.Mutex
+}
+
+// NewRecorder creates transcript file named after current time in dir
+func NewRecorder(dir string) (*Recorder, error) {
+	name := fmt.Sprintf("session-%s-%d.jsonl", time.Now().UTC().Format("20060102T150405.000000"), sessionSeq.Add(1))
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("create transcript: %w", err)
+	}
+	return &Recorder{f: f, enc: json.NewEncoder(f), now: time.Now}, nil
+}
+
+func (r *Recorder) Name() string {
+	if r == nil {
+		return ""
+	}
+	return r.f.Name()
+}
+
+func (r *Recorder) write(rec Record) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rec.Time = r.now()
+	if err := r.enc.Encode(rec); err != nil {
+		log.Printf("could not write transcript %s: %v\n", r.f.Name(), err)
+	}
+}
+
+func (r *Recorder) Connect(client, upstream string) {
+	r.write(Record{Event: EventConnect, Direction: ToUpstream.String(), Original: client})
+	r.write(Record{Event: EventConnect, Direction: ToClient.String(), Original: upstream})
+}
+
+func (r *Recorder) Line(dir Direction, original, rewritten string) {
+	r.write(Record{Event: EventLine, Direction: dir.String(), Original: original, Rewritten: rewritten})
+}
+
+func (r *Recorder) Closed(dir Direction) {
+	r.write(Record{Event: EventClose, Direction: dir.String()})
+}
+
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
+
+func ReadTranscript(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open transcript: %w", err)
+	}
+	defer f.Close()
+
+	var records []Record
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for dec.More() {
+		var rec Record
+		if err := dec.Decode(&rec); err != nil {
+			return nil, fmt.Errorf("read transcript %s: %w", path, err)
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Mismatch is difference between transcript and replay. Kind "rule" means
+// current rules rewrite recorded line differently, "response" means target
+// sent something else than upstream did when the session was recorded
+type Mismatch struct {
+	Index int
+	Kind  string
+	Want  string
+	Got   string
+}
+
+func (m Mismatch) String() string {
+	return fmt.Sprintf("record %d (%s):\n-%q\n+%q", m.Index, m.Kind, m.Want, m.Got)
+}
+
+const (
+	lineTimedOut = "<timeout>"
+	lineClosed   = "<closed>"
+)
+
+// Replay plays client side of transcript against target. Lines the client sent
+// are rewritten by rules and sent to target, lines upstream sent are expected
+// from target in recorded order. Every recorded line is also rewritten again
+// to check the rules offline. Timing of transcript is ignored, each expected
+// line is awaited up to timeout
+func Replay(records []Record, target string, rules Rules, timeout time.Duration) ([]Mismatch, error) {
+	conn, err := net.Dial("tcp", target)
+	if err != nil {
+		return nil, fmt.Errorf("connect to target: %w", err)
+	}
+	defer conn.Close()
+
+	lines := make(chan string)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(lines)
+		br := bufio.NewReader(conn)
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			select {
+			case lines <- line:
+			case <-done:
+				return
+			}
+		}
+	}()
+	next := func() string {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				return lineClosed
+			}
+			return line
+		case <-time.After(timeout):
+			return lineTimedOut
+		}
+	}
+
+	var mismatches []Mismatch
+	for i, rec := range records {
+		if rec.Event != EventLine {
+			continue
+		}
+		dir, err := ParseDirection(rec.Direction)
+		if err != nil {
+			return mismatches, fmt.Errorf("record %d: %w", i, err)
+		}
+
+		// proxy may have terminated partial line, recorded rewrite ends with newline then
+		complete := strings.HasSuffix(rec.Original, "\n") || strings.HasSuffix(rec.Rewritten, "\n")
+		rewritten, err := rules.applyLine(rec.Original, dir, complete)
+		if err != nil {
+			return mismatches, fmt.Errorf("record %d: %w", i, err)
+		}
+		if rewritten != rec.Rewritten {
+			mismatches = append(mismatches, Mismatch{Index: i, Kind: "rule", Want: rec.Rewritten, Got: rewritten})
+		}
+
+		switch dir {
+		case ToUpstream:
+			if _, err := io.WriteString(conn, rewritten); err != nil {
+				return mismatches, fmt.Errorf("send record %d: %w", i, err)
+			}
+		case ToClient:
+			if got := next(); got != rec.Original {
+				mismatches = append(mismatches, Mismatch{Index: i, Kind: "response", Want: rec.Original, Got: got})
+			}
+		}
+	}
+	return mismatches, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"github.com/dlclark/regexp2"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startEchoUpstream answers every line with prefix + line
+func startEchoUpstream(t *testing.T, prefix string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					line, err := br.ReadString('\n')
+					if err != nil {
+						return
+					}
+					_, _ = conn.Write([]byte(prefix + line))
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func coinRules(replacement string) Rules {
+	return Rules{{
+		Pattern:     regexp2.MustCompile(`(\d+) coins`, 0),
+		Replacement: replacement,
+		Direction:   Both,
+	}}
+}
+
+// recordSession proxies single client session to upstream and returns its transcript
+func recordSession(t *testing.T, upstreamAddr string, rules Rules) []Record {
+	t.Helper()
+	dir := t.TempDir()
+	proxyAddr := startProxy(t, &Proxy{Upstream: upstreamAddr, Rules: rules, RecordDir: dir})
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	c := &chatClient{conn: conn, br: bufio.NewReader(conn)}
+	c.send(t, "hello\n")
+	c.expect(t, "echo: hello\n")
+	c.send(t, "give me 5 coins\n")
+	c.expect(t, "echo: give me 5 bogus coins\n")
+	_ = conn.Close()
+
+	var records []Record
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		paths, _ := filepath.Glob(filepath.Join(dir, "session-*.jsonl"))
+		if len(paths) == 1 {
+			records, _ = ReadTranscript(paths[0])
+			if n := len(records); n > 0 && records[n-1].Event == EventClose && countEvents(records, EventClose) == 2 {
+				return records
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("transcript not finished: %+v\n", records)
+	return nil
+}
+
+func countEvents(records []Record, event string) int {
+	n := 0
+	for _, r := range records {
+		if r.Event == event {
+			n++
+		}
+	}
+	return n
+}
+
+func TestRecordSession(t *testing.T) {
+	upstreamAddr := startEchoUpstream(t, "echo: ")
+	records := recordSession(t, upstreamAddr, coinRules("$1 bogus coins"))
+
+	var lines []string
+	for _, r := range records {
+		if r.Event == EventLine {
+			lines = append(lines, r.Direction+" "+strings.TrimSpace(r.Original)+" -> "+strings.TrimSpace(r.Rewritten))
+		}
+	}
+	want := []string{
+		"client-to-upstream hello -> hello",
+		"upstream-to-client echo: hello -> echo: hello",
+		"client-to-upstream give me 5 coins -> give me 5 bogus coins",
+		"upstream-to-client echo: give me 5 bogus coins -> echo: give me 5 bogus coins",
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got lines %q, want %q\n", lines, want)
+	}
+	if countEvents(records, EventConnect) != 2 || records[0].Time.IsZero() {
+		t.Errorf("missing connect events: %+v\n", records[:2])
+	}
+}
+
+func TestReplay(t *testing.T) {
+	upstreamAddr := startEchoUpstream(t, "echo: ")
+	rules := coinRules("$1 bogus coins")
+	records := recordSession(t, upstreamAddr, rules)
+
+	mismatches, err := Replay(records, upstreamAddr, rules, time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if len(mismatches) != 0 {
+		t.Errorf("replay against same upstream and rules differs: %v\n", mismatches)
+	}
+
+	// changed rule is reported and changes what upstream answers
+	mismatches, _ = Replay(records, upstreamAddr, coinRules("$1 fake coins"), time.Second)
+	var kinds []string
+	for _, m := range mismatches {
+		kinds = append(kinds, m.Kind)
+	}
+	if strings.Join(kinds, ",") != "rule,response" {
+		t.Errorf("got mismatches %v\n", mismatches)
+	}
+
+	other := startEchoUpstream(t, "ECHO: ")
+	mismatches, _ = Replay(records, other, rules, time.Second)
+	if len(mismatches) != 2 || mismatches[0].Got != "ECHO: hello\n" {
+		t.Errorf("got mismatches %v\n", mismatches)
+	}
+}
+
+func TestReplayRuleEatingNewline(t *testing.T) {
+	upstreamAddr := startEchoUpstream(t, "echo: ")
+	// proxy puts the newline back, replay has to do the same
+	rules := Rules{{
+		Pattern:     regexp2.MustCompile(`(\d+) coins\n`, 0),
+		Replacement: "$1 bogus coins",
+		Direction:   Both,
+	}}
+	records := recordSession(t, upstreamAddr, rules)
+
+	mismatches, err := Replay(records, upstreamAddr, rules, time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if len(mismatches) != 0 {
+		t.Errorf("got mismatches %v\n", mismatches)
+	}
+}
+
+func TestReadTranscriptErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broken.jsonl")
+	_ = os.WriteFile(path, []byte(`{"event": "line"}`+"\n"+`{"event": `), 0o644)
+	if _, err := ReadTranscript(path); err == nil {
+		t.Errorf("expected error for truncated transcript\n")
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dlclark/regexp2"
+	"os"
+	"strings"
+)
+
+// Direction tells which side of the proxy a line comes from
+type Direction int
+
+const (
+	ToUpstream Direction = 1 << iota
+	ToClient
+	Both = ToUpstream | ToClient
+)
+
+func ParseDirection(s string) (Direction, error) {
+	switch s {
+	case "client-to-upstream":
+		return ToUpstream, nil
+	case "upstream-to-client":
+		return ToClient, nil
+	case "both", "":
+		return Both, nil
+	default:
+		return 0, fmt.Errorf("unknown direction %q", s)
+	}
+}
+
+func (d Direction) String() string {
+	switch d {
+	case ToUpstream:
+		return "client-to-upstream"
+	case ToClient:
+		return "upstream-to-client"
+	case Both:
+		return "both"
+	default:
+		return fmt.Sprintf("Direction(%d)", int(d))
+	}
+}
+
+// Rule replaces every match of Pattern in lines going in Direction.
+// Patterns use regexp2 syntax, so lookarounds are available and
+// replacement can refer to groups as $1 or ${name}
+type Rule struct {
+	Pattern     *regexp2.Regexp
+	Replacement string
+	Direction   Direction
+}
+
+// Rules are applied in order, each one to output of the previous
+type Rules []Rule
+
+func (rs Rules) Apply(line string, dir Direction) (string, error) {
+	for _, r := range rs {
+		if r.Direction&dir == 0 {
+			continue
+		}
+		result, err := r.Pattern.Replace(line, r.Replacement, -1, -1)
+		if err != nil {
+			return line, fmt.Errorf("apply %q: %w", r.Pattern.String(), err)
+		}
+		line = result
+	}
+	return line, nil
+}
+
+// applyLine rewrites single line, complete line stays complete even if
+// rewrite removed its newline. Proxy and Replay both use it, so replayed
+// lines are rewritten exactly like proxied ones were
+func (rs Rules) applyLine(line string, dir Direction, complete bool) (string, error) {
+	if complete && !strings.HasSuffix(line, "\n") {
+		// terminated partial line is rewritten like any complete one
+		line += "\n"
+	}
+	result, err := rs.Apply(line, dir)
+	if complete && !strings.HasSuffix(result, "\n") {
+		result += "\n"
+	}
+	return result, err
+}
+
+// ruleConfig is single rule in rules file, file holds JSON array of them:
+//
+//	[{"pattern": "(?<=^| )7[a-zA-Z0-9]{25,34}(?= |$)", "replacement": "7YWHMfk9JZe0LM0g1ZauHuiSxhI", "direction": "both"}]
+type ruleConfig struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+	Direction   string `json:"direction"`
+}
+
+func LoadRules(path string) (Rules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read rules: %w", err)
+	}
+	var configs []ruleConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("parse rules %s: %w", path, err)
+	}
+
+	rules := make(Rules, 0, len(configs))
+	for i, c := range configs {
+		re, err := regexp2.Compile(c.Pattern, 0)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+		dir, err := ParseDirection(c.Direction)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+		rules = append(rules, Rule{Pattern: re, Replacement: c.Replacement, Direction: dir})
+	}
+	return rules, nil
+}
+
+// BogusCoinRules steal Boguscoin payments in both directions, used when no rules file is given
+func BogusCoinRules() Rules {
+	return Rules{{
+		Pattern:     regexp2.MustCompile(`(?<=^|\s)7[a-zA-Z0-9]{25,34}(?=\s|$)`, 0),
+		Replacement: "7YWHMfk9JZe0LM0g1ZauHuiSxhI",
+		Direction:   Both,
+	}}
+}
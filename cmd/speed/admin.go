@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bean/pkg/pserver"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// Admin API, enabled with -admin-addr flag, is read-only:
+//
+//	GET /tickets -> issued tickets ordered by ID, query parameters:
+//	                plate, road, from and to (inclusive day numbers) filter them,
+//	                format is json (default) or csv
+//	GET /roads   -> limit, cameras, kept observations, dispatchers and
+//	                undelivered tickets of every known road
+//
+// Tickets are copied from ledger and road stats are read under road locks,
+// so requests never race with camera and dispatcher connections.
+func ListenServeAdmin(s *Server, addr string) error {
+	log.Printf("admin API listening at %s\n", addr)
+	return http.ListenAndServe(addr, s.adminHandler())
+}
+
+type adminRoad struct {
+	Road         uint16 `json:"road"`
+	Limit        uint16 `json:"limit"`
+	Cameras      int    `json:"cameras"`
+	Observations int    `json:"observations"`
+	Dispatchers  int    `json:"dispatchers"`
+	Pending      int    `json:"pending"`
+}
+
+func (s *Server) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /tickets", s.adminTickets)
+	mux.HandleFunc("GET /roads", s.adminRoads)
+	return mux
+}
+
+// parseTicketFilter reads filter from query parameters, empty ones are ignored
+func parseTicketFilter(r *http.Request) (TicketFilter, error) {
+	q := r.URL.Query()
+	f := TicketFilter{Plate: q.Get("plate")}
+	if v := q.Get("road"); v != "" {
+		road, err := strconv.ParseUint(v, 10, 16)
+		if err != nil {
+			return f, fmt.Errorf("invalid road %q", v)
+		}
+		n := uint16(road)
+		f.Road = &n
+	}
+	for _, p := range []struct {
+		name string
+		day  **uint32
+	}{{"from", &f.FromDay}, {"to", &f.ToDay}} {
+		v := q.Get(p.name)
+		if v == "" {
+			continue
+		}
+		day, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return f, fmt.Errorf("invalid %s day %q", p.name, v)
+		}
+		n := uint32(day)
+		*p.day = &n
+	}
+	return f, nil
+}
+
+var ticketCSVHeader = []string{"id", "plate", "road", "mile1", "timestamp1", "mile2", "timestamp2", "speed", "state", "attempts"}
+
+func (s *Server) adminTickets(w http.ResponseWriter, r *http.Request) {
+	f, err := parseTicketFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tickets := s.ledger.Find(f)
+
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "json":
+		pserver.WriteJSON(w, http.StatusOK, tickets)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		cw := csv.NewWriter(w)
+		_ = cw.Write(ticketCSVHeader)
+		for _, t := range tickets {
+			_ = cw.Write([]string{
+				strconv.FormatUint(t.ID, 10),
+				t.Plate,
+				strconv.Itoa(int(t.Road)),
+				strconv.Itoa(int(t.Mile1)),
+				strconv.Itoa(int(t.Timestamp1)),
+				strconv.Itoa(int(t.Mile2)),
+				strconv.Itoa(int(t.Timestamp2)),
+				strconv.Itoa(int(t.Speed)),
+				string(t.State),
+				strconv.Itoa(t.Attempts),
+			})
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			log.Printf("could not write admin response: %v\n", err)
+		}
+	default:
+		http.Error(w, fmt.Sprintf("unknown format %q", format), http.StatusBadRequest)
+	}
+}
+
+func (s *Server) adminRoads(w http.ResponseWriter, r *http.Request) {
+	// ledger is read first, so no road lock is held while it's locked
+	pending := make(map[uint16]int)
+	for _, t := range s.ledger.Tickets() {
+		if t.State != TicketSent {
+			pending[t.Road]++
+		}
+	}
+
+	roads := make([]adminRoad, 0)
+	for _, road := range s.roads.all() {
+		road.mu.Lock()
+		stats := adminRoad{
+			Road:         road.number,
+			Limit:        road.limit,
+			Observations: road.observations.len(),
+			Dispatchers:  len(road.dispatchers),
+			Pending:      pending[road.number],
+		}
+		for _, n := range road.cameras {
+			stats.Cameras += n
+		}
+		road.mu.Unlock()
+		roads = append(roads, stats)
+	}
+	pserver.WriteJSON(w, http.StatusOK, roads)
+}
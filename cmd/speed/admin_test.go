@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func adminRequest(s *Server, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	s.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec
+}
+
+func adminTickets(t *testing.T, s *Server, path string) []Ticket {
+	t.Helper()
+	rec := adminRequest(s, path)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("%s: got status %d, want %d\n", path, rec.Code, http.StatusOK)
+	}
+	var tickets []Ticket
+	if err := json.NewDecoder(rec.Body).Decode(&tickets); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	return tickets
+}
+
+func TestAdminTicketFilters(t *testing.T) {
+	s := NewServer()
+	for _, tk := range []Ticket{
+		testTicket("UN1X", 0, 45),
+		testTicket("RE05BKG", 86400, 86445),
+		{Plate: "UN1X", Road: 7, Timestamp1: 2 * 86400, Timestamp2: 3*86400 + 10},
+	} {
+		if _, _, err := s.ledger.Issue(tk); err != nil {
+			t.Fatalf("unexpected error: %v\n", err)
+		}
+	}
+
+	var tests = []struct {
+		path string
+		want []uint64
+	}{
+		{"/tickets", []uint64{1, 2, 3}},
+		{"/tickets?plate=UN1X", []uint64{1, 3}},
+		{"/tickets?road=123", []uint64{1, 2}},
+		{"/tickets?from=1&to=2", []uint64{2, 3}},
+		{"/tickets?from=3", []uint64{3}},
+		{"/tickets?plate=UN1X&to=0&format=json", []uint64{1}},
+		{"/tickets?plate=NOBODY", []uint64{}},
+	}
+	for _, tt := range tests {
+		got := adminTickets(t, s, tt.path)
+		ids := make([]uint64, 0)
+		for _, tk := range got {
+			ids = append(ids, tk.ID)
+		}
+		if !slices.Equal(ids, tt.want) {
+			t.Errorf("%s: got tickets %v, want %v\n", tt.path, ids, tt.want)
+		}
+	}
+
+	for _, path := range []string{"/tickets?road=x", "/tickets?from=-1", "/tickets?format=xml"} {
+		if rec := adminRequest(s, path); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want %d\n", path, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestAdminTicketsCSV(t *testing.T) {
+	s := NewServer()
+	_, _, _ = s.ledger.Issue(testTicket("UN1X", 0, 45))
+
+	rec := adminRequest(s, "/tickets?format=csv")
+	records, err := csv.NewReader(rec.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	want := [][]string{
+		ticketCSVHeader,
+		{"1", "UN1X", "123", "8", "0", "9", "45", "8000", "pending", "0"},
+	}
+	if !slices.EqualFunc(records, want, slices.Equal[[]string]) {
+		t.Errorf("got %q, want %q\n", records, want)
+	}
+}
+
+func TestAdminRoads(t *testing.T) {
+	s := NewServer()
+	cam1 := connect(s, cameraMessage(123, 8, 60))
+	defer cam1.Close()
+	cam2 := connect(s, cameraMessage(123, 9, 60), plateMessage("UN1X", 0))
+	cam3 := connect(s, cameraMessage(7, 1, 40))
+	defer cam3.Close()
+
+	// second camera sees plate again 45 seconds later, 80 mph is over the limit
+	_, _ = cam1.Write(plateMessage("UN1X", 45))
+
+	want := []adminRoad{
+		{Road: 7, Limit: 40, Cameras: 1},
+		{Road: 123, Limit: 60, Cameras: 2, Observations: 2, Pending: 1},
+	}
+	var got []adminRoad
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		got = nil
+		_ = json.NewDecoder(adminRequest(s, "/roads").Body).Decode(&got)
+		if len(got) == 2 && got[0] == want[0] && got[1] == want[1] {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("got %+v, want %+v\n", got, want)
+	}
+
+	// disconnected camera is not counted anymore
+	cam2.Close()
+	deadline = time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		got = nil
+		_ = json.NewDecoder(adminRequest(s, "/roads").Body).Decode(&got)
+		if len(got) == 2 && got[1].Cameras == 1 {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Errorf("got %+v, want one camera on road 123\n", got)
+}
+
+// TestAdminConcurrentQueries is meant to be run with -race
+func TestAdminConcurrentQueries(t *testing.T) {
+	s := NewServer()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := range uint32(500) {
+			s.addCamera(uint16(i%5), 0, 60)
+			s.addMeasurement(uint16(i%5), 0, i*86400, "UN1X")
+			s.addMeasurement(uint16(i%5), 10, i*86400+60, "UN1X")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for range 100 {
+			adminRequest(s, "/roads")
+			adminRequest(s, "/tickets?plate=UN1X&format=csv")
+		}
+	}()
+	wg.Wait()
+
+	if got := adminTickets(t, s, "/tickets?plate=UN1X"); len(got) != 500 {
+		t.Errorf("got %d tickets, want 500\n", len(got))
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bean/cmd/speedsim/sim"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestConcurrentCameras runs many cameras on many roads at once, it's meant
+// to be run with -race
+func TestConcurrentCameras(t *testing.T) {
+	var specs []string
+	for road := range 20 {
+		specs = append(specs, fmt.Sprintf("%d:%d:0,5,10,20,40", road, 40+road))
+	}
+	roads, _ := sim.ParseRoads(strings.Join(specs, ";"))
+	scenario := sim.Generate(sim.Config{
+		Roads:    roads,
+		Cars:     300,
+		Days:     2,
+		Seed:     2,
+		Speeders: 0.3,
+		Late:     0.05,
+	})
+
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	tickets, err := sim.Run(startServer(t, NewServer()), scenario, sim.Options{
+		Dispatchers: 4,
+		LateDelay:   20 * time.Millisecond,
+		Settle:      500 * time.Millisecond,
+		Timeout:     20 * time.Second,
+		Concurrent:  true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	for _, p := range sim.Verify(scenario, tickets) {
+		t.Error(p)
+	}
+}
+
+// BenchmarkObservations measures observations per second processed by
+// addMeasurement from many cameras at once
+func BenchmarkObservations(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	s := NewServer()
+	const roads = 256
+	for road := range uint16(roads) {
+		s.addCamera(road, 0, 60)
+	}
+	var camera atomic.Uint32
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		id := camera.Add(1)
+		road := uint16(id % roads)
+		i := uint32(0)
+		for pb.Next() {
+			// every plate is seen by two cameras, a fifth of cars is speeding
+			plate := fmt.Sprintf("P%d-%d", id, i/2)
+			mile, ts := uint16(0), (i/2)*1000
+			if i%2 == 1 {
+				mile, ts = 10, ts+600
+				if i%10 == 1 {
+					ts -= 300
+				}
+			}
+			s.addMeasurement(road, mile, ts, plate)
+			i++
+		}
+	})
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "obs/s")
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"log"
+	"slices"
+	"sync"
+)
+
+// Dispatcher owns queue of tickets waiting to be written to its connection.
+// Queue is unbounded, so road never blocks on slow dispatcher
+type Dispatcher struct {
+	roads []uint16
+	w     *connWriter
+
+	queue  []Ticket
+	wake   chan struct{}
+	done   chan struct{}
+	closed bool
+
+	mu sync.Mutex
+}
+
+func newDispatcher(roads []uint16, w *connWriter) *Dispatcher {
+	return &Dispatcher{
+		roads: roads,
+		w:     w,
+		wake:  make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+}
+
+func (d *Dispatcher) enqueue(t Ticket) {
+	d.mu.Lock()
+	d.queue = append(d.queue, t)
+	d.mu.Unlock()
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (d *Dispatcher) load() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.queue)
+}
+
+func (d *Dispatcher) pop() (Ticket, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.queue) == 0 {
+		return Ticket{}, false
+	}
+	t := d.queue[0]
+	d.queue = d.queue[1:]
+	return t, true
+}
+
+// close stops writer and returns tickets it did not start writing, only first call does it
+func (d *Dispatcher) close() ([]Ticket, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil, false
+	}
+	d.closed = true
+	close(d.done)
+	queued := d.queue
+	d.queue = nil
+	return queued, true
+}
+
+func (s *Server) addDispatcher(roads []uint16, w *connWriter) *Dispatcher {
+	log.Printf("adding new dispatcher on roads %v\n", roads)
+	d := newDispatcher(roads, w)
+	for _, rn := range roads {
+		r := s.road(rn)
+		r.mu.Lock()
+		r.dispatchers = append(r.dispatchers, d)
+		// tickets issued before any dispatcher connected, or left by dead one
+		s.dispatch(r)
+		r.mu.Unlock()
+	}
+	go s.deliverTickets(d)
+	return d
+}
+
+// removeDispatcher unregisters dispatcher from its roads and hands tickets
+// queued for it to the remaining ones, it's safe to call it more than once
+func (s *Server) removeDispatcher(d *Dispatcher) {
+	for _, rn := range d.roads {
+		r := s.road(rn)
+		r.mu.Lock()
+		r.dispatchers = slices.DeleteFunc(r.dispatchers, func(o *Dispatcher) bool { return o == d })
+		r.mu.Unlock()
+	}
+
+	queued, ok := d.close()
+	if !ok {
+		return
+	}
+	log.Printf("dispatcher for roads %v left, redistributing %d tickets\n", d.roads, len(queued))
+	for _, t := range queued {
+		s.ledger.Release(t.ID)
+	}
+	for _, rn := range d.roads {
+		s.dispatchRoad(rn)
+	}
+}
+
+// dispatchRoad hands undelivered tickets of road to its dispatchers
+func (s *Server) dispatchRoad(number uint16) {
+	r := s.road(number)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s.dispatch(r)
+}
+
+// dispatch queues every unclaimed ticket of road to least loaded dispatcher,
+// ties are broken round-robin. It must be called with r.mu held
+func (s *Server) dispatch(r *Road) {
+	if len(r.dispatchers) == 0 {
+		return
+	}
+	for _, t := range s.ledger.Claim(r.number) {
+		var best *Dispatcher
+		bestLoad := 0
+		for i := range r.dispatchers {
+			d := r.dispatchers[(r.next+i)%len(r.dispatchers)]
+			if load := d.load(); best == nil || load < bestLoad {
+				best, bestLoad = d, load
+			}
+		}
+		r.next = (r.next + 1) % len(r.dispatchers)
+		best.enqueue(t)
+	}
+}
+
+// deliverTickets writes queued tickets and records the outcome in ledger.
+// When write fails the ticket is marked failed and dispatcher is removed,
+// so the ticket and everything queued after it go to other dispatchers
+func (s *Server) deliverTickets(d *Dispatcher) {
+	for {
+		t, ok := d.pop()
+		if !ok {
+			select {
+			case <-d.wake:
+				continue
+			case <-d.done:
+				return
+			}
+		}
+		if err := d.w.send(t.Message()); err != nil {
+			log.Printf("error when writing to dispatcher: %v\n", err)
+			if err := s.ledger.MarkFailed(t.ID); err != nil {
+				log.Printf("could not mark ticket %d as failed: %v\n", t.ID, err)
+			}
+			s.removeDispatcher(d)
+			// removal may have already happened when connection was closed
+			s.dispatchRoad(t.Road)
+			return
+		}
+		if err := s.ledger.MarkSent(t.ID); err != nil {
+			log.Printf("could not mark ticket %d as sent: %v\n", t.ID, err)
+		}
+	}
+}
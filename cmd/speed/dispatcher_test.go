@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bean/cmd/speed/protocol"
+	"io"
+	"testing"
+	"time"
+)
+
+// idleDispatchers registers dispatchers without writers, so their queues can be inspected
+func idleDispatchers(s *Server, road uint16, n int) (*Road, []*Dispatcher) {
+	r := s.road(road)
+	var ds []*Dispatcher
+	for range n {
+		d := newDispatcher([]uint16{road}, nil)
+		r.dispatchers = append(r.dispatchers, d)
+		ds = append(ds, d)
+	}
+	return r, ds
+}
+
+func issue(t *testing.T, s *Server, plates ...string) {
+	t.Helper()
+	for _, p := range plates {
+		if _, ok, err := s.ledger.Issue(testTicket(p, 0, 45)); !ok || err != nil {
+			t.Fatalf("could not issue ticket for %s: %v\n", p, err)
+		}
+	}
+}
+
+func TestDispatchRoundRobin(t *testing.T) {
+	s := NewServer()
+	r, ds := idleDispatchers(s, 123, 2)
+
+	issue(t, s, "A", "B", "C", "D")
+	s.dispatchRoad(123)
+
+	for i, d := range ds {
+		if d.load() != 2 {
+			t.Errorf("dispatcher %d got %d tickets, want 2\n", i, d.load())
+		}
+	}
+	if len(s.ledger.Claim(r.number)) != 0 {
+		t.Errorf("dispatched tickets should stay claimed\n")
+	}
+}
+
+func TestDispatchLeastLoaded(t *testing.T) {
+	s := NewServer()
+	_, ds := idleDispatchers(s, 123, 2)
+	for range 3 {
+		ds[0].enqueue(Ticket{})
+	}
+
+	issue(t, s, "A", "B", "C", "D")
+	s.dispatchRoad(123)
+
+	// idle dispatcher catches up first, then they take turns
+	if ds[0].load() != 3 || ds[1].load() != 4 {
+		t.Errorf("got loads %d and %d, want 3 and 4\n", ds[0].load(), ds[1].load())
+	}
+}
+
+func TestRemoveDispatcherRedistributes(t *testing.T) {
+	s := NewServer()
+	r, ds := idleDispatchers(s, 123, 2)
+
+	issue(t, s, "A", "B", "C", "D")
+	s.dispatchRoad(123)
+	s.removeDispatcher(ds[0])
+
+	if len(r.dispatchers) != 1 || r.dispatchers[0] != ds[1] {
+		t.Errorf("dispatcher not unregistered\n")
+	}
+	if ds[1].load() != 4 {
+		t.Errorf("got %d tickets, want all 4 on remaining dispatcher\n", ds[1].load())
+	}
+	select {
+	case <-ds[0].done:
+	default:
+		t.Errorf("removed dispatcher not stopped\n")
+	}
+	// second removal, for example from both writer and connection handler, is no-op
+	s.removeDispatcher(ds[0])
+	if ds[1].load() != 4 {
+		t.Errorf("got %d tickets after second removal, want 4\n", ds[1].load())
+	}
+}
+
+func TestTicketsGoToLiveDispatcher(t *testing.T) {
+	s := NewServer()
+	cam1 := connect(s, cameraMessage(123, 8, 60))
+	defer cam1.Close()
+	cam2 := connect(s, cameraMessage(123, 9, 60))
+	defer cam2.Close()
+
+	gone := connect(s, dispatcherMessage(123, 7))
+	live := connect(s, dispatcherMessage(123))
+	defer live.Close()
+	_ = gone.Close()
+
+	r := s.road(123)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		r.mu.Lock()
+		n := len(r.dispatchers)
+		r.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("disconnected dispatcher still registered\n")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	plates := []string{"AA11", "BB22", "CC33"}
+	for i, p := range plates {
+		_, _ = cam1.Write(plateMessage(p, uint32(i*86400)))
+		_, _ = cam2.Write(plateMessage(p, uint32(i*86400+45)))
+	}
+
+	_ = live.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for _, p := range plates {
+		want, _ := protocol.Marshal(testTicket(p, 0, 45).Message())
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(live, got); err != nil {
+			t.Fatalf("unexpected error: %v\n", err)
+		}
+		if string(got[2:2+len(p)]) != p {
+			t.Errorf("got ticket for %q, want %q\n", got[2:2+len(p)], p)
+		}
+	}
+}
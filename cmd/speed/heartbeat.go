@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bean/cmd/speed/protocol"
+	"log"
+	"sync"
+	"time"
+)
+
+// wheelSlots is number of ticks wheel covers in one revolution, longer
+// intervals wait for more revolutions
+const wheelSlots = 512
+
+// heartbeat is single client which asked for heartbeats
+type heartbeat struct {
+	w *connWriter
+	// interval in wheel ticks, always positive
+	interval uint32
+	slot     int
+	// rounds is how many revolutions remain before it's due
+	rounds uint32
+}
+
+// heartbeatWheel sends heartbeats of all clients from single goroutine. It
+// runs only while some client wants heartbeats. Each due heartbeat is written
+// by short-lived goroutine, so slow client delays nobody else
+type heartbeatWheel struct {
+	tick    time.Duration
+	slots   [wheelSlots]map[*heartbeat]struct{}
+	cursor  int
+	count   int
+	running bool
+
+	mu sync.Mutex
+}
+
+func newHeartbeatWheel(tick time.Duration) *heartbeatWheel {
+	hw := &heartbeatWheel{tick: tick}
+	for i := range hw.slots {
+		hw.slots[i] = make(map[*heartbeat]struct{})
+	}
+	return hw
+}
+
+// add schedules heartbeat every interval ticks until it's removed,
+// zero interval means no heartbeats and returns nil
+func (hw *heartbeatWheel) add(w *connWriter, interval uint32) *heartbeat {
+	if interval == 0 {
+		return nil
+	}
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+
+	h := &heartbeat{w: w, interval: interval}
+	hw.schedule(h)
+	hw.count++
+	if !hw.running {
+		hw.running = true
+		go hw.run()
+	}
+	return h
+}
+
+// remove stops heartbeats, it accepts nil and heartbeat removed before
+func (hw *heartbeatWheel) remove(h *heartbeat) {
+	if h == nil {
+		return
+	}
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+	if _, ok := hw.slots[h.slot][h]; ok {
+		delete(hw.slots[h.slot], h)
+		hw.count--
+	}
+}
+
+// schedule puts heartbeat interval ticks after cursor, it must be called with mutex held
+func (hw *heartbeatWheel) schedule(h *heartbeat) {
+	h.slot = (hw.cursor + int(h.interval%wheelSlots)) % wheelSlots
+	h.rounds = (h.interval - 1) / wheelSlots
+	hw.slots[h.slot][h] = struct{}{}
+}
+
+func (hw *heartbeatWheel) run() {
+	ticker := time.NewTicker(hw.tick)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !hw.advance() {
+			return
+		}
+	}
+}
+
+// advance moves cursor by one tick and fires due heartbeats. It returns
+// false and stops the wheel when nobody wants heartbeats anymore
+func (hw *heartbeatWheel) advance() bool {
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+	if hw.count == 0 {
+		hw.running = false
+		return false
+	}
+
+	hw.cursor = (hw.cursor + 1) % wheelSlots
+	slot := hw.slots[hw.cursor]
+	var due []*heartbeat
+	for h := range slot {
+		if h.rounds > 0 {
+			h.rounds--
+			continue
+		}
+		due = append(due, h)
+	}
+	for _, h := range due {
+		delete(slot, h)
+		hw.schedule(h)
+		if h.w.beating.CompareAndSwap(false, true) {
+			go beat(h.w)
+		}
+	}
+	return true
+}
+
+func beat(w *connWriter) {
+	defer w.beating.Store(false)
+	if err := w.send(protocol.Heartbeat{}); err != nil {
+		log.Printf("error sending hb: %v\n", err)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bean/cmd/speed/protocol"
+	"testing"
+	"time"
+)
+
+// frameWriter passes every written frame to channel
+type frameWriter chan []byte
+
+func (f frameWriter) Write(b []byte) (int, error) {
+	f <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func TestHeartbeatWheel(t *testing.T) {
+	// wheel is advanced by hand, its own ticker never fires
+	hw := newHeartbeatWheel(time.Hour)
+	frames := make(frameWriter, 16)
+	w := &connWriter{enc: protocol.NewEncoder(frames)}
+	slowFrames := make(frameWriter, 16)
+	slow := &connWriter{enc: protocol.NewEncoder(slowFrames)}
+
+	if hb := hw.add(w, 0); hb != nil {
+		t.Errorf("zero interval scheduled heartbeat\n")
+	}
+	hb := hw.add(w, 3)
+	hw.add(slow, wheelSlots+2)
+
+	expect := func(frames frameWriter, tick int, want bool) {
+		t.Helper()
+		select {
+		case <-frames:
+			if !want {
+				t.Errorf("tick %d: unexpected heartbeat\n", tick)
+			}
+		case <-time.After(20 * time.Millisecond):
+			if want {
+				t.Errorf("tick %d: missing heartbeat\n", tick)
+			}
+		}
+	}
+	for tick := 1; tick <= wheelSlots+4; tick++ {
+		hw.advance()
+		if tick <= 9 {
+			expect(frames, tick, tick%3 == 0)
+		}
+		if tick == wheelSlots+2 || tick == 3 {
+			expect(slowFrames, tick, tick == wheelSlots+2)
+		}
+		for w.beating.Load() || slow.beating.Load() {
+			time.Sleep(time.Millisecond)
+		}
+		if tick == 9 {
+			hw.remove(hb)
+			hw.remove(hb)
+		}
+	}
+	if len(frames) != 0 {
+		t.Errorf("got %d heartbeats after removal\n", len(frames))
+	}
+}
+
+func wantHeartbeatMessage(interval uint32) []byte {
+	b, _ := protocol.Marshal(protocol.WantHeartbeat{Interval: interval})
+	return b
+}
+
+func TestHeartbeatsStopOnDisconnect(t *testing.T) {
+	s := NewServer()
+	client := connect(s, wantHeartbeatMessage(1))
+	_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	dec := protocol.NewDecoder(client)
+	for range 3 {
+		msg, err := dec.Decode()
+		if err != nil {
+			t.Fatalf("unexpected error: %v\n", err)
+		}
+		if _, ok := msg.(protocol.Heartbeat); !ok {
+			t.Fatalf("got %s, want heartbeat\n", msg.Type())
+		}
+	}
+	client.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		s.heartbeats.mu.Lock()
+		count, running := s.heartbeats.count, s.heartbeats.running
+		s.heartbeats.mu.Unlock()
+		if count == 0 && !running {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("heartbeats still scheduled after disconnect\n")
+}
+
+// TestHeartbeatsDoNotSplitTickets sends many tickets to dispatcher which gets
+// heartbeats every tick, every byte it reads must belong to whole frame
+func TestHeartbeatsDoNotSplitTickets(t *testing.T) {
+	s := NewServer()
+	dispatcher := connect(s, wantHeartbeatMessage(1), dispatcherMessage(123))
+	defer dispatcher.Close()
+	_ = dispatcher.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	const tickets = 200
+	for i := range uint32(tickets) {
+		s.addMeasurement(123, 0, i*86400, "UN1X")
+		s.addMeasurement(123, 10, i*86400+60, "UN1X")
+	}
+
+	dec := protocol.NewDecoder(dispatcher)
+	got, heartbeats := 0, 0
+	for got < tickets || heartbeats == 0 {
+		msg, err := dec.Decode()
+		if err != nil {
+			t.Fatalf("after %d tickets: %v\n", got, err)
+		}
+		switch m := msg.(type) {
+		case protocol.Ticket:
+			if m.Plate != "UN1X" || m.Speed != 60000 {
+				t.Fatalf("got corrupted ticket %+v\n", m)
+			}
+			got++
+		case protocol.Heartbeat:
+			heartbeats++
+		default:
+			t.Fatalf("got unexpected %s\n", msg.Type())
+		}
+	}
+	if got != tickets {
+		t.Errorf("got %d tickets, want %d\n", got, tickets)
+	}
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bean/cmd/speed/protocol"
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+type TicketState string
+
+const (
+	// TicketPending is issued ticket that was not yet written to any dispatcher
+	TicketPending TicketState = "pending"
+	// TicketSent was fully written to dispatcher connection
+	TicketSent TicketState = "sent"
+	// TicketFailed was being written when dispatcher connection died,
+	// it's delivered again just like pending one
+	TicketFailed TicketState = "failed"
+)
+
+// Ticket for single plate, Speed is in hundredths of mph like in the protocol
+type Ticket struct {
+	ID         uint64      `json:"id"`
+	Plate      string      `json:"plate"`
+	Road       uint16      `json:"road"`
+	Mile1      uint16      `json:"mile1"`
+	Timestamp1 uint32      `json:"timestamp1"`
+	Mile2      uint16      `json:"mile2"`
+	Timestamp2 uint32      `json:"timestamp2"`
+	Speed      uint16      `json:"speed"`
+	State      TicketState `json:"state"`
+	Attempts   int         `json:"attempts,omitempty"`
+}
+
+func (t Ticket) Message() protocol.Ticket {
+	return protocol.Ticket{
+		Plate:      t.Plate,
+		Road:       t.Road,
+		Mile1:      t.Mile1,
+		Timestamp1: t.Timestamp1,
+		Mile2:      t.Mile2,
+		Timestamp2: t.Timestamp2,
+		Speed:      t.Speed,
+	}
+}
+
+// Days returns every day ticket covers, plate can get only one ticket per day
+func (t Ticket) Days() []uint32 {
+	var days []uint32
+	for d := t.Timestamp1 / 86400; d <= t.Timestamp2/86400; d++ {
+		days = append(days, d)
+	}
+	return days
+}
+
+// ledgerRecord is single line of ledger file, either whole ticket or change of its state
+type ledgerRecord struct {
+	Ticket *Ticket     `json:"ticket,omitempty"`
+	ID     uint64      `json:"id,omitempty"`
+	State  TicketState `json:"state,omitempty"`
+}
+
+// Ledger owns all issued tickets and remembers which plate was ticketed on which day.
+// Ticket is persisted before it's handed to dispatcher, so restart can neither
+// lose it nor issue second ticket for the same day. Delivery is at-least-once:
+// ticket written to dispatcher right before crash may be sent again
+type Ledger struct {
+	f ledgerFile
+	// size is where next record starts, failed write is cut back to it
+	size int64
+	// failed is set when torn record could not be cut off, every later write
+	// is refused so it does not end up in the middle of ledger
+	failed  error
+	tickets map[uint64]*Ticket
+	days    map[string]map[uint32]struct{}
+	// claimed tickets are queued for live dispatcher, this is not persisted
+	// since after restart nothing is in flight
+	claimed map[uint64]struct{}
+	// waiting indexes IDs of undelivered tickets nobody claimed by road, so
+	// claiming does not scan all tickets ever issued
+	waiting map[uint16]map[uint64]struct{}
+	nextID  uint64
+
+	mu sync.Mutex
+}
+
+// ledgerFile is ledger opened for appending, *os.File
+type ledgerFile interface {
+	io.WriteCloser
+	Sync() error
+	Truncate(size int64) error
+}
+
+// NewMemoryLedger keeps tickets only until the process exits
+func NewMemoryLedger() *Ledger {
+	return &Ledger{
+		tickets: make(map[uint64]*Ticket),
+		days:    make(map[string]map[uint32]struct{}),
+		claimed: make(map[uint64]struct{}),
+		waiting: make(map[uint16]map[uint64]struct{}),
+		nextID:  1,
+	}
+}
+
+// OpenLedger loads ledger from path, compacts it and appends further changes to it.
+// Incomplete last line left by crash is ignored
+func OpenLedger(path string) (*Ledger, error) {
+	l := NewMemoryLedger()
+	if err := l.load(path); err != nil {
+		return nil, err
+	}
+	if err := l.compact(path); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open ledger: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("stat ledger: %w", err)
+	}
+	l.f = f
+	l.size = info.Size()
+	return l, nil
+}
+
+func (l *Ledger) load(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read ledger: %w", err)
+	}
+	lines := bytes.Split(data, []byte("\n"))
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		var rec ledgerRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			if i == len(lines)-1 {
+				log.Printf("ignoring torn last record of ledger: %q\n", line)
+				return nil
+			}
+			return fmt.Errorf("ledger %s line %d: %w", path, i+1, err)
+		}
+		l.apply(rec)
+	}
+	return nil
+}
+
+func (l *Ledger) apply(rec ledgerRecord) {
+	if rec.Ticket != nil {
+		t := *rec.Ticket
+		l.tickets[t.ID] = &t
+		l.markDays(t)
+		l.nextID = max(l.nextID, t.ID+1)
+		l.requeue(&t)
+		return
+	}
+	if t, ok := l.tickets[rec.ID]; ok {
+		t.State = rec.State
+		if rec.State == TicketFailed {
+			t.Attempts++
+		}
+		l.requeue(t)
+	}
+}
+
+// compact replaces ledger with one record per ticket, written to temporary
+// file first so crash leaves either old or new ledger
+func (l *Ledger) compact(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".ledger-*")
+	if err != nil {
+		return fmt.Errorf("compact ledger: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	bw := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(bw)
+	for _, t := range l.sorted(nil) {
+		if err := enc.Encode(ledgerRecord{Ticket: &t}); err != nil {
+			tmp.Close()
+			return fmt.Errorf("compact ledger: %w", err)
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("compact ledger: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("sync ledger: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close ledger: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("rename ledger: %w", err)
+	}
+	return nil
+}
+
+// append persists record, it must be called with mutex held. Record which
+// failed to be written or synced is cut off, so it's neither replayed nor
+// followed by other records
+func (l *Ledger) append(rec ledgerRecord) error {
+	if l.f == nil {
+		return nil
+	}
+	if l.failed != nil {
+		return l.failed
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line := append(data, '\n')
+	if _, err := l.f.Write(line); err != nil {
+		l.cut()
+		return fmt.Errorf("write ledger: %w", err)
+	}
+	if err := l.f.Sync(); err != nil {
+		l.cut()
+		return fmt.Errorf("sync ledger: %w", err)
+	}
+	l.size += int64(len(line))
+	return nil
+}
+
+// cut removes whatever part of failed record made it to the file
+func (l *Ledger) cut() {
+	if err := l.f.Truncate(l.size); err != nil {
+		l.failed = fmt.Errorf("ledger has torn record: %w", err)
+	}
+}
+
+func (l *Ledger) markDays(t Ticket) {
+	days, ok := l.days[t.Plate]
+	if !ok {
+		days = make(map[uint32]struct{})
+		l.days[t.Plate] = days
+	}
+	for _, d := range t.Days() {
+		days[d] = struct{}{}
+	}
+}
+
+// Issue records new pending ticket unless plate was already ticketed on any
+// of the days it covers. Returned ticket has ID assigned
+func (l *Ledger) Issue(t Ticket) (Ticket, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, d := range t.Days() {
+		if _, ok := l.days[t.Plate][d]; ok {
+			return Ticket{}, false, nil
+		}
+	}
+	t.ID = l.nextID
+	t.State = TicketPending
+	t.Attempts = 0
+	if err := l.append(ledgerRecord{Ticket: &t}); err != nil {
+		return Ticket{}, false, err
+	}
+	l.nextID++
+	l.tickets[t.ID] = &t
+	l.markDays(t)
+	l.requeue(&t)
+	return t, true, nil
+}
+
+// requeue puts ticket into waiting index unless it was delivered or is
+// claimed, otherwise it's removed from there
+func (l *Ledger) requeue(t *Ticket) {
+	ids := l.waiting[t.Road]
+	if _, claimed := l.claimed[t.ID]; claimed || t.State == TicketSent {
+		delete(ids, t.ID)
+		return
+	}
+	if ids == nil {
+		ids = make(map[uint64]struct{})
+		l.waiting[t.Road] = ids
+	}
+	ids[t.ID] = struct{}{}
+}
+
+// Claim returns undelivered tickets for road which are not queued for any
+// dispatcher yet ordered by ID, caller has to report result of delivery for
+// each of them
+func (l *Ledger) Claim(road uint16) []Ticket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ids := l.waiting[road]
+	if len(ids) == 0 {
+		return nil
+	}
+	delete(l.waiting, road)
+	tickets := make([]Ticket, 0, len(ids))
+	for _, id := range slices.Sorted(maps.Keys(ids)) {
+		l.claimed[id] = struct{}{}
+		tickets = append(tickets, *l.tickets[id])
+	}
+	return tickets
+}
+
+// Release returns claimed ticket which was not written at all, its state is unchanged
+func (l *Ledger) Release(id uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.claimed, id)
+	if t, ok := l.tickets[id]; ok {
+		l.requeue(t)
+	}
+}
+
+// MarkSent records that ticket was written to dispatcher
+func (l *Ledger) MarkSent(id uint64) error {
+	return l.setState(id, TicketSent)
+}
+
+// MarkFailed releases ticket, so it's claimed again by the next dispatcher
+func (l *Ledger) MarkFailed(id uint64) error {
+	return l.setState(id, TicketFailed)
+}
+
+func (l *Ledger) setState(id uint64, state TicketState) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.claimed, id)
+	t, ok := l.tickets[id]
+	if !ok {
+		return fmt.Errorf("unknown ticket %d", id)
+	}
+	defer l.requeue(t)
+	if err := l.append(ledgerRecord{ID: id, State: state}); err != nil {
+		return err
+	}
+	t.State = state
+	if state == TicketFailed {
+		t.Attempts++
+	}
+	return nil
+}
+
+// Tickets returns copy of all tickets ordered by ID
+func (l *Ledger) Tickets() []Ticket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.sorted(nil)
+}
+
+// TicketFilter selects tickets, zero value matches all of them
+type TicketFilter struct {
+	Plate string
+	Road  *uint16
+	// FromDay and ToDay limit days ticket covers, both are inclusive
+	FromDay *uint32
+	ToDay   *uint32
+}
+
+func (f TicketFilter) match(t *Ticket) bool {
+	if f.Plate != "" && t.Plate != f.Plate {
+		return false
+	}
+	if f.Road != nil && t.Road != *f.Road {
+		return false
+	}
+	if f.FromDay != nil && t.Timestamp2/86400 < *f.FromDay {
+		return false
+	}
+	if f.ToDay != nil && t.Timestamp1/86400 > *f.ToDay {
+		return false
+	}
+	return true
+}
+
+// Find returns copy of tickets matching filter ordered by ID
+func (l *Ledger) Find(f TicketFilter) []Ticket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.sorted(f.match)
+}
+
+// sorted returns copies of tickets matching filter ordered by ID, nil filter matches all
+func (l *Ledger) sorted(filter func(t *Ticket) bool) []Ticket {
+	tickets := make([]Ticket, 0)
+	for _, t := range l.tickets {
+		if filter == nil || filter(t) {
+			tickets = append(tickets, *t)
+		}
+	}
+	slices.SortFunc(tickets, func(a, b Ticket) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return tickets
+}
+
+func (l *Ledger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	return l.f.Close()
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bean/cmd/speed/protocol"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testTicket(plate string, ts1, ts2 uint32) Ticket {
+	return Ticket{Plate: plate, Road: 123, Mile1: 8, Timestamp1: ts1, Mile2: 9, Timestamp2: ts2, Speed: 8000}
+}
+
+func TestLedgerOneTicketPerDay(t *testing.T) {
+	l := NewMemoryLedger()
+
+	var tests = []struct {
+		ticket Ticket
+		want   bool
+	}{
+		{testTicket("UN1X", 0, 45), true},
+		{testTicket("UN1X", 1000, 2000), false},
+		{testTicket("RE05BKG", 1000, 2000), true},
+		// spans day 1 and 2, day 2 is then taken
+		{testTicket("UN1X", 86400+80000, 2*86400+100), true},
+		{testTicket("UN1X", 2*86400+5000, 2*86400+6000), false},
+		{testTicket("UN1X", 3*86400, 3*86400+60), true},
+	}
+	for i, tt := range tests {
+		_, ok, err := l.Issue(tt.ticket)
+		if err != nil {
+			t.Fatalf("unexpected error: %v\n", err)
+		}
+		if ok != tt.want {
+			t.Errorf("ticket %d: got %t, want %t\n", i, ok, tt.want)
+		}
+	}
+}
+
+func TestLedgerRequeueFailed(t *testing.T) {
+	l := NewMemoryLedger()
+	issued, _, _ := l.Issue(testTicket("UN1X", 0, 45))
+	_, _, _ = l.Issue(Ticket{Plate: "OTHER", Road: 7})
+
+	claimed := l.Claim(123)
+	if len(claimed) != 1 || claimed[0].ID != issued.ID {
+		t.Fatalf("got %+v, want ticket %d\n", claimed, issued.ID)
+	}
+	if again := l.Claim(123); len(again) != 0 {
+		t.Errorf("ticket claimed twice: %+v\n", again)
+	}
+
+	_ = l.MarkFailed(issued.ID)
+	claimed = l.Claim(123)
+	if len(claimed) != 1 || claimed[0].State != TicketFailed || claimed[0].Attempts != 1 {
+		t.Errorf("failed ticket not requeued: %+v\n", claimed)
+	}
+
+	_ = l.MarkSent(issued.ID)
+	if again := l.Claim(123); len(again) != 0 {
+		t.Errorf("sent ticket claimed again: %+v\n", again)
+	}
+}
+
+func TestLedgerReleaseRequeues(t *testing.T) {
+	l := NewMemoryLedger()
+	first, _, _ := l.Issue(testTicket("UN1X", 0, 45))
+	second, _, _ := l.Issue(testTicket("RE05BKG", 0, 45))
+
+	if claimed := l.Claim(123); len(claimed) != 2 {
+		t.Fatalf("got %+v, want both tickets\n", claimed)
+	}
+	l.Release(second.ID)
+	l.Release(first.ID)
+	claimed := l.Claim(123)
+	if len(claimed) != 2 || claimed[0].ID != first.ID || claimed[1].ID != second.ID {
+		t.Errorf("got %+v, want released tickets ordered by ID\n", claimed)
+	}
+	if other := l.Claim(7); len(other) != 0 {
+		t.Errorf("got tickets of other road: %+v\n", other)
+	}
+}
+
+// shortWriter writes only part of the next record and fails, like full disk
+type shortWriter struct {
+	ledgerFile
+	fail bool
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if !w.fail {
+		return w.ledgerFile.Write(p)
+	}
+	w.fail = false
+	n, _ := w.ledgerFile.Write(p[:len(p)/2])
+	return n, errors.New("no space left on device")
+}
+
+func TestLedgerFailedAppendIsCutOff(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tickets.jsonl")
+	l, err := OpenLedger(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	w := &shortWriter{ledgerFile: l.f}
+	l.f = w
+	_, _, _ = l.Issue(testTicket("UN1X", 0, 45))
+	w.fail = true
+	if _, _, err := l.Issue(testTicket("RE05BKG", 0, 45)); err == nil {
+		t.Fatalf("write to full disk succeeded\n")
+	}
+	_, _, _ = l.Issue(testTicket("SP33D", 0, 45))
+	_ = l.Close()
+
+	l, err = OpenLedger(path)
+	if err != nil {
+		t.Fatalf("torn record broke ledger: %v\n", err)
+	}
+	defer l.Close()
+	var plates []string
+	for _, tk := range l.Tickets() {
+		plates = append(plates, tk.Plate)
+	}
+	if strings.Join(plates, ",") != "UN1X,SP33D" {
+		t.Errorf("got tickets %v, want UN1X and SP33D\n", plates)
+	}
+}
+
+func TestLedgerSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tickets.jsonl")
+	l, err := OpenLedger(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	sent, _, _ := l.Issue(testTicket("UN1X", 0, 45))
+	failed, _, _ := l.Issue(testTicket("RE05BKG", 0, 45))
+	pending, _, _ := l.Issue(testTicket("SP33D", 0, 45))
+	l.Claim(123)
+	_ = l.MarkSent(sent.ID)
+	_ = l.MarkFailed(failed.ID)
+	_ = l.Close()
+
+	// crash in the middle of appending
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	_, _ = f.WriteString(`{"id":3,"sta`)
+	_ = f.Close()
+
+	l, err = OpenLedger(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	defer l.Close()
+
+	claimed := l.Claim(123)
+	if len(claimed) != 2 || claimed[0].ID != failed.ID || claimed[1].ID != pending.ID {
+		t.Errorf("got %+v, want failed and pending tickets\n", claimed)
+	}
+	if _, ok, _ := l.Issue(testTicket("UN1X", 3000, 3100)); ok {
+		t.Errorf("plate ticketed twice on the same day after restart\n")
+	}
+	next, ok, _ := l.Issue(testTicket("NEW", 0, 45))
+	if !ok || next.ID != 4 {
+		t.Errorf("got ticket %d (%t), want 4\n", next.ID, ok)
+	}
+}
+
+func cameraMessage(road, mile, limit uint16) []byte {
+	return binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(
+		binary.BigEndian.AppendUint16([]byte{0x80}, road), mile), limit)
+}
+
+func plateMessage(plate string, ts uint32) []byte {
+	return binary.BigEndian.AppendUint32(append([]byte{0x20, byte(len(plate))}, plate...), ts)
+}
+
+func dispatcherMessage(roads ...uint16) []byte {
+	msg := []byte{0x81, byte(len(roads))}
+	for _, r := range roads {
+		msg = binary.BigEndian.AppendUint16(msg, r)
+	}
+	return msg
+}
+
+func connect(s *Server, msgs ...[]byte) net.Conn {
+	serverConn, clientConn := net.Pipe()
+	go s.handleConnection(serverConn)
+	for _, m := range msgs {
+		_, _ = clientConn.Write(m)
+	}
+	return clientConn
+}
+
+func waitForState(t *testing.T, l *Ledger, id uint64, state TicketState) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, tk := range l.Tickets() {
+			if tk.ID == id && tk.State == state {
+				return
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("ticket %d did not become %s: %+v\n", id, state, l.Tickets())
+}
+
+func TestTicketRedeliveredAfterDispatcherDies(t *testing.T) {
+	s := NewServer()
+	cam1 := connect(s, cameraMessage(123, 8, 60))
+	defer cam1.Close()
+	cam2 := connect(s, cameraMessage(123, 9, 60))
+	defer cam2.Close()
+
+	dead := connect(s, dispatcherMessage(123))
+	_ = dead.Close()
+
+	_, _ = cam1.Write(plateMessage("UN1X", 0))
+	_, _ = cam2.Write(plateMessage("UN1X", 45))
+
+	alive := connect(s, dispatcherMessage(123))
+	defer alive.Close()
+	_ = alive.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	want, _ := protocol.Marshal(testTicket("UN1X", 0, 45).Message())
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(alive, got); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %x, want %x\n", got, want)
+	}
+	waitForState(t, s.ledger, 1, TicketSent)
+}
+
+func TestDispatcherGetsLargeBacklog(t *testing.T) {
+	s := NewServer()
+	cam1 := connect(s, cameraMessage(123, 8, 60))
+	defer cam1.Close()
+	cam2 := connect(s, cameraMessage(123, 9, 60))
+	defer cam2.Close()
+
+	const backlog = 25
+	for i := range backlog {
+		plate := fmt.Sprintf("P%02d", i)
+		_, _ = cam1.Write(plateMessage(plate, 0))
+		_, _ = cam2.Write(plateMessage(plate, 45))
+	}
+	waitForState(t, s.ledger, backlog, TicketPending)
+
+	d := connect(s, dispatcherMessage(123))
+	defer d.Close()
+	_ = d.SetReadDeadline(time.Now().Add(2 * time.Second))
+	// cameras race each other, so tickets may be issued in any order
+	want := map[string]bool{}
+	for i := range backlog {
+		msg, _ := protocol.Marshal(testTicket(fmt.Sprintf("P%02d", i), 0, 45).Message())
+		want[string(msg)] = true
+	}
+	for i := range backlog {
+		msg, _ := protocol.Marshal(testTicket("P00", 0, 45).Message())
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(d, got); err != nil {
+			t.Fatalf("ticket %d: unexpected error: %v\n", i, err)
+		}
+		if !want[string(got)] {
+			t.Errorf("unexpected ticket %x\n", got)
+		}
+		delete(want, string(got))
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"cmp"
+	"slices"
+)
+
+type Measurement struct {
+	timestamp uint32
+	mile      uint16
+}
+
+// sweepEvery is minimal number of observations between sweeps of whole index
+const sweepEvery = 1024
+
+// observationIndex keeps observations of every plate on single road sorted
+// by timestamp. Average speed over any span is weighted average of speeds between
+// consecutive observations, so comparing new observation with its neighbours
+// in time is enough to find speeding. It's guarded by mutex of the road
+type observationIndex struct {
+	plates map[string][]Measurement
+	// retention in seconds, observations older than newest minus retention
+	// are forgotten, 0 keeps everything
+	retention uint32
+	newest    uint32
+	// inserted counts observations since last sweep of plates not seen recently
+	inserted int
+}
+
+func newObservationIndex(retention uint32) observationIndex {
+	return observationIndex{
+		plates:    make(map[string][]Measurement),
+		retention: retention,
+	}
+}
+
+// insert adds observation and returns observations right before and after it
+// in time, or every other kept observation of the plate when all is set
+func (x *observationIndex) insert(plate string, m Measurement, all bool) []Measurement {
+	ms := x.plates[plate]
+	// after observations with the same timestamp, so equal ones keep arrival order
+	i, _ := slices.BinarySearchFunc(ms, m.timestamp, func(e Measurement, ts uint32) int {
+		if e.timestamp <= ts {
+			return -1
+		}
+		return 1
+	})
+	ms = slices.Insert(ms, i, m)
+
+	lo, hi := max(i-1, 0), min(i+2, len(ms))
+	if all {
+		lo, hi = 0, len(ms)
+	}
+	var others []Measurement
+	others = append(append(others, ms[lo:i]...), ms[i+1:hi]...)
+
+	x.newest = max(x.newest, m.timestamp)
+	x.plates[plate] = x.trim(ms)
+	if len(x.plates[plate]) == 0 {
+		delete(x.plates, plate)
+	}
+	x.inserted++
+	if x.retention > 0 && x.inserted >= max(sweepEvery, len(x.plates)) {
+		x.sweep()
+	}
+	return others
+}
+
+// trim drops expired prefix of plate observations
+func (x *observationIndex) trim(ms []Measurement) []Measurement {
+	if x.retention == 0 || x.newest < x.retention {
+		return ms
+	}
+	cutoff := x.newest - x.retention
+	i, _ := slices.BinarySearchFunc(ms, cutoff, func(e Measurement, ts uint32) int {
+		return cmp.Compare(e.timestamp, ts)
+	})
+	if i == 0 {
+		return ms
+	}
+	return slices.Clone(ms[i:])
+}
+
+// sweep trims plates that were not seen since retention started to apply to them,
+// it runs after as many inserts as there are plates, so its cost is amortized
+func (x *observationIndex) sweep() {
+	for plate, ms := range x.plates {
+		if ms = x.trim(ms); len(ms) == 0 {
+			delete(x.plates, plate)
+		} else {
+			x.plates[plate] = ms
+		}
+	}
+	x.inserted = 0
+}
+
+// len returns number of observations kept
+func (x *observationIndex) len() int {
+	n := 0
+	for _, ms := range x.plates {
+		n += len(ms)
+	}
+	return n
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestObservationIndexNeighbours(t *testing.T) {
+	x := newObservationIndex(0)
+
+	var tests = []struct {
+		m    Measurement
+		want []Measurement
+	}{
+		{Measurement{100, 1}, nil},
+		{Measurement{300, 3}, []Measurement{{100, 1}}},
+		{Measurement{200, 2}, []Measurement{{100, 1}, {300, 3}}},
+		{Measurement{50, 0}, []Measurement{{100, 1}}},
+		{Measurement{200, 9}, []Measurement{{200, 2}, {300, 3}}},
+	}
+	for _, tt := range tests {
+		if got := x.insert("UN1X", tt.m, false); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v: got neighbours %+v, want %+v\n", tt.m, got, tt.want)
+		}
+	}
+	want := []Measurement{{50, 0}, {100, 1}, {200, 2}, {200, 9}, {300, 3}}
+	if got := x.plates["UN1X"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v\n", got, want)
+	}
+}
+
+func TestObservationIndexRetention(t *testing.T) {
+	x := newObservationIndex(3600)
+
+	for i := range uint32(2000) {
+		x.insert(fmt.Sprintf("P%d", i), Measurement{timestamp: i * 10}, false)
+	}
+	// every plate older than an hour before the newest observation is gone
+	if n := x.len(); n > 360+sweepEvery {
+		t.Errorf("got %d observations kept, want at most %d\n", n, 360+sweepEvery)
+	}
+	x.sweep()
+	if n := len(x.plates); n != 361 {
+		t.Errorf("got %d plates after sweep, want 361\n", n)
+	}
+
+	// late observation is still compared with what is kept, then forgotten
+	x.insert("OLD", Measurement{timestamp: 20000}, false)
+	if got := x.insert("OLD", Measurement{timestamp: 100}, false); len(got) != 1 {
+		t.Errorf("got neighbours %+v, want one\n", got)
+	}
+	if got := x.plates["OLD"]; len(got) != 1 {
+		t.Errorf("expired observation kept: %+v\n", got)
+	}
+}
+
+func TestNeighbourComparisonOutOfOrder(t *testing.T) {
+	r := &Road{limit: 60, number: 123, observations: newObservationIndex(0)}
+
+	// 0 -> 20 in 20 minutes is 60 mph on average, but first half took 5 minutes
+	r.observe("UN1X", 0, 0)
+	if got := r.observe("UN1X", 20, 1200); len(got) != 0 {
+		t.Errorf("got tickets %+v, want none\n", got)
+	}
+	got := r.observe("UN1X", 10, 300)
+	want := []Ticket{{Plate: "UN1X", Road: 123, Mile1: 0, Timestamp1: 0, Mile2: 10, Timestamp2: 300, Speed: 12000}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v\n", got, want)
+	}
+}
+
+// BenchmarkObservationIndex inserts observations of 100k cars, each seen by
+// cameras every minute, so every plate keeps long history
+func BenchmarkObservationIndex(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	r := &Road{limit: 60, number: 1, observations: newObservationIndex(24 * 3600)}
+	plates := make([]string, 100_000)
+	for i := range plates {
+		plates[i] = fmt.Sprintf("P%d", i)
+	}
+
+	b.ResetTimer()
+	for i := range b.N {
+		p := i % len(plates)
+		round := uint32(i / len(plates))
+		r.observe(plates[p], uint16(round%1000), round*60+uint32(p%60))
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "obs/s")
+	b.ReportMetric(float64(r.observations.len()), "kept")
+}
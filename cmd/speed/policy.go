@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+)
+
+// Policy decides which average speeds on road get tickets
+type Policy struct {
+	// Tolerance is how many mph over the limit are still allowed
+	Tolerance float64 `json:"tolerance_mph"`
+	// TolerancePercent is allowed excess as percentage of the limit, it's added to Tolerance
+	TolerancePercent float64 `json:"tolerance_percent"`
+	// Section compares every two observations of plate on the road, so tickets
+	// are issued for average speed between any two cameras, not only consecutive ones
+	Section bool `json:"section"`
+}
+
+// threshold returns speed in hundredths of mph which has to be exceeded for ticket
+func (p Policy) threshold(limit uint16) uint64 {
+	return uint64(math.Round(float64(limit)*(100+p.TolerancePercent) + p.Tolerance*100))
+}
+
+// Policies assigns policy to every road, roads not listed use Default.
+// Zero value tickets any speed over the limit
+type Policies struct {
+	Default Policy            `json:"default"`
+	Roads   map[uint16]Policy `json:"roads"`
+}
+
+func (ps Policies) For(road uint16) Policy {
+	if p, ok := ps.Roads[road]; ok {
+		return p
+	}
+	return ps.Default
+}
+
+// LoadPolicies reads policies from JSON file like
+//
+//	{"default": {"tolerance_mph": 2}, "roads": {"123": {"tolerance_percent": 10, "section": true}}}
+func LoadPolicies(path string) (Policies, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Policies{}, fmt.Errorf("read policies: %w", err)
+	}
+	var ps Policies
+	if err := json.Unmarshal(data, &ps); err != nil {
+		return Policies{}, fmt.Errorf("parse policies %s: %w", path, err)
+	}
+	if err := ps.Default.validate(); err != nil {
+		return Policies{}, fmt.Errorf("default policy: %w", err)
+	}
+	for road, p := range ps.Roads {
+		if err := p.validate(); err != nil {
+			return Policies{}, fmt.Errorf("policy of road %d: %w", road, err)
+		}
+	}
+	return ps, nil
+}
+
+func (p Policy) validate() error {
+	if p.Tolerance < 0 || p.TolerancePercent < 0 {
+		return errors.New("tolerance must not be negative")
+	}
+	return nil
+}
+
+// averageSpeed returns speed between observations in hundredths of mph rounded
+// to nearest and tells if it's over threshold. Comparison uses exact distance
+// and time, so rounding never decides about ticket
+func averageSpeed(a, b Measurement, threshold uint64) (uint16, bool) {
+	timeDelta := uint64(b.timestamp - a.timestamp)
+	var distance uint64
+	if b.mile > a.mile {
+		distance = uint64(b.mile - a.mile)
+	} else {
+		distance = uint64(a.mile - b.mile)
+	}
+	scaled := distance * 3600 * 100
+	speed := (scaled + timeDelta/2) / timeDelta
+	return uint16(min(speed, math.MaxUint16)), scaled > threshold*timeDelta
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestAverageSpeedRounding(t *testing.T) {
+	var tests = []struct {
+		miles     uint16
+		seconds   uint32
+		speed     uint16
+		threshold uint64
+		over      bool
+	}{
+		{1, 45, 8000, 6000, true},
+		// 514.2857 mph
+		{1, 7, 51429, 6000, true},
+		// 327.2727 mph
+		{1, 11, 32727, 6000, true},
+		// 1.5 hundredths are rounded up
+		{1, 240000, 2, 0, true},
+		// exactly at threshold is not over it
+		{31, 1800, 6200, 6200, false},
+		{31, 1799, 6203, 6200, true},
+		{1000, 1, 65535, 6000, true},
+	}
+	for _, tt := range tests {
+		speed, over := averageSpeed(Measurement{timestamp: 100, mile: 5}, Measurement{timestamp: 100 + tt.seconds, mile: 5 + tt.miles}, tt.threshold)
+		if speed != tt.speed || over != tt.over {
+			t.Errorf("%d miles in %ds: got %d %t, want %d %t\n", tt.miles, tt.seconds, speed, over, tt.speed, tt.over)
+		}
+	}
+}
+
+func TestPolicyThreshold(t *testing.T) {
+	var tests = []struct {
+		policy Policy
+		want   uint64
+	}{
+		{Policy{}, 6000},
+		{Policy{Tolerance: 2}, 6200},
+		{Policy{TolerancePercent: 10}, 6600},
+		{Policy{Tolerance: 0.5, TolerancePercent: 2.5}, 6200},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.threshold(60); got != tt.want {
+			t.Errorf("%+v: got %d, want %d\n", tt.policy, got, tt.want)
+		}
+	}
+}
+
+func TestPolicyTolerance(t *testing.T) {
+	s := NewServerWithOptions(Options{Policies: Policies{
+		Default: Policy{Tolerance: 2},
+		Roads:   map[uint16]Policy{7: {TolerancePercent: 50}},
+	}})
+	s.addCamera(123, 0, 60)
+	s.addCamera(7, 0, 60)
+
+	// 61.02 mph is within tolerance, 62.07 mph is not
+	s.addMeasurement(123, 0, 0, "SLOW")
+	s.addMeasurement(123, 1, 59, "SLOW")
+	s.addMeasurement(123, 0, 0, "FAST")
+	s.addMeasurement(123, 1, 58, "FAST")
+	// 80 mph is within 50% over the limit
+	s.addMeasurement(7, 0, 0, "FAST")
+	s.addMeasurement(7, 1, 45, "FAST")
+
+	tickets := s.ledger.Tickets()
+	if len(tickets) != 1 || tickets[0].Plate != "FAST" || tickets[0].Road != 123 || tickets[0].Speed != 6207 {
+		t.Errorf("got %+v, want single ticket for FAST at 6207 on road 123\n", tickets)
+	}
+}
+
+func TestSectionControl(t *testing.T) {
+	observe := func(section bool) []Ticket {
+		r := &Road{limit: 60, number: 123, observations: newObservationIndex(0), policy: Policy{Section: section}}
+		var tickets []Ticket
+		// 90 mph between first two cameras, then exactly 60 mph, 72 mph on average
+		tickets = append(tickets, r.observe("UN1X", 0, 0)...)
+		tickets = append(tickets, r.observe("UN1X", 10, 400)...)
+		tickets = append(tickets, r.observe("UN1X", 20, 1000)...)
+		return tickets
+	}
+
+	first := Ticket{Plate: "UN1X", Road: 123, Mile1: 0, Timestamp1: 0, Mile2: 10, Timestamp2: 400, Speed: 9000}
+	if got, want := observe(false), []Ticket{first}; !reflect.DeepEqual(got, want) {
+		t.Errorf("consecutive: got %+v, want %+v\n", got, want)
+	}
+	whole := Ticket{Plate: "UN1X", Road: 123, Mile1: 0, Timestamp1: 0, Mile2: 20, Timestamp2: 1000, Speed: 7200}
+	if got, want := observe(true), []Ticket{first, whole}; !reflect.DeepEqual(got, want) {
+		t.Errorf("section: got %+v, want %+v\n", got, want)
+	}
+}
+
+func TestLoadPolicies(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "policies.json")
+	_ = os.WriteFile(path, []byte(`{"default": {"tolerance_mph": 2}, "roads": {"123": {"tolerance_percent": 10, "section": true}}}`), 0o644)
+
+	ps, err := LoadPolicies(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if got, want := ps.For(123), (Policy{TolerancePercent: 10, Section: true}); got != want {
+		t.Errorf("road 123: got %+v, want %+v\n", got, want)
+	}
+	if got, want := ps.For(7), (Policy{Tolerance: 2}); got != want {
+		t.Errorf("road 7: got %+v, want %+v\n", got, want)
+	}
+
+	_ = os.WriteFile(path, []byte(`{"roads": {"1": {"tolerance_mph": -1}}}`), 0o644)
+	if _, err := LoadPolicies(path); err == nil {
+		t.Errorf("negative tolerance accepted\n")
+	}
+}
@@ -0,0 +1,206 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Marshal returns message with its type byte, ready to be written at once
+func Marshal(m Message) ([]byte, error) {
+	return m.appendBody([]byte{byte(m.Type())})
+}
+
+func appendString(b []byte, s string) ([]byte, error) {
+	if len(s) > 255 {
+		return nil, ErrTooLong
+	}
+	b = append(b, byte(len(s)))
+	return append(b, s...), nil
+}
+
+func (m Error) appendBody(b []byte) ([]byte, error) {
+	return appendString(b, m.Msg)
+}
+
+func (m Plate) appendBody(b []byte) ([]byte, error) {
+	b, err := appendString(b, m.Plate)
+	if err != nil {
+		return nil, err
+	}
+	return binary.BigEndian.AppendUint32(b, m.Timestamp), nil
+}
+
+func (m Ticket) appendBody(b []byte) ([]byte, error) {
+	b, err := appendString(b, m.Plate)
+	if err != nil {
+		return nil, err
+	}
+	b = binary.BigEndian.AppendUint16(b, m.Road)
+	b = binary.BigEndian.AppendUint16(b, m.Mile1)
+	b = binary.BigEndian.AppendUint32(b, m.Timestamp1)
+	b = binary.BigEndian.AppendUint16(b, m.Mile2)
+	b = binary.BigEndian.AppendUint32(b, m.Timestamp2)
+	return binary.BigEndian.AppendUint16(b, m.Speed), nil
+}
+
+func (m WantHeartbeat) appendBody(b []byte) ([]byte, error) {
+	return binary.BigEndian.AppendUint32(b, m.Interval), nil
+}
+
+func (m Heartbeat) appendBody(b []byte) ([]byte, error) {
+	return b, nil
+}
+
+func (m IAmCamera) appendBody(b []byte) ([]byte, error) {
+	b = binary.BigEndian.AppendUint16(b, m.Road)
+	b = binary.BigEndian.AppendUint16(b, m.Mile)
+	return binary.BigEndian.AppendUint16(b, m.Limit), nil
+}
+
+func (m IAmDispatcher) appendBody(b []byte) ([]byte, error) {
+	if len(m.Roads) > 255 {
+		return nil, ErrTooLong
+	}
+	b = append(b, byte(len(m.Roads)))
+	for _, r := range m.Roads {
+		b = binary.BigEndian.AppendUint16(b, r)
+	}
+	return b, nil
+}
+
+// Encoder writes every message with single Write call, so messages from
+// different goroutines never interleave
+type Encoder struct {
+	w io.Writer
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+func (e *Encoder) Encode(m Message) error {
+	b, err := Marshal(m)
+	if err != nil {
+		return fmt.Errorf("encode %s: %w", m.Type(), err)
+	}
+	_, err = e.w.Write(b)
+	return err
+}
+
+// Decoder reads messages from stream. It returns io.EOF when stream ends
+// between messages and io.ErrUnexpectedEOF when it ends inside one
+type Decoder struct {
+	r *bufio.Reader
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r)}
+}
+
+func (d *Decoder) Decode() (Message, error) {
+	t, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	m, err := d.decodeBody(Type(t))
+	if errors.Is(err, io.EOF) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (d *Decoder) decodeBody(t Type) (Message, error) {
+	switch t {
+	case TypeError:
+		msg, err := d.readString()
+		return Error{Msg: msg}, err
+	case TypePlate:
+		var m Plate
+		var err error
+		if m.Plate, err = d.readString(); err != nil {
+			return nil, err
+		}
+		m.Timestamp, err = d.read32()
+		return m, err
+	case TypeTicket:
+		var m Ticket
+		var err error
+		if m.Plate, err = d.readString(); err != nil {
+			return nil, err
+		}
+		var buf [16]byte
+		if _, err := io.ReadFull(d.r, buf[:]); err != nil {
+			return nil, err
+		}
+		m.Road = binary.BigEndian.Uint16(buf[0:])
+		m.Mile1 = binary.BigEndian.Uint16(buf[2:])
+		m.Timestamp1 = binary.BigEndian.Uint32(buf[4:])
+		m.Mile2 = binary.BigEndian.Uint16(buf[8:])
+		m.Timestamp2 = binary.BigEndian.Uint32(buf[10:])
+		m.Speed = binary.BigEndian.Uint16(buf[14:])
+		return m, nil
+	case TypeWantHeartbeat:
+		interval, err := d.read32()
+		return WantHeartbeat{Interval: interval}, err
+	case TypeHeartbeat:
+		return Heartbeat{}, nil
+	case TypeIAmCamera:
+		var buf [6]byte
+		if _, err := io.ReadFull(d.r, buf[:]); err != nil {
+			return nil, err
+		}
+		return IAmCamera{
+			Road:  binary.BigEndian.Uint16(buf[0:]),
+			Mile:  binary.BigEndian.Uint16(buf[2:]),
+			Limit: binary.BigEndian.Uint16(buf[4:]),
+		}, nil
+	case TypeIAmDispatcher:
+		n, err := d.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		roads := make([]uint16, n)
+		for i := range roads {
+			if roads[i], err = d.read16(); err != nil {
+				return nil, err
+			}
+		}
+		return IAmDispatcher{Roads: roads}, nil
+	default:
+		return nil, fmt.Errorf("%w %#02x", ErrUnknownType, byte(t))
+	}
+}
+
+func (d *Decoder) read16() (uint16, error) {
+	var buf [2]byte
+	if _, err := io.ReadFull(d.r, buf[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(buf[:]), nil
+}
+
+func (d *Decoder) read32() (uint32, error) {
+	var buf [4]byte
+	if _, err := io.ReadFull(d.r, buf[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(buf[:]), nil
+}
+
+func (d *Decoder) readString() (string, error) {
+	n, err := d.r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(d.r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
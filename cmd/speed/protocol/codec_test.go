@@ -0,0 +1,110 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// examples from protocol specification
+var examples = []struct {
+	msg   Message
+	bytes []byte
+}{
+	{Error{Msg: "bad"}, []byte{0x10, 0x03, 0x62, 0x61, 0x64}},
+	{Plate{Plate: "UN1X", Timestamp: 1000}, []byte{0x20, 0x04, 0x55, 0x4e, 0x31, 0x58, 0x00, 0x00, 0x03, 0xe8}},
+	{Ticket{Plate: "UN1X", Road: 66, Mile1: 100, Timestamp1: 123456, Mile2: 110, Timestamp2: 123816, Speed: 10000},
+		[]byte{0x21, 0x04, 0x55, 0x4e, 0x31, 0x58, 0x00, 0x42, 0x00, 0x64, 0x00, 0x01, 0xe2, 0x40,
+			0x00, 0x6e, 0x00, 0x01, 0xe3, 0xa8, 0x27, 0x10}},
+	{WantHeartbeat{Interval: 10}, []byte{0x40, 0x00, 0x00, 0x00, 0x0a}},
+	{Heartbeat{}, []byte{0x41}},
+	{IAmCamera{Road: 66, Mile: 100, Limit: 60}, []byte{0x80, 0x00, 0x42, 0x00, 0x64, 0x00, 0x3c}},
+	{IAmDispatcher{Roads: []uint16{66, 368, 5000}}, []byte{0x81, 0x03, 0x00, 0x42, 0x01, 0x70, 0x13, 0x88}},
+}
+
+func TestRoundTrip(t *testing.T) {
+	var stream bytes.Buffer
+	enc := NewEncoder(&stream)
+	for _, ex := range examples {
+		got, err := Marshal(ex.msg)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v\n", ex.msg.Type(), err)
+		}
+		if !bytes.Equal(got, ex.bytes) {
+			t.Errorf("%s: got %x, want %x\n", ex.msg.Type(), got, ex.bytes)
+		}
+		if err := enc.Encode(ex.msg); err != nil {
+			t.Fatalf("%s: unexpected error: %v\n", ex.msg.Type(), err)
+		}
+	}
+
+	dec := NewDecoder(&stream)
+	for _, ex := range examples {
+		got, err := dec.Decode()
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v\n", ex.msg.Type(), err)
+		}
+		if !reflect.DeepEqual(got, ex.msg) {
+			t.Errorf("got %+v, want %+v\n", got, ex.msg)
+		}
+	}
+	if _, err := dec.Decode(); err != io.EOF {
+		t.Errorf("got %v at end of stream, want EOF\n", err)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	for _, ex := range examples {
+		for n := 1; n < len(ex.bytes); n++ {
+			_, err := NewDecoder(bytes.NewReader(ex.bytes[:n])).Decode()
+			if !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("%s truncated to %d bytes: got %v, want %v\n", ex.msg.Type(), n, err, io.ErrUnexpectedEOF)
+			}
+		}
+	}
+
+	_, err := NewDecoder(bytes.NewReader([]byte{0x0f, 0x21})).Decode()
+	if !errors.Is(err, ErrUnknownType) {
+		t.Errorf("got %v, want %v\n", err, ErrUnknownType)
+	}
+}
+
+func TestEncodeTooLong(t *testing.T) {
+	long := strings.Repeat("x", 256)
+	for _, m := range []Message{Error{Msg: long}, Plate{Plate: long}, Ticket{Plate: long}, IAmDispatcher{Roads: make([]uint16, 256)}} {
+		if err := NewEncoder(io.Discard).Encode(m); !errors.Is(err, ErrTooLong) {
+			t.Errorf("%s: got %v, want %v\n", m.Type(), err, ErrTooLong)
+		}
+	}
+}
+
+// FuzzDecode checks that decoder never panics and that everything it accepts
+// is encoded back to the very same bytes
+func FuzzDecode(f *testing.F) {
+	for _, ex := range examples {
+		f.Add(ex.bytes)
+	}
+	f.Add([]byte{0x20, 0xff})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		dec := NewDecoder(r)
+		var encoded []byte
+		for {
+			m, err := dec.Decode()
+			if err != nil {
+				break
+			}
+			b, err := Marshal(m)
+			if err != nil {
+				t.Fatalf("decoded %+v cannot be encoded: %v\n", m, err)
+			}
+			encoded = append(encoded, b...)
+		}
+		if !bytes.HasPrefix(data, encoded) {
+			t.Errorf("re-encoded %x is not prefix of input %x\n", encoded, data)
+		}
+	})
+}
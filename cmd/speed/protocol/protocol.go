@@ -0,0 +1,100 @@
+// Package protocol implements binary messages of the speed daemon protocol.
+// All integers are big endian, strings are prefixed with single length byte.
+package protocol
+
+import (
+	"errors"
+	"fmt"
+)
+
+type Type byte
+
+const (
+	TypeError         Type = 0x10
+	TypePlate         Type = 0x20
+	TypeTicket        Type = 0x21
+	TypeWantHeartbeat Type = 0x40
+	TypeHeartbeat     Type = 0x41
+	TypeIAmCamera     Type = 0x80
+	TypeIAmDispatcher Type = 0x81
+)
+
+func (t Type) String() string {
+	switch t {
+	case TypeError:
+		return "Error"
+	case TypePlate:
+		return "Plate"
+	case TypeTicket:
+		return "Ticket"
+	case TypeWantHeartbeat:
+		return "WantHeartbeat"
+	case TypeHeartbeat:
+		return "Heartbeat"
+	case TypeIAmCamera:
+		return "IAmCamera"
+	case TypeIAmDispatcher:
+		return "IAmDispatcher"
+	default:
+		return fmt.Sprintf("Type(%#02x)", byte(t))
+	}
+}
+
+var (
+	ErrUnknownType = errors.New("unknown message type")
+	ErrTooLong     = errors.New("string or list longer than 255")
+)
+
+// Message is one of the message structs below
+type Message interface {
+	Type() Type
+	// appendBody appends everything after type byte
+	appendBody(b []byte) ([]byte, error)
+}
+
+// Error is sent by server before it disconnects misbehaving client
+type Error struct {
+	Msg string
+}
+
+// Plate is observation of a car reported by camera, Timestamp is in seconds
+type Plate struct {
+	Plate     string
+	Timestamp uint32
+}
+
+// Ticket is sent to dispatcher, Speed is in hundredths of mph
+type Ticket struct {
+	Plate      string
+	Road       uint16
+	Mile1      uint16
+	Timestamp1 uint32
+	Mile2      uint16
+	Timestamp2 uint32
+	Speed      uint16
+}
+
+// WantHeartbeat asks server for heartbeat every Interval deciseconds, 0 disables it
+type WantHeartbeat struct {
+	Interval uint32
+}
+
+type Heartbeat struct{}
+
+type IAmCamera struct {
+	Road  uint16
+	Mile  uint16
+	Limit uint16
+}
+
+type IAmDispatcher struct {
+	Roads []uint16
+}
+
+func (Error) Type() Type         { return TypeError }
+func (Plate) Type() Type         { return TypePlate }
+func (Ticket) Type() Type        { return TypeTicket }
+func (WantHeartbeat) Type() Type { return TypeWantHeartbeat }
+func (Heartbeat) Type() Type     { return TypeHeartbeat }
+func (IAmCamera) Type() Type     { return TypeIAmCamera }
+func (IAmDispatcher) Type() Type { return TypeIAmDispatcher }
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+)
+
+// roadShards spreads roads over independent locks, so cameras of different
+// roads never wait for each other to find their road
+const roadShards = 64
+
+type roadShard struct {
+	roads map[uint16]*Road
+
+	mu sync.RWMutex
+}
+
+// roadTable owns all roads of the server. Roads are never removed, so once
+// found, *Road can be used without holding shard lock
+type roadTable struct {
+	shards [roadShards]roadShard
+	// retention of observations in seconds for new roads
+	retention uint32
+	policies  Policies
+}
+
+func newRoadTable(retention uint32, policies Policies) *roadTable {
+	t := &roadTable{retention: retention, policies: policies}
+	for i := range t.shards {
+		t.shards[i].roads = make(map[uint16]*Road)
+	}
+	return t
+}
+
+// get returns road with given number, creating it when needed
+func (t *roadTable) get(number uint16) *Road {
+	shard := &t.shards[number%roadShards]
+	shard.mu.RLock()
+	r, ok := shard.roads[number]
+	shard.mu.RUnlock()
+	if ok {
+		return r
+	}
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if r, ok := shard.roads[number]; ok {
+		return r
+	}
+	r = &Road{
+		observations: newObservationIndex(t.retention),
+		cameras:      make(map[uint16]int),
+		policy:       t.policies.For(number),
+		number:       number,
+	}
+	shard.roads[number] = r
+	return r
+}
+
+// all returns every road ordered by number, shard locks are held only while
+// collecting them
+func (t *roadTable) all() []*Road {
+	var roads []*Road
+	for i := range t.shards {
+		shard := &t.shards[i]
+		shard.mu.RLock()
+		for _, r := range shard.roads {
+			roads = append(roads, r)
+		}
+		shard.mu.RUnlock()
+	}
+	slices.SortFunc(roads, func(a, b *Road) int {
+		return cmp.Compare(a.number, b.number)
+	})
+	return roads
+}
@@ -1,12 +1,10 @@
 package main
 
 import (
+	"bean/cmd/speed/protocol"
 	"bean/pkg/pserver"
-	"bufio"
-	"encoding/binary"
+	"errors"
 	"flag"
-	"fmt"
-	"io"
 	"log"
 	"net"
 	"os"
@@ -15,12 +13,36 @@ import (
 )
 
 var portNumber = flag.Int("port", 4242, "Port number of server")
+var retention = flag.Duration("retention", 24*time.Hour, "How long observations are kept for comparison, 0 keeps them forever")
+var ledgerPath = flag.String("ledger", "", "File where issued tickets are persisted, tickets are kept only in memory when empty")
+var policiesPath = flag.String("policies", "", "JSON file with per-road ticketing policies, any speed over the limit is ticketed when empty")
+var adminAddr = flag.String("admin-addr", "", "TCP address of read-only HTTP API listing tickets and road state, disabled when empty (it exposes plates without authentication, keep it on a trusted network)")
 
 func main() {
 	flag.Parse()
-	server := NewServer()
+	ledger := NewMemoryLedger()
+	if *ledgerPath != "" {
+		var err error
+		if ledger, err = OpenLedger(*ledgerPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+	defer ledger.Close()
+	var policies Policies
+	if *policiesPath != "" {
+		var err error
+		if policies, err = LoadPolicies(*policiesPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+	server := NewServerWithOptions(Options{Ledger: ledger, Retention: *retention, Policies: policies})
 	log.SetOutput(os.Stdout) // Redirect logs to stdout
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+	if *adminAddr != "" {
+		go func() {
+			log.Fatal(ListenServeAdmin(server, *adminAddr))
+		}()
+	}
 	handler := pserver.WithMiddleware(
 		server.handleConnection,
 		pserver.LoggingMiddleware,
@@ -29,75 +51,75 @@ func main() {
 	log.Fatal(pserver.ListenServe(handler, *portNumber))
 }
 
+// Server state is owned as follows, locks are always taken in this order
+// and none of them is held while writing to network:
+//
+//	roadTable shard lock - only to find a road
+//	Road.mu              - observations, limit, cameras and dispatchers of single road
+//	Ledger.mu            - tickets and days tickets were issued for
+//	Dispatcher.mu        - queue of single dispatcher
+//	heartbeatWheel.mu    - who wants heartbeats and when
+//
+// Only connWriter.mu is held while writing, it's taken with no other lock held.
+// Ledger is never called with road lock held when it may write to disk.
 type Server struct {
-	roads       map[uint16]*Road
-	sendTickets map[string]*PastTickets // for a certain car
-
-	mu sync.Mutex
-}
-
-type PastTickets struct {
-	days map[int]struct{}
-
-	mu sync.Mutex
-}
-
-func (s *Server) addNew(car string, day1, day2 int) bool {
-	s.mu.Lock()
-	if _, ok := s.sendTickets[car]; !ok {
-		d := make(map[int]struct{})
-		d[day1] = struct{}{}
-		d[day2] = struct{}{}
-		s.sendTickets[car] = &PastTickets{
-			days: d,
-			mu:   sync.Mutex{},
-		}
-		s.mu.Unlock()
-		return true
-	}
-	s.mu.Unlock()
-	defer s.sendTickets[car].mu.Unlock()
-
-	s.sendTickets[car].mu.Lock()
-	if _, ok := s.sendTickets[car].days[day1]; ok {
-		return false
-	}
-	if _, ok := s.sendTickets[car].days[day2]; ok {
-		return false
-	}
-	s.sendTickets[car].days[day1] = struct{}{}
-	s.sendTickets[car].days[day2] = struct{}{}
-	return true
+	roads *roadTable
+	// ledger owns issued tickets and one ticket per day rule
+	ledger *Ledger
+	// heartbeats of all connections, interval is in deciseconds like in the protocol
+	heartbeats *heartbeatWheel
 }
 
 type Road struct {
 	limit        uint16
-	measurements map[string][]Measurement // for a plate number
-	dispatcher   []Dispatcher
-	number       uint16
-	oldTickets   [][]byte
+	observations observationIndex
+	dispatchers  []*Dispatcher
+	policy       Policy
+	// cameras counts connected cameras by mile
+	cameras map[uint16]int
+	// next is where search for least loaded dispatcher starts, so they take turns
+	next   int
+	number uint16
 
 	mu sync.Mutex
 }
 
-type Measurement struct {
-	timestamp uint32
-	mile      uint16
+type Options struct {
+	// Ledger keeps issued tickets, in memory one is used when nil
+	Ledger *Ledger
+	// Retention is how long observations are kept, measured back from the newest
+	// timestamp seen on the road. Zero keeps them forever
+	Retention time.Duration
+	// Policies decide which speeds get tickets on each road
+	Policies Policies
 }
 
-type Dispatcher struct {
-	dChan chan []byte
+func NewServer() *Server {
+	return NewServerWithOptions(Options{})
 }
 
-func NewServer() *Server {
+func NewServerWithOptions(opts Options) *Server {
+	if opts.Ledger == nil {
+		opts.Ledger = NewMemoryLedger()
+	}
 	return &Server{
-		roads:       make(map[uint16]*Road),
-		sendTickets: make(map[string]*PastTickets),
+		roads:      newRoadTable(uint32(opts.Retention/time.Second), opts.Policies),
+		ledger:     opts.Ledger,
+		heartbeats: newHeartbeatWheel(time.Second / 10),
 	}
 }
 
 func (s *Server) handleConnection(conn net.Conn) {
 	defer pserver.HandleConnShutdown(conn)
+	w := newConnWriter(conn)
+	var hb *heartbeat
+	defer func() { s.heartbeats.remove(hb) }()
+	var dispatcher *Dispatcher
+	defer func() {
+		if dispatcher != nil {
+			s.removeDispatcher(dispatcher)
+		}
+	}()
 
 	isCamera := false
 	isDispatcher := false
@@ -107,307 +129,157 @@ func (s *Server) handleConnection(conn net.Conn) {
 
 	var connRoad uint16
 	var connMile uint16
+	defer func() {
+		if isCamera {
+			s.removeCamera(connRoad, connMile)
+		}
+	}()
 
-	reader := bufio.NewReader(conn)
+	dec := protocol.NewDecoder(conn)
 	for {
-		msgType, err := reader.ReadByte()
+		msg, err := dec.Decode()
+		if errors.Is(err, protocol.ErrUnknownType) {
+			log.Printf("illegal message: %v\n", err)
+			s.sendError("illegal message", w)
+			return
+		}
 		if err != nil {
-			log.Printf("error reading type: %q", err)
+			log.Printf("error reading message: %v\n", err)
 			return
 		}
-		switch msgType {
-		case 0x20:
-			// Plate
-			_, plate, err := readString(reader)
-			if err != nil {
-				log.Printf("error reading plate: %v\n", err)
-				return
-			}
-			timestamp, err := read32(reader)
+		switch m := msg.(type) {
+		case protocol.Plate:
 			if !isCamera {
-				s.sendError("you are not camera", conn)
+				s.sendError("you are not camera", w)
+				return
 			}
-			s.addMeasurement(connRoad, connMile, timestamp, plate)
-		case 0x40:
-			// WantHeartbeat
+			s.addMeasurement(connRoad, connMile, m.Timestamp, m.Plate)
+		case protocol.WantHeartbeat:
 			if isHeartBiting {
 				log.Print("Already sending hb\n")
-				return
-			}
-			interval, err := read32(reader)
-			if err != nil {
-				log.Printf("error when getting interval: %v\n", err)
+				s.sendError("heartbeat already requested", w)
 				return
 			}
 			isHeartBiting = true
-			log.Printf("interval: %d\n", interval)
-			if interval == 0 {
-				continue
-			}
-			go func(interval uint32) {
-				for {
-					_, err := conn.Write([]byte{0x41})
-					if err != nil {
-						log.Printf("error sending hb: %v\n", err)
-						return
-					}
-					time.Sleep(time.Second * time.Duration(interval) / 10)
-				}
-			}(interval)
-		case 0x80:
-			// IAmCamera
-			road, err := read16(reader)
-			if err != nil {
-				log.Printf("error road: %v\n", err)
-				return
-			}
-			mile, err := read16(reader)
-			if err != nil {
-				log.Printf("error mile: %v\n", err)
-				return
-			}
-			limit, err := read16(reader)
-			if err != nil {
-				log.Printf("error limit: %v\n", err)
-				return
-			}
+			log.Printf("interval: %d\n", m.Interval)
+			hb = s.heartbeats.add(w, m.Interval)
+		case protocol.IAmCamera:
 			if isDispatcher || isCamera {
-				s.sendError("already registered", conn)
+				s.sendError("already registered", w)
 				return
 			}
 			isCamera = true
-			connRoad = road
-			connMile = mile
-			s.addCamera(road, mile, limit)
-		case 0x81:
-			// IAmDispatcher
-			numRoads, err := read8(reader)
-			log.Printf("new dispatcher for %d roads\n", numRoads)
-			if err != nil {
-				log.Printf("error numRoads: %v\n", err)
-				return
-			}
-			roads := make([]uint16, numRoads)
-			for i := range roads {
-				log.Println("adding dispatcher to road")
-				road, err := read16(reader)
-				if err != nil {
-					log.Printf("error road: %v\n", err)
-					return
-				}
-				roads[i] = road
-			}
+			connRoad = m.Road
+			connMile = m.Mile
+			s.addCamera(m.Road, m.Mile, m.Limit)
+		case protocol.IAmDispatcher:
+			log.Printf("new dispatcher for %d roads\n", len(m.Roads))
 			if isCamera || isDispatcher {
-				s.sendError("already registered", conn)
+				s.sendError("already registered", w)
 				return
 			}
 			isDispatcher = true
-			dCh := s.addDispatcher(roads)
-			log.Printf("dispatcher added correctly: %v\n", roads)
-			go func(dCh chan []byte, conn net.Conn) {
-				for {
-					msg := <-dCh
-					_, err := conn.Write(msg)
-					if err != nil {
-						fmt.Printf("error when writing to dispatcher: %v\n", err)
-						return
-					}
-				}
-			}(dCh, conn)
+			dispatcher = s.addDispatcher(m.Roads, w)
+			log.Printf("dispatcher added correctly: %v\n", m.Roads)
 		default:
-			log.Printf("illegal message with code: %02x\n", msgType)
-			s.sendError("illegal message", conn)
+			// messages server sends, clients must not send them
+			log.Printf("illegal message %s\n", msg.Type())
+			s.sendError("illegal message", w)
 			return
 		}
 	}
 }
 
-func read8(reader *bufio.Reader) (uint8, error) {
-	buff := make([]byte, 1)
-	n, err := io.ReadFull(reader, buff)
-	if n != 1 {
-		return 0, fmt.Errorf("read not 1 but %d bytes", n)
-	}
-	if err != nil {
-		return 0, err
-	}
-	return buff[0], nil
-}
+func (s *Server) addMeasurement(road, mile uint16, timestamp uint32, plate string) {
+	r := s.road(road)
+	candidates := r.observe(plate, mile, timestamp)
 
-func read16(reader *bufio.Reader) (uint16, error) {
-	buff := make([]byte, 2)
-	n, err := io.ReadFull(reader, buff)
-	if n != 2 {
-		return 0, fmt.Errorf("read not 2 but %d bytes", n)
+	issued := false
+	for _, c := range candidates {
+		ticket, ok, err := s.ledger.Issue(c)
+		if err != nil {
+			log.Printf("could not issue ticket for %s: %v\n", plate, err)
+			continue
+		}
+		if ok {
+			log.Printf("issuing ticket %d for %s at day %d\n", ticket.ID, plate, c.Timestamp1/86400)
+			issued = true
+		}
 	}
-	if err != nil {
-		return 0, err
+	if issued {
+		s.dispatchRoad(road)
 	}
-	return binary.BigEndian.Uint16(buff), nil
 }
 
-func read32(reader *bufio.Reader) (uint32, error) {
-	buff := make([]byte, 4)
-	n, err := io.ReadFull(reader, buff)
-	if n != 4 {
-		return 0, fmt.Errorf("read not 4 but %d bytes", n)
-	}
-	if err != nil {
-		return 0, err
+// observe records observation and returns tickets for observations of the plate
+// it was speeding from or to, ledger decides which of them are issued. Only
+// neighbouring observations are compared unless road uses section control
+func (r *Road) observe(plate string, mile uint16, timestamp uint32) []Ticket {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var candidates []Ticket
+	current := Measurement{timestamp: timestamp, mile: mile}
+	for _, m := range r.observations.insert(plate, current, r.policy.Section) {
+		if t, ok := r.speeding(plate, m, current); ok {
+			candidates = append(candidates, t)
+		}
 	}
-	return binary.BigEndian.Uint32(buff), nil
+	return candidates
 }
 
-func readString(reader *bufio.Reader) (int, string, error) {
-	l, err := reader.ReadByte()
-	if err != nil {
-		return 0, "", err
+// speeding returns ticket if average speed between two observations is over
+// the threshold of road policy
+func (r *Road) speeding(plate string, a, b Measurement) (Ticket, bool) {
+	if b.timestamp < a.timestamp {
+		a, b = b, a
 	}
-	strBuff := make([]byte, int(l))
-	n, err := io.ReadFull(reader, strBuff)
-	if err != nil {
-		return 0, "", err
+	if b.timestamp == a.timestamp {
+		// two cameras at once, nothing sensible can be computed
+		return Ticket{}, false
 	}
-	if n != int(l) {
-		return 0, "", fmt.Errorf("should read %d bytes, but read %d", int(l), n)
+	speed, over := averageSpeed(a, b, r.policy.threshold(r.limit))
+	if !over {
+		return Ticket{}, false
 	}
-	return int(l) + 1, string(strBuff), nil
+	log.Printf("speed is: %d, limit is %d\n", speed, r.limit)
+	return Ticket{
+		Plate:      plate,
+		Road:       r.number,
+		Mile1:      a.mile,
+		Timestamp1: a.timestamp,
+		Mile2:      b.mile,
+		Timestamp2: b.timestamp,
+		Speed:      speed,
+	}, true
 }
 
-func (s *Server) addMeasurement(road, mile uint16, timestamp uint32, plate string) {
-	r := s.roads[road]
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	ms := r.measurements[plate]
-	for _, m := range ms {
-		var distance uint16
-		var m1 uint16
-		var m2 uint16
-		if mile > m.mile {
-			distance = mile - m.mile
-		} else {
-			distance = m.mile - mile
-		}
-		var timeDelta uint32
-		var t1 uint32
-		var t2 uint32
-		if timestamp > m.timestamp {
-			t1 = m.timestamp
-			t2 = timestamp
-			m1 = m.mile
-			m2 = mile
-			timeDelta = t2 - t1
-		} else {
-			t1 = timestamp
-			t2 = m.timestamp
-			m1 = mile
-			m2 = m.mile
-			timeDelta = t2 - t1
-		}
-		speed := uint32(distance) * 3600 / timeDelta
-
-		if speed > uint32(r.limit) || (speed >= uint32(r.limit) && uint32(distance)*3600%timeDelta > 0) {
-			log.Printf("speed is: %d, limit is %d\n", speed, r.limit)
-			if uint32(distance)*3600%timeDelta > timeDelta/2 {
-				speed += 1
-			}
-			day := t1 / 86400
-			day2 := t2 / 86400
-
-			if s.addNew(plate, int(day), int(day2)) {
-				log.Printf("issuing ticket for %s at day %d\n", plate, day)
-				ticket := r.generateTicket(plate, m1, m2, t1, t2, speed)
-				if len(r.dispatcher) == 0 {
-					log.Println("no dispatchers, storing ticket for later")
-					r.oldTickets = append(r.oldTickets, ticket)
-				} else {
-					r.dispatcher[0].dChan <- ticket
-				}
-			}
-		}
-	}
-	ms = append(ms, Measurement{
-		timestamp: timestamp,
-		mile:      mile,
-	})
-	r.measurements[plate] = ms
+// road returns road with given number, creating it when needed
+func (s *Server) road(number uint16) *Road {
+	return s.roads.get(number)
 }
 
 func (s *Server) addCamera(numRoad, mile, limit uint16) {
-	r, ok := s.roads[numRoad]
-	if !ok {
-		nr := &Road{
-			limit:        limit,
-			measurements: make(map[string][]Measurement),
-			dispatcher:   make([]Dispatcher, 0),
-			number:       numRoad,
-			oldTickets:   make([][]byte, 0),
-			mu:           sync.Mutex{},
-		}
-		s.roads[numRoad] = nr
-	} else {
-		r.limit = limit
-	}
+	r := s.road(numRoad)
+	r.mu.Lock()
+	r.limit = limit
+	r.cameras[mile]++
+	r.mu.Unlock()
 	log.Printf("road: %d, mile: %d, limit: %d\n",
 		numRoad, mile, limit)
 }
 
-func (s *Server) addDispatcher(roads []uint16) chan []byte {
-	log.Printf("adding new dispatcher on roads %v\n", roads)
-	dChan := make(chan []byte, 10)
-	for _, rn := range roads {
-		r, ok := s.roads[rn]
-		dispatcher := Dispatcher{
-			dChan: dChan,
-		}
-		if !ok {
-			nr := &Road{
-				limit:        0,
-				measurements: make(map[string][]Measurement),
-				dispatcher:   []Dispatcher{dispatcher},
-				number:       rn,
-				oldTickets:   make([][]byte, 0),
-				mu:           sync.Mutex{},
-			}
-			s.roads[rn] = nr
-		} else {
-			r.dispatcher = append(r.dispatcher, dispatcher)
-			for _, oldT := range r.oldTickets {
-				dChan <- oldT
-			}
-			r.oldTickets = nil
-		}
+func (s *Server) removeCamera(numRoad, mile uint16) {
+	r := s.road(numRoad)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cameras[mile]--; r.cameras[mile] <= 0 {
+		delete(r.cameras, mile)
 	}
-	return dChan
 }
 
-func (s *Server) sendError(msg string, conn net.Conn) {
-	l := len(msg)
-	response := make([]byte, l+2)
-	response[0] = 0x10
-	response[1] = byte(l)
-	bMsg := []byte(msg)
-	copy(bMsg, response[2:])
-	conn.Write(response)
-}
-
-func (r *Road) generateTicket(plate string, mile1, mile2 uint16, ts1, ts2, speed uint32) []byte {
-	ticket := make([]byte, 2+len(plate)+2+2+4+2+4+2)
-	ticket[0] = 0x21
-	ticket[1] = byte(len(plate))
-	copy(ticket[2:], plate)
-	offset := 2 + len(plate)
-
-	binary.BigEndian.PutUint16(ticket[offset:], r.number) // Road
-	offset += 2
-	binary.BigEndian.PutUint16(ticket[offset:], mile1) // Mile 1
-	offset += 2
-	binary.BigEndian.PutUint32(ticket[offset:], ts1) // Timestamp 1
-	offset += 4
-	binary.BigEndian.PutUint16(ticket[offset:], mile2) // Mile 2
-	offset += 2
-	binary.BigEndian.PutUint32(ticket[offset:], ts2)
-	offset += 4
-	binary.BigEndian.PutUint16(ticket[offset:], uint16(speed)*100)
-	return ticket
+func (s *Server) sendError(msg string, w *connWriter) {
+	if err := w.send(protocol.Error{Msg: msg}); err != nil {
+		log.Printf("could not send error: %v\n", err)
+	}
 }
@@ -27,6 +27,9 @@ func TestUnknownMessage(t *testing.T) {
 	if int(l)+2 != n {
 		t.Errorf("should end %d, but got %d bytes\n", int(l)+2, n)
 	}
+	if got := string(buff[2:n]); got != "illegal message" {
+		t.Errorf("got error %q, want %q\n", got, "illegal message")
+	}
 
 	_, err := clientConn.Write(msg)
 
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bean/cmd/speedsim/sim"
+	"net"
+	"testing"
+	"time"
+)
+
+func startServer(t *testing.T, s *Server) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.handleConnection(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// TestSimulatedTraffic is acceptance test of ticketing, it runs simulator
+// against the server and checks every received ticket
+func TestSimulatedTraffic(t *testing.T) {
+	roads, _ := sim.ParseRoads("123:60:0,8,9,25;368:50:10,15,40;5000:70:1,100")
+	scenario := sim.Generate(sim.Config{
+		Roads:    roads,
+		Cars:     100,
+		Days:     3,
+		Seed:     1,
+		Speeders: 0.2,
+		Late:     0.1,
+	})
+
+	tickets, err := sim.Run(startServer(t, NewServer()), scenario, sim.Options{
+		Dispatchers: 3,
+		LateDelay:   50 * time.Millisecond,
+		Settle:      300 * time.Millisecond,
+		Timeout:     10 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if len(tickets) == 0 {
+		t.Fatalf("no tickets received\n")
+	}
+	for _, p := range sim.Verify(scenario, tickets) {
+		t.Error(p)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bean/cmd/speed/protocol"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// connWriter is the only way server writes to connection. Frames are written
+// one at a time, so heartbeats, tickets and errors never interleave
+type connWriter struct {
+	enc *protocol.Encoder
+	// beating is set while heartbeat write is in flight, wheel skips
+	// heartbeat rather than piling up writes for slow client
+	beating atomic.Bool
+
+	mu sync.Mutex
+}
+
+func newConnWriter(conn net.Conn) *connWriter {
+	return &connWriter{enc: protocol.NewEncoder(conn)}
+}
+
+// send writes whole message and returns once it's written or failed
+func (w *connWriter) send(m protocol.Message) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.enc.Encode(m)
+}
@@ -0,0 +1,163 @@
+package sim
+
+import (
+	"bean/cmd/speed/protocol"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+type Options struct {
+	// Dispatchers connect before cameras, each of them for every road
+	Dispatchers int
+	// LateDelay is pause before late observations are sent
+	LateDelay time.Duration
+	// Settle is how long to wait for more tickets after the last one arrived
+	Settle time.Duration
+	// Timeout bounds the whole run
+	Timeout time.Duration
+	// Concurrent makes every camera send its observations from its own goroutine,
+	// otherwise observations are sent one by one in scenario order
+	Concurrent bool
+}
+
+// Run connects cameras and dispatchers to server at addr, sends observations
+// of scenario and returns tickets received until no more arrive
+func Run(addr string, s Scenario, opts Options) ([]protocol.Ticket, error) {
+	deadline := time.Now().Add(opts.Timeout)
+	// receivers are stopped by closing done and their connections, then waited for
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	var conns []net.Conn
+	defer func() {
+		for _, c := range conns {
+			_ = c.Close()
+		}
+	}()
+	dial := func(hello protocol.Message) (net.Conn, error) {
+		conn, err := net.DialTimeout("tcp", addr, time.Until(deadline))
+		if err != nil {
+			return nil, err
+		}
+		conns = append(conns, conn)
+		return conn, protocol.NewEncoder(conn).Encode(hello)
+	}
+
+	var roads []uint16
+	for _, r := range s.Roads {
+		roads = append(roads, r.Road)
+	}
+	tickets := make(chan protocol.Ticket)
+	failures := make(chan error, opts.Dispatchers)
+	done := make(chan struct{})
+	defer close(done)
+
+	for range opts.Dispatchers {
+		conn, err := dial(protocol.IAmDispatcher{Roads: roads})
+		if err != nil {
+			return nil, fmt.Errorf("connect dispatcher: %w", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			failures <- receiveTickets(conn, tickets, done)
+		}()
+	}
+
+	cameras := make(map[[2]uint16]*protocol.Encoder)
+	for _, r := range s.Roads {
+		for _, mile := range r.Miles {
+			conn, err := dial(protocol.IAmCamera{Road: r.Road, Mile: mile, Limit: r.Limit})
+			if err != nil {
+				return nil, fmt.Errorf("connect camera: %w", err)
+			}
+			cameras[[2]uint16{r.Road, mile}] = protocol.NewEncoder(conn)
+		}
+	}
+	sendSerial := func(obs []Observation) error {
+		for _, o := range obs {
+			err := cameras[[2]uint16{o.Road, o.Mile}].Encode(protocol.Plate{Plate: o.Plate, Timestamp: o.Timestamp})
+			if err != nil {
+				return fmt.Errorf("send observation: %w", err)
+			}
+		}
+		return nil
+	}
+	send := sendSerial
+	if opts.Concurrent {
+		send = func(obs []Observation) error {
+			perCamera := make(map[[2]uint16][]Observation)
+			for _, o := range obs {
+				k := [2]uint16{o.Road, o.Mile}
+				perCamera[k] = append(perCamera[k], o)
+			}
+			errs := make(chan error, len(perCamera))
+			for _, camObs := range perCamera {
+				go func() {
+					errs <- sendSerial(camObs)
+				}()
+			}
+			var err error
+			for range perCamera {
+				err = errors.Join(err, <-errs)
+			}
+			return err
+		}
+	}
+	if err := send(s.Observations); err != nil {
+		return nil, err
+	}
+	time.Sleep(opts.LateDelay)
+	if err := send(s.Late); err != nil {
+		return nil, err
+	}
+
+	var received []protocol.Ticket
+	settle := time.NewTimer(opts.Settle)
+	defer settle.Stop()
+	for {
+		select {
+		case t := <-tickets:
+			received = append(received, t)
+			settle.Reset(opts.Settle)
+		case err := <-failures:
+			return received, err
+		case <-settle.C:
+			return received, nil
+		case <-time.After(time.Until(deadline)):
+			return received, errors.New("timeout waiting for tickets")
+		}
+	}
+}
+
+// receiveTickets passes tickets from dispatcher connection until it's closed
+func receiveTickets(conn net.Conn, tickets chan<- protocol.Ticket, done <-chan struct{}) error {
+	dec := protocol.NewDecoder(conn)
+	for {
+		msg, err := dec.Decode()
+		if err != nil {
+			select {
+			case <-done:
+				return nil
+			default:
+			}
+			if errors.Is(err, io.EOF) {
+				return errors.New("server closed dispatcher connection")
+			}
+			return fmt.Errorf("dispatcher: %w", err)
+		}
+		switch m := msg.(type) {
+		case protocol.Ticket:
+			select {
+			case tickets <- m:
+			case <-done:
+				return nil
+			}
+		case protocol.Error:
+			return fmt.Errorf("server error for dispatcher: %s", m.Msg)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// Package sim generates speed daemon traffic and checks tickets the server issues.
+package sim
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// RoadSpec is road with speed limit in mph and cameras at given miles
+type RoadSpec struct {
+	Road  uint16
+	Limit uint16
+	Miles []uint16
+}
+
+// ParseRoads reads roads in form "road:limit:mile,mile,...", separated by semicolons,
+// for example "123:60:0,10,25;456:50:3,8"
+func ParseRoads(s string) ([]RoadSpec, error) {
+	var roads []RoadSpec
+	for _, part := range strings.Split(s, ";") {
+		fields := strings.Split(strings.TrimSpace(part), ":")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("road %q: want road:limit:miles", part)
+		}
+		road, err := strconv.ParseUint(fields[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("road %q: %w", part, err)
+		}
+		limit, err := strconv.ParseUint(fields[1], 10, 16)
+		if err != nil || limit == 0 {
+			return nil, fmt.Errorf("road %q: invalid limit %q", part, fields[1])
+		}
+		spec := RoadSpec{Road: uint16(road), Limit: uint16(limit)}
+		for _, m := range strings.Split(fields[2], ",") {
+			mile, err := strconv.ParseUint(m, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("road %q: %w", part, err)
+			}
+			spec.Miles = append(spec.Miles, uint16(mile))
+		}
+		slices.Sort(spec.Miles)
+		spec.Miles = slices.Compact(spec.Miles)
+		if len(spec.Miles) < 2 {
+			return nil, fmt.Errorf("road %q: need at least two cameras", part)
+		}
+		roads = append(roads, spec)
+	}
+	return roads, nil
+}
+
+type Config struct {
+	Roads []RoadSpec
+	// Cars is number of distinct plates, every car makes one trip per day on random road
+	Cars int
+	Days int
+	Seed uint64
+	// Speeders is fraction of trips driven well above the limit, others drive
+	// around it, so some of them are just slightly too fast
+	Speeders float64
+	// Late is fraction of observations held back and sent after all others
+	Late float64
+}
+
+type Observation struct {
+	Road      uint16
+	Mile      uint16
+	Plate     string
+	Timestamp uint32
+}
+
+// Scenario is generated traffic in order it's sent to the server
+type Scenario struct {
+	Roads        []RoadSpec
+	Observations []Observation
+	// Late observations are sent after all Observations
+	Late []Observation
+}
+
+// Generate creates reproducible scenario for seed. Trips start between 6am and
+// 6pm, so consecutive days of the same car never look like speeding
+func Generate(cfg Config) Scenario {
+	rng := rand.New(rand.NewPCG(cfg.Seed, cfg.Seed^0x9e3779b97f4a7c15))
+	var obs []Observation
+
+	plates := make(map[string]struct{})
+	for range cfg.Cars {
+		plate := randomPlate(rng)
+		for _, ok := plates[plate]; ok; _, ok = plates[plate] {
+			plate = randomPlate(rng)
+		}
+		plates[plate] = struct{}{}
+
+		for day := range cfg.Days {
+			road := cfg.Roads[rng.IntN(len(cfg.Roads))]
+			obs = append(obs, trip(rng, road, plate, day, cfg.Speeders)...)
+		}
+	}
+
+	rng.Shuffle(len(obs), func(i, j int) { obs[i], obs[j] = obs[j], obs[i] })
+	late := int(float64(len(obs)) * cfg.Late)
+	return Scenario{
+		Roads:        cfg.Roads,
+		Observations: obs[late:],
+		Late:         obs[:late],
+	}
+}
+
+func randomPlate(rng *rand.Rand) string {
+	const letters = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	const digits = "0123456789"
+	b := []byte{
+		letters[rng.IntN(26)], letters[rng.IntN(26)],
+		digits[rng.IntN(10)], digits[rng.IntN(10)],
+		letters[rng.IntN(26)], letters[rng.IntN(26)], letters[rng.IntN(26)],
+	}
+	return string(b)
+}
+
+// trip drives whole road in random direction, speed of every segment varies a little
+func trip(rng *rand.Rand, road RoadSpec, plate string, day int, speeders float64) []Observation {
+	limit := float64(road.Limit)
+	mean, stddev := limit*0.95, limit*0.06
+	if rng.Float64() < speeders {
+		mean, stddev = limit*1.2, limit*0.1
+	}
+	speed := max(5, rng.NormFloat64()*stddev+mean)
+
+	miles := slices.Clone(road.Miles)
+	if rng.IntN(2) == 0 {
+		slices.Reverse(miles)
+	}
+	t := float64(day*86400 + 6*3600 + rng.IntN(12*3600))
+	obs := []Observation{{Road: road.Road, Mile: miles[0], Plate: plate, Timestamp: uint32(t)}}
+	for i := 1; i < len(miles); i++ {
+		segment := max(5, speed*(1+rng.NormFloat64()*0.03))
+		distance := math.Abs(float64(miles[i]) - float64(miles[i-1]))
+		t += distance * 3600 / segment
+		obs = append(obs, Observation{Road: road.Road, Mile: miles[i], Plate: plate, Timestamp: uint32(math.Round(t))})
+	}
+	return obs
+}
+
+// All returns every observation of scenario
+func (s Scenario) All() []Observation {
+	return append(slices.Clone(s.Observations), s.Late...)
+}
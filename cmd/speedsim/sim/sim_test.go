@@ -0,0 +1,85 @@
+package sim
+
+import (
+	"bean/cmd/speed/protocol"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRoads(t *testing.T) {
+	roads, err := ParseRoads("123:60:25,0,8,8; 7:50:3,1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	want := []RoadSpec{{123, 60, []uint16{0, 8, 25}}, {7, 50, []uint16{1, 3}}}
+	if !reflect.DeepEqual(roads, want) {
+		t.Errorf("got %+v, want %+v\n", roads, want)
+	}
+
+	for _, bad := range []string{"123:60", "x:60:1,2", "1:0:1,2", "1:60:5", "1:60:1,y"} {
+		if _, err := ParseRoads(bad); err == nil {
+			t.Errorf("%q: expected error\n", bad)
+		}
+	}
+}
+
+func TestGenerateReproducible(t *testing.T) {
+	cfg := Config{
+		Roads: []RoadSpec{{123, 60, []uint16{0, 8, 25}}},
+		Cars:  20,
+		Days:  2,
+		Seed:  42,
+		Late:  0.1,
+	}
+	a, b := Generate(cfg), Generate(cfg)
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("same seed generated different scenarios\n")
+	}
+	if n := len(a.All()); n != 20*2*3 {
+		t.Errorf("got %d observations, want %d\n", n, 20*2*3)
+	}
+	if len(a.Late) != 12 {
+		t.Errorf("got %d late observations, want 12\n", len(a.Late))
+	}
+	cfg.Seed = 43
+	if reflect.DeepEqual(a, Generate(cfg)) {
+		t.Errorf("different seeds generated the same scenario\n")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	s := Scenario{
+		Roads: []RoadSpec{{123, 60, []uint16{8, 9}}},
+		Observations: []Observation{
+			{123, 8, "UN1X", 0}, {123, 9, "UN1X", 45}, // 80 mph
+			{123, 8, "SLOW", 0}, {123, 9, "SLOW", 60}, // 60 mph
+		},
+	}
+	good := protocol.Ticket{Plate: "UN1X", Road: 123, Mile1: 8, Timestamp1: 0, Mile2: 9, Timestamp2: 45, Speed: 8000}
+
+	var tests = []struct {
+		name    string
+		tickets []protocol.Ticket
+		want    []string
+	}{
+		{"exact", []protocol.Ticket{good}, nil},
+		{"missing", nil, []string{"missing ticket: UN1X"}},
+		{"twice", []protocol.Ticket{good, good}, []string{"ticketed twice on day 0"}},
+		{"within limit", []protocol.Ticket{good, {Plate: "SLOW", Road: 123, Mile1: 8, Mile2: 9, Timestamp2: 60, Speed: 6000}}, []string{"within limit"}},
+		{"wrong speed", []protocol.Ticket{{Plate: "UN1X", Road: 123, Mile1: 8, Mile2: 9, Timestamp2: 45, Speed: 7000}}, []string{"reported speed"}},
+		{"invented", []protocol.Ticket{good, {Plate: "UN1X", Road: 123, Mile1: 8, Mile2: 9, Timestamp1: 86400, Timestamp2: 86410, Speed: 36000}}, []string{"no such observations"}},
+	}
+	for _, tt := range tests {
+		problems := Verify(s, tt.tickets)
+		if len(problems) != len(tt.want) {
+			t.Errorf("%s: got problems %q, want %q\n", tt.name, problems, tt.want)
+			continue
+		}
+		for i := range problems {
+			if !strings.Contains(problems[i], tt.want[i]) {
+				t.Errorf("%s: got %q, want %q\n", tt.name, problems[i], tt.want[i])
+			}
+		}
+	}
+}
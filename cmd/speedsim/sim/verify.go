@@ -0,0 +1,98 @@
+package sim
+
+import (
+	"bean/cmd/speed/protocol"
+	"fmt"
+	"math"
+	"slices"
+)
+
+type plateRoad struct {
+	plate string
+	road  uint16
+}
+
+// Verify checks tickets against rules of the protocol and returns description
+// of every problem found. Server has some freedom: it must ticket car exceeding
+// the limit by 0.5 mph or more, may ticket car exceeding it by less, and issues
+// at most one ticket per car per day, so which pair gets ticketed is not fixed
+func Verify(s Scenario, tickets []protocol.Ticket) []string {
+	limits := make(map[uint16]uint16)
+	for _, r := range s.Roads {
+		limits[r.Road] = r.Limit
+	}
+	observed := make(map[plateRoad][]Observation)
+	for _, o := range s.All() {
+		k := plateRoad{o.Plate, o.Road}
+		observed[k] = append(observed[k], o)
+	}
+
+	var problems []string
+	ticketedDays := make(map[string]map[uint32]int)
+	for i, t := range tickets {
+		obs := observed[plateRoad{t.Plate, t.Road}]
+		if !slices.Contains(obs, Observation{t.Road, t.Mile1, t.Plate, t.Timestamp1}) ||
+			!slices.Contains(obs, Observation{t.Road, t.Mile2, t.Plate, t.Timestamp2}) {
+			problems = append(problems, fmt.Sprintf("ticket %d %+v: no such observations", i, t))
+			continue
+		}
+		if t.Timestamp1 >= t.Timestamp2 {
+			problems = append(problems, fmt.Sprintf("ticket %d %+v: timestamps not in order", i, t))
+			continue
+		}
+		speed := averageSpeed(t.Mile1, t.Timestamp1, t.Mile2, t.Timestamp2)
+		if speed <= float64(limits[t.Road]) {
+			problems = append(problems, fmt.Sprintf("ticket %d %+v: %.2f mph is within limit %d", i, t, speed, limits[t.Road]))
+		}
+		// reported speed is rounded to hundredths of mph
+		if math.Abs(float64(t.Speed)-speed*100) > 0.5+1e-6 {
+			problems = append(problems, fmt.Sprintf("ticket %d %+v: reported speed, actual %.4f mph", i, t, speed))
+		}
+
+		days, ok := ticketedDays[t.Plate]
+		if !ok {
+			days = make(map[uint32]int)
+			ticketedDays[t.Plate] = days
+		}
+		for d := t.Timestamp1 / 86400; d <= t.Timestamp2/86400; d++ {
+			if prev, ok := days[d]; ok {
+				problems = append(problems, fmt.Sprintf("tickets %d and %d: %s ticketed twice on day %d", prev, i, t.Plate, d))
+			}
+			days[d] = i
+		}
+	}
+
+	var missing []string
+	for k, obs := range observed {
+		for _, o1 := range obs {
+			for _, o2 := range obs {
+				if o1.Timestamp >= o2.Timestamp {
+					continue
+				}
+				speed := averageSpeed(o1.Mile, o1.Timestamp, o2.Mile, o2.Timestamp)
+				if speed < float64(limits[k.road])+0.5 || covered(ticketedDays[k.plate], o1.Timestamp, o2.Timestamp) {
+					continue
+				}
+				missing = append(missing, fmt.Sprintf("missing ticket: %s on road %d drove %.2f mph between mile %d at %d and mile %d at %d",
+					k.plate, k.road, speed, o1.Mile, o1.Timestamp, o2.Mile, o2.Timestamp))
+			}
+		}
+	}
+	slices.Sort(missing)
+	return append(problems, missing...)
+}
+
+func averageSpeed(mile1 uint16, ts1 uint32, mile2 uint16, ts2 uint32) float64 {
+	distance := math.Abs(float64(mile2) - float64(mile1))
+	return distance * 3600 / math.Abs(float64(ts2)-float64(ts1))
+}
+
+// covered tells if some ticket already exists on any day between timestamps
+func covered(days map[uint32]int, ts1, ts2 uint32) bool {
+	for d := ts1 / 86400; d <= ts2/86400; d++ {
+		if _, ok := days[d]; ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bean/cmd/speedsim/sim"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+var addr = flag.String("addr", "localhost:4242", "Address of speed daemon")
+var roads = flag.String("roads", "123:60:0,8,9,25;368:50:10,15,40;5000:70:1,100", "Roads as road:limit:camera miles, separated by semicolons")
+var cars = flag.Int("cars", 200, "Number of cars, every car drives one trip per day")
+var days = flag.Int("days", 3, "Number of simulated days")
+var seed = flag.Uint64("seed", uint64(time.Now().UnixNano()), "Seed of generated traffic, the same seed gives the same traffic")
+var speeders = flag.Float64("speeders", 0.1, "Fraction of trips well above the speed limit")
+var late = flag.Float64("late", 0.05, "Fraction of observations sent late, after all others")
+var lateDelay = flag.Duration("late-delay", 500*time.Millisecond, "Pause before late observations are sent")
+var dispatchers = flag.Int("dispatchers", 2, "Number of dispatchers, each for every road")
+var settle = flag.Duration("settle", 2*time.Second, "How long to wait for more tickets after the last one")
+var timeout = flag.Duration("timeout", time.Minute, "Maximum duration of the run")
+var concurrent = flag.Bool("concurrent", false, "Send observations from all cameras at once instead of one by one")
+
+func main() {
+	flag.Parse()
+	roadSpecs, err := sim.ParseRoads(*roads)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	scenario := sim.Generate(sim.Config{
+		Roads:    roadSpecs,
+		Cars:     *cars,
+		Days:     *days,
+		Seed:     *seed,
+		Speeders: *speeders,
+		Late:     *late,
+	})
+	log.Printf("seed %d: %d observations, %d of them late\n", *seed, len(scenario.All()), len(scenario.Late))
+
+	tickets, err := sim.Run(*addr, scenario, sim.Options{
+		Dispatchers: *dispatchers,
+		LateDelay:   *lateDelay,
+		Settle:      *settle,
+		Timeout:     *timeout,
+		Concurrent:  *concurrent,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	problems := sim.Verify(scenario, tickets)
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	fmt.Printf("%d tickets received, %d problems\n", len(tickets), len(problems))
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+}
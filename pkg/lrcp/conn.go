@@ -0,0 +1,600 @@
+package lrcp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// initialRTO is retransmission timeout before first round trip is measured
+	initialRTO = time.Second
+	// minRTO and maxRTO bound retransmission timeout, backoff included
+	minRTO = 200 * time.Millisecond
+	maxRTO = 60 * time.Second
+	// window is how many packets can wait for acknowledgement at once
+	window = 16
+	// sessionExpiry closes session when peer stays silent this long
+	sessionExpiry = 60 * time.Second
+	// closeAttempts is how many times /close/ is sent before session ends
+	// without peer confirming it
+	closeAttempts = 3
+	// sendBuffer is how many written bytes can wait for acknowledgement
+	// before Write blocks
+	sendBuffer = 64 << 10
+	// writeChunk is most Write hands to session at once, so unacknowledged
+	// data never exceeds send buffer by more than that
+	writeChunk = MaxMessage
+)
+
+// discard is logger of sessions nobody asked to log
+var discard = log.New(io.Discard, "", 0)
+
+// orDiscard returns logger, or one throwing everything away when it's nil
+func orDiscard(logger *log.Logger) *log.Logger {
+	if logger == nil {
+		return discard
+	}
+	return logger
+}
+
+// timeouts of single session
+type timeouts struct {
+	initialRTO time.Duration
+	minRTO     time.Duration
+	window     int
+	buffer     int
+	expiry     time.Duration
+	// expireIdle ends session when peer is silent even if nothing waits for
+	// acknowledgement, server uses it to forget abandoned sessions
+	expireIdle bool
+}
+
+// newTimeouts uses protocol defaults in place of zero values
+func newTimeouts(retransmit, minRetransmit time.Duration, packets, buffer int, expiry time.Duration) timeouts {
+	t := timeouts{
+		initialRTO: orDefault(retransmit, initialRTO),
+		minRTO:     orDefault(minRetransmit, minRTO),
+		window:     window,
+		buffer:     sendBuffer,
+		expiry:     orDefault(expiry, sessionExpiry),
+	}
+	if packets > 0 {
+		t.window = packets
+	}
+	if buffer > 0 {
+		t.buffer = buffer
+	}
+	return t
+}
+
+// segment is data packet sent and not acknowledged yet
+type segment struct {
+	start, end int
+	sent       time.Time
+	// retransmitted segment is not used to measure round trip
+	retransmitted bool
+}
+
+// inboxSize is number of received messages waiting for session, more are
+// dropped just like datagrams lost on the way
+const inboxSize = 64
+
+// message received from peer
+type message struct {
+	t    Type
+	rest string
+}
+
+// Conn is single LRCP session. Read returns bytes peer sent in order, Write
+// queues bytes which are sent and retransmitted until peer acknowledges them,
+// it blocks while send buffer is full.
+// Session is driven by its own goroutine, methods only talk to it
+type Conn struct {
+	id         SessionID
+	remoteAddr *net.UDPAddr
+	ln         *net.UDPConn
+	timeouts   timeouts
+
+	// inbox keeps received messages in order they arrived
+	inbox     chan message
+	appChan   chan string
+	closeChan chan bool
+	// done is closed when session ended, for whatever reason
+	done chan struct{}
+	// onClose is called once session ended
+	onClose func()
+	logger  *log.Logger
+
+	readingOffset int
+
+	// ackLast is how much peer acknowledged, unacked holds written data from
+	// there on and inflight its packets sent so far, nextSend is offset of
+	// first byte not sent yet
+	ackLast  int
+	unacked  []byte
+	inflight []segment
+	nextSend int
+	rto      rtoEstimator
+	// rtoTimer runs while some segment waits for acknowledgement
+	rtoTimer *time.Timer
+	// closing session waits until peer acknowledges everything written,
+	// then sends /close/ until peer confirms it
+	closing    bool
+	closeSent  int
+	closeTimer <-chan time.Time
+	// lastHeard is when peer sent anything, waitingSince when data started
+	// waiting for acknowledgement with nothing outstanding before
+	lastHeard    time.Time
+	waitingSince time.Time
+
+	// received holds data peer sent which was not read yet
+	received     []byte
+	readDeadline time.Time
+	readable     chan struct{}
+	rmu          sync.Mutex
+
+	writeDeadline time.Time
+	// deadlineSet wakes up blocked Write, so it notices new deadline
+	deadlineSet chan struct{}
+	wmu         sync.Mutex
+}
+
+func newConn(id SessionID, ln *net.UDPConn, remoteAddr *net.UDPAddr, t timeouts, logger *log.Logger, onClose func()) *Conn {
+	return &Conn{
+		id:          id,
+		remoteAddr:  remoteAddr,
+		ln:          ln,
+		timeouts:    t,
+		rto:         newRTOEstimator(t.initialRTO, t.minRTO, maxRTO),
+		lastHeard:   time.Now(),
+		inbox:       make(chan message, inboxSize),
+		appChan:     make(chan string),
+		closeChan:   make(chan bool),
+		done:        make(chan struct{}),
+		onClose:     onClose,
+		logger:      logger,
+		readable:    make(chan struct{}, 1),
+		deadlineSet: make(chan struct{}, 1),
+	}
+}
+
+// deliver passes message received from peer to session, it does not wait
+// for session to process it
+func (c *Conn) deliver(t Type, rest string) {
+	select {
+	case c.inbox <- message{t, rest}:
+	default:
+		c.logger.Printf("session %d is not keeping up, dropping %s message\n", c.id, t)
+	}
+}
+
+// ended tells if session goroutine finished
+func (c *Conn) ended() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// requestClose asks session to end, notify sends /close/ to peer first
+func (c *Conn) requestClose(notify bool) {
+	select {
+	case c.closeChan <- notify:
+	case <-c.done:
+	}
+}
+
+func (c *Conn) act() {
+	for {
+		var expiry <-chan time.Time
+		var timer *time.Timer
+		if deadline, ok := c.expiryDeadline(); ok {
+			timer = time.NewTimer(time.Until(deadline))
+			expiry = timer.C
+		}
+		running := c.step(expiry)
+		if timer != nil {
+			timer.Stop()
+		}
+		if !running {
+			c.stopTimer()
+			return
+		}
+	}
+}
+
+// step handles single event, it returns false once session ended
+func (c *Conn) step(expiry <-chan time.Time) bool {
+	// writes wait while send buffer is full
+	var appChan chan string
+	if len(c.unacked) < c.timeouts.buffer {
+		appChan = c.appChan
+	}
+	select {
+	case m := <-c.inbox:
+		return c.handle(m)
+	case s := <-appChan:
+		if !c.outstanding() {
+			c.waitingSince = time.Now()
+		}
+		c.unacked = append(c.unacked, s...)
+		c.fill()
+	case <-c.timerC():
+		c.retransmit()
+	case notify := <-c.closeChan:
+		if !notify {
+			c.shutdown(false)
+			return false
+		}
+		c.closing = true
+		if len(c.unacked) == 0 && c.closeSent == 0 {
+			c.sendClose()
+		}
+	case <-c.closeTimer:
+		if c.closeSent >= closeAttempts {
+			c.logger.Printf("peer did not confirm close of %d\n", c.id)
+			c.shutdown(false)
+			return false
+		}
+		c.sendClose()
+	case <-expiry:
+		c.logger.Printf("session %d expired\n", c.id)
+		c.shutdown(true)
+		return false
+	}
+	return true
+}
+
+// outstanding tells if session waits for peer to acknowledge something
+func (c *Conn) outstanding() bool {
+	return len(c.unacked) > 0 || c.closeSent > 0
+}
+
+// expiryDeadline returns when session expires unless peer says something
+func (c *Conn) expiryDeadline() (time.Time, bool) {
+	if c.timeouts.expireIdle {
+		return c.lastHeard.Add(c.timeouts.expiry), true
+	}
+	if !c.outstanding() {
+		// nothing is expected from peer, idle client session lives forever
+		return time.Time{}, false
+	}
+	since := c.lastHeard
+	if c.waitingSince.After(since) {
+		since = c.waitingSince
+	}
+	return since.Add(c.timeouts.expiry), true
+}
+
+// sendClose sends /close/ and schedules sending it again
+func (c *Conn) sendClose() {
+	if c.closeSent == 0 {
+		c.waitingSince = time.Now()
+	}
+	c.closeSent++
+	c.send(fmt.Sprintf("/close/%d/", c.id))
+	c.closeTimer = time.After(c.rto.timeout())
+}
+
+// handle processes message from peer, it returns false when session ended
+func (c *Conn) handle(m message) bool {
+	c.lastHeard = time.Now()
+	switch m.t {
+	case Data:
+		pos, data, err := parseData(m.rest)
+		if err != nil {
+			c.logger.Printf("invalid data message for %d: %v\n", c.id, err)
+			return true
+		}
+		c.handleData(pos, data)
+	case Ack:
+		length, err := parseAck(m.rest)
+		if err != nil {
+			c.logger.Printf("invalid ack message for %d: %v\n", c.id, err)
+			return true
+		}
+		return c.handleAck(length)
+	case Close:
+		// confirm close started by peer, our own close is confirmed by this message
+		c.shutdown(c.closeSent == 0)
+		return false
+	}
+	return true
+}
+
+func (c *Conn) handleData(pos int, data string) {
+	if pos > c.readingOffset {
+		// previous data was lost, peer learns where to continue from
+		c.send(fmt.Sprintf("/ack/%d/%d/", c.id, c.readingOffset))
+		return
+	}
+	unescaped, err := unescapeMsg(data)
+	if err != nil {
+		c.logger.Printf("invalid data in message for %d: %v\n", c.id, err)
+		return
+	}
+	newLength := pos + len(unescaped) - c.readingOffset
+	if newLength < 1 {
+		// duplicate, peer may have missed our ack
+		c.send(fmt.Sprintf("/ack/%d/%d/", c.id, c.readingOffset))
+		return
+	}
+
+	c.readingOffset += newLength
+	c.send(fmt.Sprintf("/ack/%d/%d/", c.id, c.readingOffset))
+	c.receive(unescaped[len(unescaped)-newLength:])
+}
+
+// handleAck processes cumulative acknowledgement, it returns false when peer
+// misbehaved and session was ended
+func (c *Conn) handleAck(ackLen int) bool {
+	if ackLen <= c.ackLast {
+		// duplicate ack, nothing to do
+		return true
+	}
+	if ackLen > c.nextSend {
+		// peer is misbehaving, close connection
+		c.shutdown(true)
+		return false
+	}
+
+	now := time.Now()
+	acked := 0
+	for acked < len(c.inflight) && c.inflight[acked].end <= ackLen {
+		if seg := c.inflight[acked]; !seg.retransmitted {
+			c.rto.sample(now.Sub(seg.sent))
+		}
+		acked++
+	}
+	c.rto.recover()
+	c.inflight = slices.Delete(c.inflight, 0, acked)
+	if len(c.inflight) > 0 {
+		// peer accepted part of the packet, only the rest is sent again
+		c.inflight[0].start = max(c.inflight[0].start, ackLen)
+	}
+	c.unacked = c.unacked[ackLen-c.ackLast:]
+	c.ackLast = ackLen
+
+	// acknowledged progress restarts retransmission timer
+	c.stopTimer()
+	c.fill()
+	if c.closing && len(c.unacked) == 0 && c.closeSent == 0 {
+		c.sendClose()
+	}
+	return true
+}
+
+// shutdown ends session, it must be called only by act
+func (c *Conn) shutdown(notify bool) {
+	if notify {
+		c.send(fmt.Sprintf("/close/%d/", c.id))
+	}
+	close(c.done)
+	if c.onClose != nil {
+		c.onClose()
+	}
+}
+
+// receive makes data available to Read
+func (c *Conn) receive(data string) {
+	c.rmu.Lock()
+	c.received = append(c.received, data...)
+	c.rmu.Unlock()
+	select {
+	case c.readable <- struct{}{}:
+	default:
+	}
+}
+
+// fill sends written data not sent yet while window has room
+func (c *Conn) fill() {
+	end := c.ackLast + len(c.unacked)
+	for len(c.inflight) < c.timeouts.window && c.nextSend < end {
+		seg := segment{start: c.nextSend, sent: time.Now()}
+		seg.end = c.transmit(seg.start, end)
+		c.inflight = append(c.inflight, seg)
+		c.nextSend = seg.end
+	}
+	if len(c.inflight) > 0 && c.rtoTimer == nil {
+		c.rtoTimer = time.NewTimer(c.rto.timeout())
+	}
+}
+
+// retransmit sends every unacknowledged packet again after timeout, peer
+// drops packets following lost one, so all of them are likely lost
+func (c *Conn) retransmit() {
+	c.rtoTimer = nil
+	if len(c.inflight) == 0 {
+		return
+	}
+	c.rto.backoff()
+	c.logger.Printf("retransmitting %d packets of %d, next timeout %v\n", len(c.inflight), c.id, c.rto.timeout())
+	for i := range c.inflight {
+		seg := &c.inflight[i]
+		// packet shrinks when its start moved, so it still fits into one message
+		c.transmit(seg.start, seg.end)
+		seg.retransmitted = true
+	}
+	c.rtoTimer = time.NewTimer(c.rto.timeout())
+}
+
+// transmit sends data from start up to end or as much as fits into single
+// message, it returns offset right after last sent byte
+func (c *Conn) transmit(start, end int) int {
+	header := fmt.Sprintf("/data/%d/%d/", c.id, start)
+	// whole message including final slash must be shorter than MaxMessage
+	data := string(c.unacked[start-c.ackLast : end-c.ackLast])
+	escaped, n := escapeFrom(data, 0, MaxMessage-len(header)-2)
+	c.send(header + escaped + "/")
+	return start + n
+}
+
+// timerC returns channel of retransmission timer, nil when it's not running
+func (c *Conn) timerC() <-chan time.Time {
+	if c.rtoTimer == nil {
+		return nil
+	}
+	return c.rtoTimer.C
+}
+
+func (c *Conn) stopTimer() {
+	if c.rtoTimer != nil {
+		c.rtoTimer.Stop()
+		c.rtoTimer = nil
+	}
+}
+
+func (c *Conn) send(msg string) {
+	if _, err := c.ln.WriteToUDP([]byte(msg), c.remoteAddr); err != nil {
+		c.logger.Printf("could not send %q to %d: %v\n", msg, c.id, err)
+	}
+}
+
+// Read reads data sent by peer, it returns io.EOF once session is closed
+// and everything received was read
+func (c *Conn) Read(p []byte) (int, error) {
+	for {
+		c.rmu.Lock()
+		if len(c.received) > 0 {
+			n := copy(p, c.received)
+			c.received = c.received[n:]
+			c.rmu.Unlock()
+			return n, nil
+		}
+		deadline := c.readDeadline
+		c.rmu.Unlock()
+
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if !deadline.IsZero() {
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+		err := c.wait(timeout)
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// wait blocks until there may be something to read, it returns error when
+// there is nothing more to read or deadline passed
+func (c *Conn) wait(timeout <-chan time.Time) error {
+	select {
+	case <-c.readable:
+		return nil
+	case <-c.done:
+		c.rmu.Lock()
+		defer c.rmu.Unlock()
+		if len(c.received) == 0 {
+			return io.EOF
+		}
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// Write queues data for sending, it returns once session accepted it, not
+// when peer acknowledged it. It blocks while send buffer is full, until
+// peer acknowledges enough or write deadline passes
+func (c *Conn) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		c.wmu.Lock()
+		deadline := c.writeDeadline
+		c.wmu.Unlock()
+
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if !deadline.IsZero() {
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				return written, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+		chunk := p[written:min(len(p), written+writeChunk)]
+		var err error
+		select {
+		case c.appChan <- string(chunk):
+			written += len(chunk)
+		case <-c.deadlineSet:
+		case <-c.done:
+			err = net.ErrClosed
+		case <-timeout:
+			err = os.ErrDeadlineExceeded
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Close waits until peer acknowledges everything written, then sends /close/
+// until peer confirms it. Data is lost only when session expires first
+func (c *Conn) Close() error {
+	if c.ended() {
+		return net.ErrClosed
+	}
+	c.requestClose(true)
+	<-c.done
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.ln.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	return errors.Join(c.SetReadDeadline(t), c.SetWriteDeadline(t))
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.rmu.Lock()
+	c.readDeadline = t
+	c.rmu.Unlock()
+	// wake up blocked Read, so it notices new deadline
+	select {
+	case c.readable <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// SetWriteDeadline limits how long Write waits for room in send buffer
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.wmu.Lock()
+	c.writeDeadline = t
+	c.wmu.Unlock()
+	select {
+	case c.deadlineSet <- struct{}{}:
+	default:
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package lrcp
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand/v2"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	// connectTimeout is how long Dial waits for server to acknowledge connect
+	connectTimeout = 10 * time.Second
+	// connectRetry is how often connect is sent again while waiting
+	connectRetry = time.Second
+)
+
+// Dialer opens client sessions, zero value uses protocol defaults
+type Dialer struct {
+	// Timeout limits waiting for server to acknowledge connect
+	Timeout time.Duration
+	// ConnectRetry is interval between repeated connects
+	ConnectRetry time.Duration
+	// Retransmit is retransmission timeout until round trip is measured,
+	// MinRetransmit bounds timeout computed from measured round trips
+	Retransmit    time.Duration
+	MinRetransmit time.Duration
+	// Window is how many packets can wait for acknowledgement at once
+	Window int
+	// SendBuffer is how many written bytes can wait for acknowledgement,
+	// Write blocks while it's full
+	SendBuffer int
+	// Expiry ends session when server does not answer for this long while
+	// data or close waits for it, idle session never expires
+	Expiry time.Duration
+	// Logger receives events like retransmissions or expiry of session,
+	// nothing is logged when it's nil
+	Logger *log.Logger
+}
+
+// Dial opens session with LRCP server at UDP address using default Dialer
+func Dial(addr string) (*Conn, error) {
+	var d Dialer
+	return d.Dial(addr)
+}
+
+// Dial opens session with LRCP server at UDP address, session uses its own
+// socket which is closed when session ends
+func (d *Dialer) Dial(addr string) (*Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("resolve %s: %w", addr, err)
+	}
+	ln, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, fmt.Errorf("listen: %w", err)
+	}
+
+	id := SessionID(rand.Int32N(math.MaxInt32))
+	if err := d.handshake(ln, raddr, id); err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	t := newTimeouts(d.Retransmit, d.MinRetransmit, d.Window, d.SendBuffer, d.Expiry)
+	c := newConn(id, ln, raddr, t, orDiscard(d.Logger), func() { ln.Close() })
+	go c.act()
+	go clientLoop(ln, raddr, c)
+	return c, nil
+}
+
+func orDefault(d, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return d
+}
+
+// handshake sends connect until it's acknowledged or Timeout passes
+func (d *Dialer) handshake(ln *net.UDPConn, raddr *net.UDPAddr, id SessionID) error {
+	deadline := time.Now().Add(orDefault(d.Timeout, connectTimeout))
+	retry := orDefault(d.ConnectRetry, connectRetry)
+	defer ln.SetReadDeadline(time.Time{})
+
+	connect := []byte(fmt.Sprintf("/connect/%d/", id))
+	buffer := make([]byte, MaxMessage)
+	for attempt := 1; ; attempt++ {
+		if _, err := ln.WriteToUDP(connect, raddr); err != nil {
+			return fmt.Errorf("connect: %w", err)
+		}
+		wait := time.Now().Add(retry)
+		if wait.After(deadline) {
+			wait = deadline
+		}
+		if err := ln.SetReadDeadline(wait); err != nil {
+			return err
+		}
+		for {
+			n, from, err := ln.ReadFromUDP(buffer)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("connect: %w", err)
+			}
+			if !sameAddr(from, raddr) {
+				continue
+			}
+			mtype, session, rest, err := ParseMessage(string(buffer[:n]))
+			if err != nil || session != id {
+				continue
+			}
+			switch {
+			case mtype == Ack && rest == "0":
+				return nil
+			case mtype == Close:
+				return errors.New("connect: server closed session")
+			}
+		}
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("connect: no answer from %s after %d attempts: %w", raddr, attempt, os.ErrDeadlineExceeded)
+		}
+	}
+}
+
+// clientLoop passes datagrams from server to session until socket is closed
+func clientLoop(ln *net.UDPConn, raddr *net.UDPAddr, c *Conn) {
+	buffer := make([]byte, MaxMessage+100)
+	for {
+		n, from, err := ln.ReadFromUDP(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			c.logger.Printf("could not read datagram: %v\n", err)
+			continue
+		}
+		if n >= MaxMessage || !sameAddr(from, raddr) {
+			continue
+		}
+		mtype, session, rest, err := ParseMessage(string(buffer[:n]))
+		if err != nil || session != c.id {
+			continue
+		}
+		c.deliver(mtype, rest)
+	}
+}
+
+func sameAddr(a, b *net.UDPAddr) bool {
+	return a.Port == b.Port && (a.IP.Equal(b.IP) || b.IP.IsUnspecified() || b.IP == nil)
+}
@@ -0,0 +1,413 @@
+package lrcp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer is raw UDP socket playing server side of the protocol by hand
+type fakeServer struct {
+	t    *testing.T
+	ln   *net.UDPConn
+	peer *net.UDPAddr
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	t.Helper()
+	ln, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return &fakeServer{t: t, ln: ln}
+}
+
+func (f *fakeServer) addr() string {
+	return f.ln.LocalAddr().String()
+}
+
+// recv returns next message from client
+func (f *fakeServer) recv() (Type, SessionID, string) {
+	f.t.Helper()
+	_ = f.ln.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 2000)
+	n, from, err := f.ln.ReadFromUDP(buf)
+	if err != nil {
+		f.t.Fatalf("unexpected error: %v\n", err)
+	}
+	if n >= MaxMessage {
+		f.t.Errorf("got %d bytes long message\n", n)
+	}
+	f.peer = from
+	mtype, id, rest, err := ParseMessage(string(buf[:n]))
+	if err != nil {
+		f.t.Fatalf("%q: unexpected error: %v\n", buf[:n], err)
+	}
+	return mtype, id, rest
+}
+
+// recvType skips messages until one of given type arrives
+func (f *fakeServer) recvType(want Type) (SessionID, string) {
+	f.t.Helper()
+	for {
+		mtype, id, rest := f.recv()
+		if mtype == want {
+			return id, rest
+		}
+	}
+}
+
+func (f *fakeServer) send(format string, args ...any) {
+	f.t.Helper()
+	if _, err := f.ln.WriteToUDP([]byte(fmt.Sprintf(format, args...)), f.peer); err != nil {
+		f.t.Fatalf("unexpected error: %v\n", err)
+	}
+}
+
+// dial connects Dialer to fake server, it acknowledges connect
+func (f *fakeServer) dial(d *Dialer) (*Conn, SessionID) {
+	f.t.Helper()
+	type result struct {
+		conn *Conn
+		err  error
+	}
+	res := make(chan result, 1)
+	go func() {
+		conn, err := d.Dial(f.addr())
+		res <- result{conn, err}
+	}()
+	id, _ := f.recvType(Connect)
+	f.send("/ack/%d/0/", id)
+	r := <-res
+	if r.err != nil {
+		f.t.Fatalf("unexpected error: %v\n", r.err)
+	}
+	f.t.Cleanup(func() { r.conn.requestClose(false) })
+	return r.conn, id
+}
+
+func TestDialRetriesConnect(t *testing.T) {
+	f := newFakeServer(t)
+	d := &Dialer{ConnectRetry: 20 * time.Millisecond}
+	res := make(chan error, 1)
+	go func() {
+		conn, err := d.Dial(f.addr())
+		if err == nil {
+			conn.requestClose(false)
+		}
+		res <- err
+	}()
+
+	// first connect is lost
+	first, _ := f.recvType(Connect)
+	second, _ := f.recvType(Connect)
+	if first != second {
+		t.Errorf("got sessions %d and %d, want the same\n", first, second)
+	}
+	f.send("/ack/%d/0/", second)
+	if err := <-res; err != nil {
+		t.Errorf("unexpected error: %v\n", err)
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	f := newFakeServer(t)
+	d := &Dialer{Timeout: 100 * time.Millisecond, ConnectRetry: 30 * time.Millisecond}
+
+	start := time.Now()
+	_, err := d.Dial(f.addr())
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("got %v, want deadline exceeded\n", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Dial took %v\n", elapsed)
+	}
+}
+
+func TestClientSendsData(t *testing.T) {
+	f := newFakeServer(t)
+	conn, id := f.dial(&Dialer{Retransmit: 50 * time.Millisecond})
+
+	want := strings.Repeat("ab/c\\", 700)
+	if _, err := conn.Write([]byte(want)); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+
+	// nothing is acknowledged at first, so everything is sent again
+	received := make(map[int]string)
+	sent := make(map[int]int)
+	for len(received) == 0 || sent[0] < 2 {
+		session, rest := f.recvType(Data)
+		if session != id {
+			t.Fatalf("got session %d, want %d\n", session, id)
+		}
+		pos, data, err := parseData(rest)
+		if err != nil {
+			t.Fatalf("unexpected error: %v\n", err)
+		}
+		unescaped, err := unescapeMsg(data)
+		if err != nil {
+			t.Fatalf("unexpected error: %v\n", err)
+		}
+		received[pos] = unescaped
+		sent[pos]++
+	}
+	// read rest of the first round, packets can't be lost on loopback
+	for total(received) < len(want) {
+		_, rest := f.recvType(Data)
+		pos, data, _ := parseData(rest)
+		received[pos], _ = unescapeMsg(data)
+	}
+	var got strings.Builder
+	for got.Len() < len(want) {
+		part, ok := received[got.Len()]
+		if !ok {
+			t.Fatalf("no packet at %d\n", got.Len())
+		}
+		got.WriteString(part)
+	}
+	if got.String() != want {
+		t.Errorf("data differs\n")
+	}
+	f.send("/ack/%d/%d/", id, len(want))
+
+	closed := make(chan error, 1)
+	go func() { closed <- conn.Close() }()
+	f.recvType(Close)
+	f.send("/close/%d/", id)
+	if err := <-closed; err != nil {
+		t.Errorf("unexpected error: %v\n", err)
+	}
+}
+
+// total counts distinct bytes in packets starting at 0
+func total(packets map[int]string) int {
+	n := 0
+	for {
+		p, ok := packets[n]
+		if !ok {
+			return n
+		}
+		n += len(p)
+	}
+}
+
+func TestClientReceivesData(t *testing.T) {
+	f := newFakeServer(t)
+	conn, id := f.dial(&Dialer{})
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	f.send("/data/%d/0/hi\\/there/", id)
+	if _, rest := f.recvType(Ack); rest != "8" {
+		t.Errorf("got ack %s, want 8\n", rest)
+	}
+	// duplicate and data from the future are acknowledged with what we have
+	f.send("/data/%d/0/hi\\/there/", id)
+	if _, rest := f.recvType(Ack); rest != "8" {
+		t.Errorf("got ack %s, want 8\n", rest)
+	}
+	f.send("/data/%d/100/lost/", id)
+	if _, rest := f.recvType(Ack); rest != "8" {
+		t.Errorf("got ack %s, want 8\n", rest)
+	}
+
+	buf := make([]byte, 100)
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "hi/there" {
+		t.Errorf("got %q %v, want %q\n", buf[:n], err, "hi/there")
+	}
+
+	// server closes session, client confirms it
+	f.send("/close/%d/", id)
+	f.recvType(Close)
+	if _, err := conn.Read(buf); !errors.Is(err, io.EOF) {
+		t.Errorf("got %v, want EOF\n", err)
+	}
+}
+
+func TestClientExpiry(t *testing.T) {
+	f := newFakeServer(t)
+	conn, id := f.dial(&Dialer{Retransmit: 20 * time.Millisecond, Expiry: 200 * time.Millisecond})
+
+	// idle session does not expire
+	time.Sleep(300 * time.Millisecond)
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if session, _ := f.recvType(Data); session != id {
+		t.Errorf("got session %d, want %d\n", session, id)
+	}
+
+	// server never acknowledges data
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("got %v, want EOF after expiry\n", err)
+	}
+	if _, err := conn.Write([]byte("x")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("got %v, want %v\n", err, net.ErrClosed)
+	}
+}
+
+func TestManyClients(t *testing.T) {
+	ln := listen(t, echo)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := Dial(ln.Addr().String())
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+			want := strings.Repeat(fmt.Sprintf("client %d/", i), 200)
+			if _, err := conn.Write([]byte(want)); err != nil {
+				errs <- err
+				return
+			}
+			got := make([]byte, len(want))
+			if _, err := io.ReadFull(conn, got); err != nil {
+				errs <- err
+				return
+			}
+			if string(got) != want {
+				errs <- fmt.Errorf("client %d: data differs", i)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// recvData returns position and unescaped data of next data message
+func (f *fakeServer) recvData() (int, string) {
+	f.t.Helper()
+	_, rest := f.recvType(Data)
+	pos, data, err := parseData(rest)
+	if err != nil {
+		f.t.Fatalf("unexpected error: %v\n", err)
+	}
+	unescaped, err := unescapeMsg(data)
+	if err != nil {
+		f.t.Fatalf("unexpected error: %v\n", err)
+	}
+	return pos, unescaped
+}
+
+// quiet fails when client sends anything within d
+func (f *fakeServer) quiet(d time.Duration) {
+	f.t.Helper()
+	_ = f.ln.SetReadDeadline(time.Now().Add(d))
+	buf := make([]byte, 2000)
+	if n, _, err := f.ln.ReadFromUDP(buf); err == nil {
+		f.t.Errorf("got unexpected %q\n", buf[:n])
+	}
+}
+
+func TestWindow(t *testing.T) {
+	f := newFakeServer(t)
+	conn, id := f.dial(&Dialer{Window: 2, Retransmit: 10 * time.Second})
+
+	data := strings.Repeat("x", 5000)
+	_, _ = conn.Write([]byte(data))
+
+	pos1, data1 := f.recvData()
+	pos2, data2 := f.recvData()
+	if pos1 != 0 || pos2 != len(data1) {
+		t.Fatalf("got packets at %d and %d\n", pos1, pos2)
+	}
+	// window is full until something is acknowledged
+	f.quiet(50 * time.Millisecond)
+
+	// cumulative ack of both packets lets two more go
+	f.send("/ack/%d/%d/", id, pos2+len(data2))
+	pos3, data3 := f.recvData()
+	pos4, _ := f.recvData()
+	if pos3 != pos2+len(data2) || pos4 != pos3+len(data3) {
+		t.Errorf("got packets at %d and %d\n", pos3, pos4)
+	}
+	f.quiet(50 * time.Millisecond)
+}
+
+func TestPartialAck(t *testing.T) {
+	f := newFakeServer(t)
+	conn, id := f.dial(&Dialer{Window: 1, Retransmit: 50 * time.Millisecond, MinRetransmit: 10 * time.Millisecond})
+
+	_, _ = conn.Write([]byte("hello world"))
+	if pos, data := f.recvData(); pos != 0 || data != "hello world" {
+		t.Fatalf("got %q at %d\n", data, pos)
+	}
+	// peer took only part of the packet, only the rest is retransmitted
+	f.send("/ack/%d/6/", id)
+	if pos, data := f.recvData(); pos != 6 || data != "world" {
+		t.Errorf("got %q at %d, want %q at 6\n", data, pos, "world")
+	}
+}
+
+func TestRetransmitBackoff(t *testing.T) {
+	f := newFakeServer(t)
+	conn, _ := f.dial(&Dialer{Retransmit: 40 * time.Millisecond, MinRetransmit: 10 * time.Millisecond})
+
+	_, _ = conn.Write([]byte("hello"))
+	var sent []time.Time
+	for range 5 {
+		if pos, _ := f.recvData(); pos != 0 {
+			t.Fatalf("got packet at %d, want 0\n", pos)
+		}
+		sent = append(sent, time.Now())
+	}
+	// 40ms, 80ms, 160ms, 320ms apart, anything much below is missing backoff
+	for i := 2; i < len(sent); i++ {
+		prev, gap := sent[i-1].Sub(sent[i-2]), sent[i].Sub(sent[i-1])
+		if gap < prev*3/2 {
+			t.Errorf("retransmission %d came %v after previous one, which came %v after its own\n", i, gap, prev)
+		}
+	}
+}
+
+func TestWriteBlocksOnFullBuffer(t *testing.T) {
+	f := newFakeServer(t)
+	conn, id := f.dial(&Dialer{SendBuffer: 100, Retransmit: 10 * time.Second})
+
+	_ = conn.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, err := conn.Write([]byte(strings.Repeat("x", 100))); err != nil || n != 100 {
+		t.Fatalf("got %d, %v, want 100 written\n", n, err)
+	}
+	// buffer is full until peer acknowledges something
+	n, err := conn.Write([]byte("y"))
+	if !isTimeout(err) || n != 0 {
+		t.Fatalf("got %d, %v, want timeout\n", n, err)
+	}
+
+	res := make(chan error, 1)
+	_ = conn.SetWriteDeadline(time.Time{})
+	go func() {
+		_, err := conn.Write([]byte("y"))
+		res <- err
+	}()
+	f.recvData()
+	f.send("/ack/%d/100/", id)
+	select {
+	case err := <-res:
+		if err != nil {
+			t.Errorf("unexpected error: %v\n", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("write did not resume after ack\n")
+	}
+}
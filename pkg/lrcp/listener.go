@@ -0,0 +1,231 @@
+package lrcp
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// acceptBacklog is number of new sessions waiting for Accept, connects
+// beyond it are ignored and peers retry them
+const acceptBacklog = 64
+
+// ListenConfig tunes sessions of Listener, zero value uses protocol defaults
+type ListenConfig struct {
+	// Retransmit is retransmission timeout until round trip is measured,
+	// MinRetransmit bounds timeout computed from measured round trips
+	Retransmit    time.Duration
+	MinRetransmit time.Duration
+	// Window is how many packets can wait for acknowledgement at once
+	Window int
+	// SendBuffer is how many written bytes can wait for acknowledgement,
+	// Write blocks while it's full
+	SendBuffer int
+	// Expiry ends session when peer stays silent this long
+	Expiry time.Duration
+	// Logger receives events like new and expired sessions or malformed
+	// datagrams, nothing is logged when it's nil
+	Logger *log.Logger
+}
+
+// packetBacklog is number of parsed datagrams waiting for loop
+const packetBacklog = 64
+
+// Listener accepts LRCP sessions arriving at single UDP socket.
+//
+// Session table has single owner, loop goroutine. It creates sessions
+// on connect, passes them messages and forgets them once their goroutine
+// reports it ended, be it by idle expiry, close from peer, misbehaving peer
+// or Close of the session. Datagrams are read by readLoop goroutine and
+// passed on in order they arrived.
+type Listener struct {
+	ln       *net.UDPConn
+	timeouts timeouts
+	logger   *log.Logger
+	// sessions is touched only by loop
+	sessions map[SessionID]*Conn
+	packets  chan packet
+	ended    chan *Conn
+	accept   chan *Conn
+	done     chan struct{}
+	// stopped is closed once every goroutine of listener and its sessions exited
+	stopped chan struct{}
+	once    sync.Once
+	wg      sync.WaitGroup
+}
+
+// packet is parsed datagram
+type packet struct {
+	t    Type
+	id   SessionID
+	rest string
+	from *net.UDPAddr
+}
+
+// Listen starts accepting sessions on UDP address using default ListenConfig
+func Listen(addr string) (*Listener, error) {
+	var lc ListenConfig
+	return lc.Listen(addr)
+}
+
+// Listen starts accepting sessions on UDP address
+func (lc *ListenConfig) Listen(addr string) (*Listener, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("resolve %s: %w", addr, err)
+	}
+	ln, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("listen on %s: %w", addr, err)
+	}
+	t := newTimeouts(lc.Retransmit, lc.MinRetransmit, lc.Window, lc.SendBuffer, lc.Expiry)
+	t.expireIdle = true
+	l := &Listener{
+		ln:       ln,
+		timeouts: t,
+		logger:   orDiscard(lc.Logger),
+		sessions: make(map[SessionID]*Conn),
+		packets:  make(chan packet, packetBacklog),
+		ended:    make(chan *Conn),
+		accept:   make(chan *Conn, acceptBacklog),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	l.wg.Add(1)
+	go l.readLoop()
+	go l.loop()
+	return l, nil
+}
+
+// Accept returns next new session
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting sessions and ends all of them without notifying
+// peers, it returns once every session goroutine exited
+func (l *Listener) Close() error {
+	err := net.ErrClosed
+	l.once.Do(func() {
+		close(l.done)
+		err = l.ln.Close()
+		<-l.stopped
+	})
+	return err
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.ln.LocalAddr()
+}
+
+// readLoop parses datagrams and passes them to loop until socket is closed
+func (l *Listener) readLoop() {
+	defer l.wg.Done()
+	buffer := make([]byte, MaxMessage+100)
+	for {
+		n, remoteAddr, err := l.ln.ReadFromUDP(buffer)
+		if err != nil {
+			select {
+			case <-l.done:
+				return
+			default:
+			}
+			l.logger.Printf("could not read datagram: %v\n", err)
+			continue
+		}
+		if n >= MaxMessage {
+			l.logger.Printf("dropping oversized message from %s\n", remoteAddr)
+			continue
+		}
+		mtype, session, rest, err := ParseMessage(string(buffer[:n]))
+		if err != nil {
+			l.logger.Printf("invalid message from %s: %v\n", remoteAddr, err)
+			continue
+		}
+		select {
+		case l.packets <- packet{mtype, session, rest, remoteAddr}:
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// loop owns session table, it dispatches packets to sessions and
+// removes ended ones until listener is closed
+func (l *Listener) loop() {
+	defer close(l.stopped)
+	for {
+		select {
+		case p := <-l.packets:
+			l.dispatch(p)
+		case c := <-l.ended:
+			// session with the same ID may have been created meanwhile
+			if l.sessions[c.id] == c {
+				delete(l.sessions, c.id)
+			}
+		case <-l.done:
+			for _, c := range l.sessions {
+				c.requestClose(false)
+			}
+			l.wg.Wait()
+			return
+		}
+	}
+}
+
+func (l *Listener) dispatch(p packet) {
+	if p.t == Connect {
+		l.connect(p.id, p.from)
+		return
+	}
+	c, ok := l.sessions[p.id]
+	if !ok || c.ended() {
+		// we don't track session associated with this ID, telling peer it's closed
+		l.send(fmt.Sprintf("/close/%d/", p.id), p.from)
+		return
+	}
+	c.deliver(p.t, p.rest)
+}
+
+// connect acknowledges connect and creates session if it's new
+func (l *Listener) connect(id SessionID, remoteAddr *net.UDPAddr) {
+	// session which ended, but was not removed yet, is replaced
+	if c, ok := l.sessions[id]; !ok || c.ended() {
+		c := newConn(id, l.ln, remoteAddr, l.timeouts, l.logger, nil)
+		select {
+		case l.accept <- c:
+		default:
+			l.logger.Printf("accept backlog full, ignoring connect of %d\n", id)
+			return
+		}
+		l.sessions[id] = c
+		l.wg.Add(1)
+		go l.run(c)
+		l.logger.Printf("created session %d for %s\n", id, remoteAddr)
+	}
+	l.send(fmt.Sprintf("/ack/%d/0/", id), remoteAddr)
+}
+
+// run drives session and reports its end to loop, which does not
+// listen anymore once listener is closed
+func (l *Listener) run(c *Conn) {
+	defer l.wg.Done()
+	c.act()
+	select {
+	case l.ended <- c:
+	case <-l.done:
+	}
+}
+
+func (l *Listener) send(msg string, remoteAddr *net.UDPAddr) {
+	if _, err := l.ln.WriteToUDP([]byte(msg), remoteAddr); err != nil {
+		l.logger.Printf("could not send %q: %v\n", msg, err)
+	}
+}
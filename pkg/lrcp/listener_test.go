@@ -0,0 +1,153 @@
+package lrcp
+
+import (
+	"bean/pkg/pserver"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// rawPeer speaks to listener with hand written datagrams
+type rawPeer struct {
+	t    *testing.T
+	conn *net.UDPConn
+}
+
+func newRawPeer(t *testing.T, addr net.Addr) *rawPeer {
+	t.Helper()
+	conn, err := net.DialUDP("udp", nil, addr.(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &rawPeer{t: t, conn: conn}
+}
+
+func (p *rawPeer) send(format string, args ...any) {
+	if _, err := fmt.Fprintf(p.conn, format, args...); err != nil {
+		p.t.Fatalf("unexpected error: %v\n", err)
+	}
+}
+
+// expect skips datagrams until wanted one arrives
+func (p *rawPeer) expect(want string) {
+	p.t.Helper()
+	_ = p.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 2000)
+	for {
+		n, err := p.conn.Read(buf)
+		if err != nil {
+			p.t.Fatalf("waiting for %q: %v\n", want, err)
+		}
+		if string(buf[:n]) == want {
+			return
+		}
+	}
+}
+
+func TestSessionLifecycle(t *testing.T) {
+	var tests = []struct {
+		name string
+		// end makes session end, session is closed by server afterwards
+		end func(p *rawPeer, conn net.Conn, id int)
+	}{
+		{"idle expiry", func(p *rawPeer, conn net.Conn, id int) {}},
+		{"peer close", func(p *rawPeer, conn net.Conn, id int) {
+			p.send("/close/%d/", id)
+		}},
+		{"misbehaving peer", func(p *rawPeer, conn net.Conn, id int) {
+			// acknowledges data server never sent
+			p.send("/ack/%d/100/", id)
+		}},
+		{"session close", func(p *rawPeer, conn net.Conn, id int) {
+			go conn.Close()
+			p.expect(fmt.Sprintf("/close/%d/", id))
+			p.send("/close/%d/", id)
+		}},
+	}
+	for i, tt := range tests {
+		lc := ListenConfig{Expiry: 200 * time.Millisecond}
+		ln, err := lc.Listen("127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("unexpected error: %v\n", err)
+		}
+		p := newRawPeer(t, ln.Addr())
+		id := 1000 + i
+		p.send("/connect/%d/", id)
+		p.expect(fmt.Sprintf("/ack/%d/0/", id))
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatalf("unexpected error: %v\n", err)
+		}
+		p.send("/data/%d/0/hi/", id)
+		p.expect(fmt.Sprintf("/ack/%d/2/", id))
+
+		tt.end(p, conn, id)
+		if tt.name != "session close" {
+			p.expect(fmt.Sprintf("/close/%d/", id))
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if got, err := io.ReadAll(conn); err != nil || string(got) != "hi" {
+			t.Errorf("%s: got %q and %v, want %q\n", tt.name, got, err, "hi")
+		}
+		// ended session is forgotten, so its messages are answered by close
+		p.send("/data/%d/2/x/", id)
+		p.expect(fmt.Sprintf("/close/%d/", id))
+		ln.Close()
+	}
+}
+
+func TestSessionIDReuse(t *testing.T) {
+	ln := listen(t, echo)
+	p := newRawPeer(t, ln.Addr())
+	for range 3 {
+		p.send("/connect/7/")
+		p.expect("/ack/7/0/")
+		p.send("/data/7/0/hi/")
+		p.expect("/data/7/0/hi/")
+		p.send("/close/7/")
+		p.expect("/close/7/")
+	}
+}
+
+func TestListenerCloseStopsGoroutines(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+
+	ln, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	served := make(chan error)
+	go func() { served <- pserver.Serve(ln, echo) }()
+
+	p := newRawPeer(t, ln.Addr())
+	for id := range 10 {
+		p.send("/connect/%d/", id)
+		p.expect(fmt.Sprintf("/ack/%d/0/", id))
+		p.send("/data/%d/0/x/", id)
+		p.expect(fmt.Sprintf("/data/%d/0/x/", id))
+	}
+	// some sessions end before listener does
+	for id := range 3 {
+		p.send("/close/%d/", id)
+		p.expect(fmt.Sprintf("/close/%d/", id))
+	}
+
+	if err := ln.Close(); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if err := <-served; err == nil {
+		t.Errorf("Serve did not fail after Close\n")
+	}
+	// echo handlers return once their sessions ended
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > baseline && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > baseline {
+		t.Errorf("got %d goroutines after Close, want %d\n", n, baseline)
+	}
+}
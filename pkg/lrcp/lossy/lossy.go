@@ -0,0 +1,290 @@
+// Package lossy is an in-process UDP proxy which drops, duplicates, reorders,
+// delays and corrupts datagrams, so LRCP can be tested against bad networks.
+// Faults are decided by RNGs seeded from Faults.Seed, one for each direction,
+// so same sequence of datagrams suffers the same faults every run.
+package lossy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+// holdLimit is how long reordered datagram waits for another one to overtake
+// it before it's sent anyway
+const holdLimit = 20 * time.Millisecond
+
+// Faults are probabilities of each fault happening to a datagram, applied
+// independently in both directions
+type Faults struct {
+	Drop      float64
+	Duplicate float64
+	// Reorder holds datagram back until the next one in the same direction
+	// has been sent
+	Reorder float64
+	// Corrupt cuts datagram short. LRCP has no checksum, but every message ends
+	// with slash, so truncated ones are always recognized and ignored
+	Corrupt float64
+	// Delay is the most any datagram is delayed, each gets random delay up to
+	// it, so delay reorders datagrams as well
+	Delay time.Duration
+	Seed  uint64
+	// Logger receives errors of proxy sockets, nothing is logged when it's nil
+	Logger *log.Logger
+}
+
+// Stats counts what happened to datagrams passing through proxy
+type Stats struct {
+	Forwarded  int
+	Dropped    int
+	Duplicated int
+	Reordered  int
+	Corrupted  int
+}
+
+// Proxy forwards datagrams from clients to target and answers back. Each
+// client gets its own socket towards target, so target sees them as
+// different peers.
+type Proxy struct {
+	faults Faults
+	ln     *net.UDPConn
+	target *net.UDPAddr
+	// rng of datagrams towards target and back to clients
+	rng     [2]*rand.Rand
+	clients map[string]*net.UDPConn
+	held    map[path]*heldDatagram
+	stats   Stats
+	done    chan struct{}
+	once    sync.Once
+	wg      sync.WaitGroup
+
+	mu sync.Mutex
+}
+
+// path is direction datagrams travel between client and target, only
+// datagrams on the same path are reordered
+type path struct {
+	client   string
+	toTarget bool
+}
+
+// heldDatagram waits to be sent after next datagram on the same path
+type heldDatagram struct {
+	send  func()
+	timer *time.Timer
+}
+
+// Listen starts proxy on loopback forwarding to target UDP address
+func Listen(target string, faults Faults) (*Proxy, error) {
+	raddr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		return nil, fmt.Errorf("resolve %s: %w", target, err)
+	}
+	ln, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, fmt.Errorf("listen: %w", err)
+	}
+	p := &Proxy{
+		faults: faults,
+		ln:     ln,
+		target: raddr,
+		rng: [2]*rand.Rand{
+			rand.New(rand.NewPCG(faults.Seed, 0)),
+			rand.New(rand.NewPCG(faults.Seed, 1)),
+		},
+		clients: make(map[string]*net.UDPConn),
+		held:    make(map[path]*heldDatagram),
+		done:    make(chan struct{}),
+	}
+	p.wg.Add(1)
+	go p.clientLoop()
+	return p, nil
+}
+
+// Addr is where clients send datagrams meant for target
+func (p *Proxy) Addr() net.Addr {
+	return p.ln.LocalAddr()
+}
+
+// Stats returns counts of datagrams so far
+func (p *Proxy) Stats() Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stats
+}
+
+// Close stops forwarding, datagrams still delayed or held are dropped
+func (p *Proxy) Close() error {
+	err := net.ErrClosed
+	p.once.Do(func() {
+		close(p.done)
+		err = p.ln.Close()
+		p.mu.Lock()
+		for _, up := range p.clients {
+			up.Close()
+		}
+		for _, h := range p.held {
+			h.timer.Stop()
+		}
+		p.mu.Unlock()
+		p.wg.Wait()
+	})
+	return err
+}
+
+// clientLoop forwards datagrams from clients to target
+func (p *Proxy) clientLoop() {
+	defer p.wg.Done()
+	buffer := make([]byte, 65536)
+	for {
+		n, from, err := p.ln.ReadFromUDP(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			p.logf("proxy read from %v: %v\n", from, err)
+			continue
+		}
+		up, err := p.upstream(from)
+		if err != nil {
+			p.logf("proxy could not open upstream for %s: %v\n", from, err)
+			continue
+		}
+		data := append([]byte(nil), buffer[:n]...)
+		p.forward(path{from.String(), true}, data, func(b []byte) { _, _ = up.Write(b) })
+	}
+}
+
+// logf logs through Faults.Logger, if there is any
+func (p *Proxy) logf(format string, args ...any) {
+	if p.faults.Logger != nil {
+		p.faults.Logger.Printf(format, args...)
+	}
+}
+
+// upstream returns socket forwarding datagrams of client to target, starting
+// its loop of answers when it's new
+func (p *Proxy) upstream(client *net.UDPAddr) (*net.UDPConn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if up, ok := p.clients[client.String()]; ok {
+		return up, nil
+	}
+	select {
+	case <-p.done:
+		return nil, net.ErrClosed
+	default:
+	}
+	up, err := net.DialUDP("udp", nil, p.target)
+	if err != nil {
+		return nil, err
+	}
+	p.clients[client.String()] = up
+	p.wg.Add(1)
+	go p.targetLoop(up, client)
+	return up, nil
+}
+
+// targetLoop forwards answers of target back to client
+func (p *Proxy) targetLoop(up *net.UDPConn, client *net.UDPAddr) {
+	defer p.wg.Done()
+	buffer := make([]byte, 65536)
+	for {
+		n, err := up.Read(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			// target may not listen yet or anymore, which is just another lost datagram
+			continue
+		}
+		data := append([]byte(nil), buffer[:n]...)
+		p.forward(path{client.String(), false}, data, func(b []byte) { _, _ = p.ln.WriteToUDP(b, client) })
+	}
+}
+
+// forward decides faults of datagram and sends it
+func (p *Proxy) forward(on path, data []byte, write func([]byte)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	rng := p.rng[0]
+	if !on.toTarget {
+		rng = p.rng[1]
+	}
+	chance := func(probability float64) bool {
+		return probability > 0 && rng.Float64() < probability
+	}
+
+	if chance(p.faults.Drop) {
+		p.stats.Dropped++
+		return
+	}
+	if len(data) > 0 && chance(p.faults.Corrupt) {
+		p.stats.Corrupted++
+		data = data[:rng.IntN(len(data))]
+	}
+	copies := 1
+	if chance(p.faults.Duplicate) {
+		p.stats.Duplicated++
+		copies = 2
+	}
+	var delay time.Duration
+	if p.faults.Delay > 0 {
+		delay = time.Duration(rng.Int64N(int64(p.faults.Delay)))
+	}
+	send := func() {
+		for range copies {
+			p.after(delay, func() { write(data) })
+		}
+	}
+	p.stats.Forwarded++
+
+	held := p.held[on]
+	if held == nil && chance(p.faults.Reorder) {
+		p.stats.Reordered++
+		h := &heldDatagram{send: send}
+		h.timer = time.AfterFunc(holdLimit, func() { p.release(on, h) })
+		p.held[on] = h
+		return
+	}
+	send()
+	if held != nil && held.timer.Stop() {
+		delete(p.held, on)
+		held.send()
+	}
+}
+
+// release sends held datagram nobody overtook in time
+func (p *Proxy) release(on path, h *heldDatagram) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.held[on] != h {
+		return
+	}
+	delete(p.held, on)
+	h.send()
+}
+
+// after runs write after delay unless proxy is closed, must be called with mu held
+func (p *Proxy) after(delay time.Duration, write func()) {
+	select {
+	case <-p.done:
+		return
+	default:
+	}
+	if delay == 0 {
+		write()
+		return
+	}
+	time.AfterFunc(delay, func() {
+		select {
+		case <-p.done:
+		default:
+			write()
+		}
+	})
+}
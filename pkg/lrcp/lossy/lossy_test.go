@@ -0,0 +1,167 @@
+package lossy
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// target answers every datagram with the same one and records what arrived
+type target struct {
+	ln *net.UDPConn
+
+	mu       sync.Mutex
+	received []string
+}
+
+func newTarget(t *testing.T) *target {
+	t.Helper()
+	ln, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	tg := &target{ln: ln}
+	go func() {
+		buf := make([]byte, 2000)
+		for {
+			n, from, err := ln.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			tg.mu.Lock()
+			tg.received = append(tg.received, string(buf[:n]))
+			tg.mu.Unlock()
+			_, _ = ln.WriteToUDP(buf[:n], from)
+		}
+	}()
+	return tg
+}
+
+// exchange sends n numbered datagrams through proxy with given faults, it
+// returns what target received, what came back to client and proxy stats
+func exchange(t *testing.T, faults Faults, n int) ([]string, []string, Stats) {
+	t.Helper()
+	tg := newTarget(t)
+	p, err := Listen(tg.ln.LocalAddr().String(), faults)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	defer p.Close()
+	conn, err := net.Dial("udp", p.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	defer conn.Close()
+
+	for _, msg := range numbered(n) {
+		_, _ = conn.Write([]byte(msg))
+		// datagrams are spaced out, so that only faults reorder them
+		time.Sleep(2 * time.Millisecond)
+	}
+	var back []string
+	buf := make([]byte, 2000)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		k, err := conn.Read(buf)
+		if err != nil {
+			break
+		}
+		back = append(back, string(buf[:k]))
+	}
+	tg.mu.Lock()
+	defer tg.mu.Unlock()
+	return tg.received, back, p.Stats()
+}
+
+func numbered(n int) []string {
+	var msgs []string
+	for i := range n {
+		msgs = append(msgs, fmt.Sprintf("/data/%d/", i))
+	}
+	return msgs
+}
+
+func TestFaults(t *testing.T) {
+	var tests = []struct {
+		name     string
+		faults   Faults
+		n        int
+		received []string
+		back     []string
+	}{
+		{"none", Faults{}, 4, numbered(4), numbered(4)},
+		{"drop", Faults{Drop: 1}, 4, nil, nil},
+		{
+			"duplicate", Faults{Duplicate: 1}, 2,
+			[]string{"/data/0/", "/data/0/", "/data/1/", "/data/1/"},
+			[]string{"/data/0/", "/data/0/", "/data/0/", "/data/0/", "/data/1/", "/data/1/", "/data/1/", "/data/1/"},
+		},
+		// every other datagram is overtaken by the next one, answers are
+		// swapped back on their way
+		{
+			"reorder", Faults{Reorder: 1}, 4,
+			[]string{"/data/1/", "/data/0/", "/data/3/", "/data/2/"},
+			numbered(4),
+		},
+	}
+	for _, tt := range tests {
+		received, back, _ := exchange(t, tt.faults, tt.n)
+		if !slices.Equal(received, tt.received) {
+			t.Errorf("%s: target got %q, want %q\n", tt.name, received, tt.received)
+		}
+		if !slices.Equal(back, tt.back) {
+			t.Errorf("%s: client got %q, want %q\n", tt.name, back, tt.back)
+		}
+	}
+}
+
+func TestCorrupt(t *testing.T) {
+	received, _, stats := exchange(t, Faults{Corrupt: 1, Seed: 1}, 20)
+	if stats.Corrupted < 20 || len(received) != 20 {
+		t.Fatalf("got %d corrupted and %d received, want at least 20 and 20\n", stats.Corrupted, len(received))
+	}
+	for i, got := range received {
+		sent := numbered(20)[i]
+		if len(got) >= len(sent) || !strings.HasPrefix(sent, got) {
+			t.Errorf("got %q, want it cut from %q\n", got, sent)
+		}
+	}
+}
+
+func TestDelay(t *testing.T) {
+	received, back, _ := exchange(t, Faults{Delay: 30 * time.Millisecond, Seed: 1}, 20)
+	if len(received) != 20 || len(back) != 20 {
+		t.Fatalf("got %d received and %d back, want 20 of both\n", len(received), len(back))
+	}
+	if slices.Equal(received, numbered(20)) {
+		t.Errorf("delays up to 30ms did not reorder datagrams 2ms apart\n")
+	}
+	slices.Sort(back)
+	want := numbered(20)
+	slices.Sort(want)
+	if !slices.Equal(back, want) {
+		t.Errorf("got %q, want %q\n", back, want)
+	}
+}
+
+func TestSeed(t *testing.T) {
+	faults := Faults{Drop: 0.5, Seed: 42}
+	first, _, stats := exchange(t, faults, 40)
+	second, _, _ := exchange(t, faults, 40)
+	if !slices.Equal(first, second) {
+		t.Errorf("same seed dropped different datagrams: %q and %q\n", first, second)
+	}
+	if stats.Dropped == 0 || len(first) == 40 {
+		t.Errorf("got %d dropped, want some\n", stats.Dropped)
+	}
+
+	faults.Seed = 43
+	if other, _, _ := exchange(t, faults, 40); slices.Equal(first, other) {
+		t.Errorf("different seeds dropped the same datagrams\n")
+	}
+}
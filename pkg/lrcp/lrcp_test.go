@@ -0,0 +1,104 @@
+package lrcp
+
+import (
+	"bean/pkg/pserver"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listen starts server running handler on loopback, it's closed with the test
+func listen(t *testing.T, handler pserver.HandlerFunc) *Listener {
+	t.Helper()
+	ln, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go pserver.Serve(ln, handler)
+	return ln
+}
+
+// echo is the same handler smoketest runs over TCP
+func echo(conn net.Conn) {
+	defer conn.Close()
+	_, _ = io.Copy(conn, conn)
+}
+
+func TestEcho(t *testing.T) {
+	ln := listen(t, echo)
+
+	conn, err := Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// several packets worth of data which needs escaping
+	want := []byte(strings.Repeat("hello/world\\", 500))
+	if _, err := conn.Write(want); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("echoed data differs\n")
+	}
+}
+
+func TestPeerClose(t *testing.T) {
+	accepted := make(chan net.Conn, 1)
+	ln := listen(t, func(conn net.Conn) { accepted <- conn })
+
+	conn, err := Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	server := <-accepted
+	_ = server.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write([]byte("bye")); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	// Close waits until written data is acknowledged
+	if err := conn.Close(); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	got, err := io.ReadAll(server)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	if string(got) != "bye" {
+		t.Errorf("got %q, want %q\n", got, "bye")
+	}
+	if _, err := server.Write([]byte("x")); err == nil {
+		t.Errorf("write to closed session succeeded\n")
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	ln := listen(t, echo)
+	conn, err := Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	defer conn.Close()
+
+	_ = conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 1)); !isTimeout(err) {
+		t.Errorf("got %v, want timeout\n", err)
+	}
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	ok := err != nil && errors.As(err, &ne)
+	return ok && ne.Timeout()
+}
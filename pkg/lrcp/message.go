@@ -0,0 +1,146 @@
+// Package lrcp implements Line Reversal Control Protocol, reliable ordered
+// byte streams over UDP. Sessions are exposed as net.Conn and Listener as
+// net.Listener, so handlers written for TCP run over LRCP unchanged.
+package lrcp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MaxMessage is protocol limit, every message must be shorter than this
+const MaxMessage = 1000
+
+type Type string
+
+const (
+	Connect Type = "connect"
+	Data    Type = "data"
+	Ack     Type = "ack"
+	Close   Type = "close"
+)
+
+type SessionID int
+
+func ParseMessage(msg string) (Type, SessionID, string, error) {
+	var t Type
+	var s SessionID
+
+	msgLen := len(msg)
+
+	if msgLen < 2 || msg[0] != '/' || msg[msgLen-1] != '/' {
+		return t, s, "", fmt.Errorf("first and last character must be slash")
+	}
+
+	parts := strings.SplitN(msg[1:msgLen-1], "/", 3)
+	if len(parts) < 2 {
+		return t, s, "", fmt.Errorf("message needs at least 2 parts")
+	}
+
+	switch parts[0] {
+	case "connect":
+		t = Connect
+	case "data":
+		t = Data
+	case "ack":
+		t = Ack
+	case "close":
+		t = Close
+	default:
+		return t, s, "", fmt.Errorf("unknown message type %q", parts[0])
+	}
+
+	sessionNum, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return t, s, "", fmt.Errorf("could not parse session: %v", err)
+	}
+
+	if sessionNum >= 2147483648 || sessionNum < 0 {
+		return t, s, "", fmt.Errorf("invalid session id: %d", sessionNum)
+	}
+	s = SessionID(sessionNum)
+
+	rest := ""
+	if len(parts) > 2 {
+		rest = parts[2]
+	}
+
+	return t, s, rest, nil
+}
+
+func parseData(rest string) (int, string, error) {
+	parts := strings.SplitN(rest, "/", 2)
+	if len(parts) != 2 {
+		return 0, "", fmt.Errorf("invalid data message")
+	}
+
+	pos, err := strconv.Atoi(parts[0])
+	if err != nil || pos < 0 {
+		return 0, "", fmt.Errorf("invalid data position %q", parts[0])
+	}
+	data := parts[1]
+
+	return pos, data, nil
+}
+
+func parseAck(rest string) (int, error) {
+	length, err := strconv.Atoi(rest)
+	if err != nil || length < 0 {
+		return 0, fmt.Errorf("invalid ack length %q", rest)
+	}
+	return length, nil
+}
+
+func unescapeMsg(s string) (string, error) {
+	var sb strings.Builder
+	escaping := false
+
+	for i := range len(s) {
+		c := s[i]
+		if escaping {
+			if c == '\\' || c == '/' {
+				sb.WriteByte(c)
+				escaping = false
+			} else {
+				return "", fmt.Errorf("illegal backslash in data")
+			}
+		} else {
+			switch c {
+			case '\\':
+				escaping = true
+			case '/':
+				return "", fmt.Errorf("illegal slash in data")
+			default:
+				sb.WriteByte(c)
+			}
+		}
+	}
+	if escaping {
+		return "", fmt.Errorf("unterminated backslash in data")
+	}
+
+	return sb.String(), nil
+}
+
+// escapeFrom escapes data starting at offset while escaped form fits into limit
+// bytes, it returns escaped data and offset right after last escaped byte
+func escapeFrom(data string, offset, limit int) (string, int) {
+	var sb strings.Builder
+	for offset < len(data) {
+		next := data[offset]
+		size := 1
+		if next == '\\' || next == '/' {
+			size = 2
+		}
+		if sb.Len()+size > limit {
+			break
+		}
+		if size == 2 {
+			sb.WriteByte('\\')
+		}
+		sb.WriteByte(next)
+		offset++
+	}
+	return sb.String(), offset
+}
@@ -0,0 +1,85 @@
+package lrcp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseMessage(t *testing.T) {
+	validDataMessage := "/data/1234/0/Hello world!/"
+
+	tp, s, rest, err := ParseMessage(validDataMessage)
+
+	if err != nil {
+		t.Errorf("Unexpected error: %v\n", err)
+	}
+
+	wantRest := `0/Hello world!`
+	if rest != wantRest {
+		t.Errorf("got %q, want %q\n", rest, wantRest)
+	}
+
+	if tp != Type("data") {
+		t.Errorf("Wrong type: %q\n", err)
+	}
+
+	if s != SessionID(1234) {
+		t.Errorf("Wrong session: %d\n", s)
+	}
+
+	invalidMessage := "/data/0x12/1/o7/"
+	_, _, _, err = ParseMessage(invalidMessage)
+
+	if err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestUnescape(t *testing.T) {
+	msg := "\\/"
+
+	if len(msg) != 2 {
+		t.Errorf("I don't understand strings, len: %d\n", len(msg))
+	}
+
+	unescaped, err := unescapeMsg(msg)
+
+	if err != nil {
+		t.Errorf("unexpected error: %v\n", err)
+	}
+
+	want := "/"
+	if unescaped != want {
+		t.Errorf("unescaped: %v\n", unescaped)
+	}
+}
+
+func TestEscapeFrom(t *testing.T) {
+	data := strings.Repeat("a/b\\", 300)
+
+	var got strings.Builder
+	for offset := 0; offset < len(data); {
+		escaped, next := escapeFrom(data, offset, 101)
+		if len(escaped) > 101 {
+			t.Errorf("at %d: got %d escaped bytes, want at most 101\n", offset, len(escaped))
+		}
+		unescaped, err := unescapeMsg(escaped)
+		if err != nil {
+			t.Fatalf("unexpected error: %v\n", err)
+		}
+		if len(unescaped) != next-offset {
+			t.Errorf("at %d: got %d bytes, want %d\n", offset, len(unescaped), next-offset)
+		}
+		got.WriteString(unescaped)
+		offset = next
+	}
+	if got.String() != data {
+		t.Errorf("escaped data does not round trip\n")
+	}
+
+	for _, bad := range []string{"a/b", "a\\b", "a\\"} {
+		if _, err := unescapeMsg(bad); err == nil {
+			t.Errorf("%q: expected error\n", bad)
+		}
+	}
+}
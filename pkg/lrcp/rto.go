@@ -0,0 +1,67 @@
+package lrcp
+
+import "time"
+
+// clockGranularity is G from RFC 6298, smallest variance term of timeout
+const clockGranularity = time.Millisecond
+
+// rtoEstimator computes retransmission timeout from measured round trip
+// times as described in RFC 6298. It's owned by session goroutine
+type rtoEstimator struct {
+	srtt     time.Duration
+	rttvar   time.Duration
+	rto      time.Duration
+	initial  time.Duration
+	min      time.Duration
+	max      time.Duration
+	measured bool
+}
+
+func newRTOEstimator(initial, min, max time.Duration) rtoEstimator {
+	e := rtoEstimator{initial: initial, min: min, max: max}
+	e.recover()
+	return e
+}
+
+// sample updates estimate with round trip time of packet which was sent only
+// once, retransmitted packets must not be sampled (Karn's algorithm)
+func (e *rtoEstimator) sample(r time.Duration) {
+	if !e.measured {
+		e.srtt = r
+		e.rttvar = r / 2
+		e.measured = true
+	} else {
+		delta := e.srtt - r
+		if delta < 0 {
+			delta = -delta
+		}
+		// beta = 1/4, alpha = 1/8
+		e.rttvar = (3*e.rttvar + delta) / 4
+		e.srtt = (7*e.srtt + r) / 8
+	}
+	e.recover()
+}
+
+// backoff doubles timeout after it expired, new sample resets it
+func (e *rtoEstimator) backoff() {
+	e.rto = e.clamp(2 * e.rto)
+}
+
+// recover ends backoff, it's called when peer acknowledges new data even if
+// none of it could be sampled. LRCP has no timestamps to time retransmitted
+// packets, so once all of them were retransmitted, timeout would only grow
+func (e *rtoEstimator) recover() {
+	if !e.measured {
+		e.rto = e.clamp(e.initial)
+		return
+	}
+	e.rto = e.clamp(e.srtt + max(clockGranularity, 4*e.rttvar))
+}
+
+func (e *rtoEstimator) timeout() time.Duration {
+	return e.rto
+}
+
+func (e *rtoEstimator) clamp(d time.Duration) time.Duration {
+	return min(max(d, e.min), e.max)
+}
@@ -0,0 +1,72 @@
+package lrcp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRTOEstimator(t *testing.T) {
+	ms := time.Millisecond
+	e := newRTOEstimator(time.Second, 200*ms, 60*time.Second)
+	if got := e.timeout(); got != time.Second {
+		t.Errorf("initial: got %v, want 1s\n", got)
+	}
+
+	var tests = []struct {
+		sample time.Duration
+		srtt   time.Duration
+		rttvar time.Duration
+		rto    time.Duration
+	}{
+		// first measurement: srtt = R, rttvar = R/2
+		{100 * ms, 100 * ms, 50 * ms, 300 * ms},
+		// rttvar = 3/4*50 + 1/4*|100-300|, srtt = 7/8*100 + 1/8*300
+		{300 * ms, 125 * ms, 87500 * time.Microsecond, 475 * ms},
+		// stable round trips bring timeout down to the minimum
+		{125 * ms, 125 * ms, 65625 * time.Microsecond, 387500 * time.Microsecond},
+	}
+	for i, tt := range tests {
+		e.sample(tt.sample)
+		if e.srtt != tt.srtt || e.rttvar != tt.rttvar || e.timeout() != tt.rto {
+			t.Errorf("sample %d: got srtt %v rttvar %v rto %v, want %v %v %v\n",
+				i, e.srtt, e.rttvar, e.timeout(), tt.srtt, tt.rttvar, tt.rto)
+		}
+	}
+	for range 50 {
+		e.sample(10 * ms)
+	}
+	if got := e.timeout(); got != 200*ms {
+		t.Errorf("got %v, want minimum 200ms\n", got)
+	}
+
+	for _, want := range []time.Duration{400 * ms, 800 * ms, 1600 * ms} {
+		e.backoff()
+		if got := e.timeout(); got != want {
+			t.Errorf("backoff: got %v, want %v\n", got, want)
+		}
+	}
+	for range 10 {
+		e.backoff()
+	}
+	if got := e.timeout(); got != 60*time.Second {
+		t.Errorf("got %v, want maximum 60s\n", got)
+	}
+	// new measurement ends backoff
+	e.sample(10 * ms)
+	if got := e.timeout(); got != 200*ms {
+		t.Errorf("after backoff: got %v, want 200ms\n", got)
+	}
+
+	// acknowledged progress ends backoff without measurement too
+	e.backoff()
+	e.recover()
+	if got := e.timeout(); got != 200*ms {
+		t.Errorf("after recover: got %v, want 200ms\n", got)
+	}
+	unmeasured := newRTOEstimator(time.Second, 200*ms, 60*time.Second)
+	unmeasured.backoff()
+	unmeasured.recover()
+	if got := unmeasured.timeout(); got != time.Second {
+		t.Errorf("after recover: got %v, want initial 1s\n", got)
+	}
+}
@@ -0,0 +1,17 @@
+package pserver
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// WriteJSON answers HTTP request with v encoded as JSON, admin APIs of the
+// servers use it for every response
+func WriteJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("could not write JSON response: %v\n", err)
+	}
+}
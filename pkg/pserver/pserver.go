@@ -1,6 +1,7 @@
 package pserver
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -10,6 +11,10 @@ type HandlerFunc func(conn net.Conn)
 
 type UDPHandlerFunc func(msg string) string
 
+// UDPMultiHandlerFunc can answer single request with many datagrams, each
+// element of returned slice is sent separately
+type UDPMultiHandlerFunc func(msg string) []string
+
 type Middleware func(next HandlerFunc) HandlerFunc
 
 // ListenServe is responsible for starting the sever and listening on the given port
@@ -20,10 +25,20 @@ func ListenServe(handler HandlerFunc, port int) error {
 		return fmt.Errorf("Failed to bind to port %d, %w", port, err)
 	}
 	log.Printf("Server started successfully, running at port: %d\n", port)
+	return Serve(ln, handler)
+}
+
+// Serve runs handler for every connection accepted by ln until ln is closed,
+// so handlers work the same over any stream transport, not only TCP
+func Serve(ln net.Listener, handler HandlerFunc) error {
 	for {
 		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return err
+		}
 		if err != nil {
 			log.Printf("Cannot accept connection: %v\n", err)
+			continue
 		}
 		go func() {
 			handler(conn)
@@ -32,28 +47,17 @@ func ListenServe(handler HandlerFunc, port int) error {
 }
 
 func ListenServeUDP(handler UDPHandlerFunc, port int) error {
-	addr := fmt.Sprintf(":%d", port)
-	udpAddr, err := net.ResolveUDPAddr("udp", addr)
-	ln, err := net.ListenUDP("udp", udpAddr)
-	if err != nil {
-		return fmt.Errorf("listenUPD on port %d: %w", port, err)
-	}
-	log.Printf("server started successfully, running at port: %d\n", port)
-	buffer := make([]byte, 1024)
-	for {
-		//n, err := ln.Read(buffer)
-		n, remoteAddr, err := ln.ReadFromUDP(buffer)
-		log.Printf("got message: %q\n", buffer[:n])
-		if err != nil {
-			return err
-		}
-		response := handler(string(buffer[:n]))
+	return ListenServeUDPMulti(func(msg string) []string {
+		response := handler(msg)
 		if response == "" {
-			continue
+			return nil
 		}
-		_, _ = ln.WriteToUDP([]byte(response), remoteAddr)
-		log.Printf("send message: %q\n", response)
-	}
+		return []string{response}
+	}, port)
+}
+
+func ListenServeUDPMulti(handler UDPMultiHandlerFunc, port int) error {
+	return ListenServeUDPOptions(handler, port, DefaultUDPOptions())
 }
 
 func WithMiddleware(handler HandlerFunc, ms ...Middleware) HandlerFunc {
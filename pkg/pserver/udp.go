@@ -0,0 +1,192 @@
+package pserver
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// MaxUDPDatagram is protocol limit, requests and responses must be shorter than this
+const MaxUDPDatagram = 1000
+
+const (
+	// readBufferSize is bigger than any valid request, so oversized datagrams
+	// are detected instead of being silently truncated
+	readBufferSize = 64 * 1024
+
+	// sourceIdleTime after which state of silent source is forgotten
+	sourceIdleTime = time.Minute
+	// maxSources bounds memory used for rate limiting, requests from new
+	// sources are dropped when that many sources are active
+	maxSources = 1 << 16
+)
+
+type UDPOptions struct {
+	// MaxDatagram drops requests and responses of this size or bigger, 0 disables the check
+	MaxDatagram int
+
+	// RequestRate is number of requests per second accepted from single IP, 0 means unlimited
+	RequestRate  float64
+	RequestBurst int
+
+	// ByteRate limits response bytes per second sent to single IP, so small
+	// spoofed request cannot be used to flood victim with big responses
+	ByteRate  float64
+	ByteBurst int
+}
+
+func DefaultUDPOptions() UDPOptions {
+	return UDPOptions{MaxDatagram: MaxUDPDatagram}
+}
+
+func ListenServeUDPOptions(handler UDPMultiHandlerFunc, port int, opts UDPOptions) error {
+	addr := fmt.Sprintf(":%d", port)
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return fmt.Errorf("resolve port %d: %w", port, err)
+	}
+	ln, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return fmt.Errorf("listenUPD on port %d: %w", port, err)
+	}
+	log.Printf("server started successfully, running at port: %d\n", port)
+	return ServeUDP(ln, handler, opts)
+}
+
+// ServeUDP answers requests on ln until reading fails, enforcing limits from opts
+func ServeUDP(ln *net.UDPConn, handler UDPMultiHandlerFunc, opts UDPOptions) error {
+	limiter := newSourceLimiter(opts)
+	buffer := make([]byte, readBufferSize)
+	for {
+		n, remoteAddr, err := ln.ReadFromUDP(buffer)
+		if err != nil {
+			return err
+		}
+		if opts.MaxDatagram > 0 && n >= opts.MaxDatagram {
+			log.Printf("dropping %d bytes datagram from %s\n", n, remoteAddr)
+			continue
+		}
+		log.Printf("got message: %q\n", buffer[:n])
+
+		ip := remoteAddr.IP.String()
+		now := time.Now()
+		if !limiter.allowRequest(ip, now) {
+			log.Printf("rate limit exceeded for %s, dropping request\n", ip)
+			continue
+		}
+
+		for _, response := range handler(string(buffer[:n])) {
+			if opts.MaxDatagram > 0 && len(response) >= opts.MaxDatagram {
+				log.Printf("dropping oversized response of %d bytes\n", len(response))
+				continue
+			}
+			if !limiter.allowBytes(ip, len(response), now) {
+				log.Printf("byte limit exceeded for %s, dropping remaining responses\n", ip)
+				break
+			}
+			_, _ = ln.WriteToUDP([]byte(response), remoteAddr)
+			log.Printf("send message: %q\n", response)
+		}
+	}
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take refills bucket for elapsed time and takes n tokens if available
+func (b *bucket) take(n, rate, burst float64, now time.Time) bool {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+type source struct {
+	requests bucket
+	bytes    bucket
+	seen     time.Time
+}
+
+// sourceLimiter keeps token buckets per source IP, state of idle sources is
+// dropped periodically so spoofed addresses cannot exhaust memory
+type sourceLimiter struct {
+	opts      UDPOptions
+	sources   map[string]*source
+	lastSweep time.Time
+
+	mu sync.Mutex
+}
+
+func newSourceLimiter(opts UDPOptions) *sourceLimiter {
+	return &sourceLimiter{
+		opts:    opts,
+		sources: make(map[string]*source),
+	}
+}
+
+// get returns state of source, nil when too many sources are tracked
+func (l *sourceLimiter) get(ip string, now time.Time) *source {
+	if now.Sub(l.lastSweep) > sourceIdleTime || len(l.sources) >= maxSources {
+		l.sweep(now)
+	}
+	src, ok := l.sources[ip]
+	if !ok {
+		if len(l.sources) >= maxSources {
+			return nil
+		}
+		src = &source{}
+		l.sources[ip] = src
+	}
+	src.seen = now
+	return src
+}
+
+func (l *sourceLimiter) sweep(now time.Time) {
+	for k, src := range l.sources {
+		if now.Sub(src.seen) > sourceIdleTime {
+			delete(l.sources, k)
+		}
+	}
+	l.lastSweep = now
+}
+
+func (l *sourceLimiter) allowRequest(ip string, now time.Time) bool {
+	if l.opts.RequestRate <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	src := l.get(ip, now)
+	if src == nil {
+		return false
+	}
+	burst := float64(max(l.opts.RequestBurst, 1))
+	return src.requests.take(1, l.opts.RequestRate, burst, now)
+}
+
+func (l *sourceLimiter) allowBytes(ip string, n int, now time.Time) bool {
+	if l.opts.ByteRate <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	src := l.get(ip, now)
+	if src == nil {
+		return false
+	}
+	burst := float64(max(l.opts.ByteBurst, MaxUDPDatagram))
+	return src.bytes.take(float64(n), l.opts.ByteRate, burst, now)
+}
@@ -0,0 +1,120 @@
+package pserver
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startUDP serves handler on random local port and returns connected client
+func startUDP(t *testing.T, handler UDPMultiHandlerFunc, opts UDPOptions) *net.UDPConn {
+	t.Helper()
+	ln, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("could not listen: %v\n", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go ServeUDP(ln, handler, opts)
+
+	client, err := net.DialUDP("udp", nil, ln.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("could not dial: %v\n", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// receiveAll collects datagrams until nothing arrives for a while
+func receiveAll(t *testing.T, conn *net.UDPConn) []string {
+	t.Helper()
+	var result []string
+	buf := make([]byte, readBufferSize)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, err := conn.Read(buf)
+		if err != nil {
+			return result
+		}
+		result = append(result, string(buf[:n]))
+	}
+}
+
+func echo(msg string) []string {
+	return []string{msg}
+}
+
+func TestUDPDropsOversizedRequest(t *testing.T) {
+	client := startUDP(t, echo, DefaultUDPOptions())
+
+	_, _ = client.Write([]byte(strings.Repeat("a", MaxUDPDatagram)))
+	if got := receiveAll(t, client); len(got) != 0 {
+		t.Errorf("oversized request should be dropped, got %d responses\n", len(got))
+	}
+
+	_, _ = client.Write([]byte(strings.Repeat("a", MaxUDPDatagram-1)))
+	if got := receiveAll(t, client); len(got) != 1 {
+		t.Errorf("got %d responses, want 1\n", len(got))
+	}
+}
+
+func TestUDPDropsOversizedResponse(t *testing.T) {
+	handler := func(msg string) []string {
+		return []string{strings.Repeat("b", MaxUDPDatagram), "small"}
+	}
+	client := startUDP(t, handler, DefaultUDPOptions())
+
+	_, _ = client.Write([]byte("x"))
+	got := receiveAll(t, client)
+	if len(got) != 1 || got[0] != "small" {
+		t.Errorf("got %q, want only small response\n", got)
+	}
+}
+
+func TestUDPRequestRateLimit(t *testing.T) {
+	opts := DefaultUDPOptions()
+	opts.RequestRate = 0.001
+	opts.RequestBurst = 2
+	client := startUDP(t, echo, opts)
+
+	for _, msg := range []string{"1", "2", "3"} {
+		_, _ = client.Write([]byte(msg))
+	}
+	got := receiveAll(t, client)
+	if len(got) != 2 {
+		t.Errorf("got %d responses, want 2\n", len(got))
+	}
+}
+
+func TestUDPByteRateLimit(t *testing.T) {
+	opts := DefaultUDPOptions()
+	opts.ByteRate = 0.001
+	opts.ByteBurst = MaxUDPDatagram
+	handler := func(msg string) []string {
+		part := strings.Repeat("c", 400)
+		return []string{part, part, part}
+	}
+	client := startUDP(t, handler, opts)
+
+	_, _ = client.Write([]byte("amplify"))
+	got := receiveAll(t, client)
+	if len(got) != 2 {
+		t.Errorf("got %d responses, want 2\n", len(got))
+	}
+}
+
+func TestSourceLimiterForgetsIdleSources(t *testing.T) {
+	l := newSourceLimiter(UDPOptions{RequestRate: 1, RequestBurst: 1})
+	now := time.Now()
+
+	l.allowRequest("10.0.0.1", now)
+	l.allowRequest("10.0.0.2", now.Add(sourceIdleTime/2))
+	l.allowRequest("10.0.0.3", now.Add(sourceIdleTime+time.Second))
+
+	if _, ok := l.sources["10.0.0.1"]; ok {
+		t.Errorf("idle source should be forgotten\n")
+	}
+	if len(l.sources) != 2 {
+		t.Errorf("got %d sources, want 2\n", len(l.sources))
+	}
+}